@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// agentSigner exposes a key held by ssh-agent as a crypto.Signer. The agent
+// only signs full messages, so the signer can be used to describe the
+// public key for certgen but not to sign pre-hashed digests.
+type agentSigner struct {
+	sshSigner ssh.Signer
+	publicKey crypto.PublicKey
+}
+
+func (s *agentSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+func (s *agentSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return nil, errors.New("agent held keys cannot sign pre-hashed digests")
+}
+
+func connectToAgent() (agent.Agent, io.Closer, error) {
+	socketPath := os.Getenv("SSH_AUTH_SOCK")
+	if len(socketPath) < 1 {
+		return nil, nil, errors.New("SSH_AUTH_SOCK is not set, no agent available")
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return agent.NewClient(conn), conn, nil
+}
+
+// selectAgentSigner returns the first agent key whose comment or SHA256
+// fingerprint matches keyMatch, or the first key when keyMatch is empty.
+func selectAgentSigner(sshAgent agent.Agent, keyMatch string) (*agentSigner, error) {
+	keys, err := sshAgent.List()
+	if err != nil {
+		return nil, err
+	}
+	signers, err := sshAgent.Signers()
+	if err != nil {
+		return nil, err
+	}
+	for _, signer := range signers {
+		pub := signer.PublicKey()
+		if len(keyMatch) > 0 && ssh.FingerprintSHA256(pub) != keyMatch &&
+			agentKeyComment(keys, pub) != keyMatch {
+			continue
+		}
+		cryptoPub, ok := pub.(ssh.CryptoPublicKey)
+		if !ok {
+			log.Printf("skipping agent key of type %s", pub.Type())
+			continue
+		}
+		return &agentSigner{sshSigner: signer, publicKey: cryptoPub.CryptoPublicKey()}, nil
+	}
+	return nil, errors.New("no matching key found in agent")
+}
+
+func agentKeyComment(keys []*agent.Key, pub ssh.PublicKey) string {
+	for _, key := range keys {
+		if string(key.Marshal()) == string(pub.Marshal()) {
+			return key.Comment
+		}
+	}
+	return ""
+}
+
+// getAgentSigner picks the signer from the running ssh-agent. Its public
+// key, which ssh pairs with the issued cert, is written in the commit step
+// with the certs (see newKey). The agent protocol requires the private key to attach a certificate, so
+// the cert for an agent held key is only ever written to disk.
+func getAgentSigner(keyMatch string) (crypto.Signer, error) {
+	sshAgent, conn, err := connectToAgent()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	signer, err := selectAgentSigner(sshAgent, keyMatch)
+	if err != nil {
+		return nil, err
+	}
+	if *debug {
+		log.Printf("using agent key %s", ssh.FingerprintSHA256(signer.sshSigner.PublicKey()))
+	}
+	return signer, nil
+}
+
+// addCertToAgent adds privateKey with its ssh cert to sshAgent, to be
+// removed by the agent when the cert expires.
+func addCertToAgent(sshAgent agent.Agent, privateKey crypto.Signer, cert *ssh.Certificate, now time.Time) error {
+	addedKey := agent.AddedKey{PrivateKey: privateKey, Certificate: cert, Comment: cert.KeyId}
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		lifetime := int64(cert.ValidBefore) - now.Unix()
+		if lifetime <= 0 {
+			return errors.New("ssh cert is already expired")
+		}
+		addedKey.LifetimeSecs = uint32(lifetime)
+	}
+	return sshAgent.Add(addedKey)
+}
+
+// agentPersister implements --memory-only, adding the in memory key and
+// its ssh cert to the running ssh-agent instead of writing them to disk.
+// The x509 cert cannot be held by the agent and is dropped.
+func agentPersister(privateKey crypto.Signer) persistFunc {
+	return func(material certMaterial) error {
+		if material.SSHCert == nil {
+			return errors.New("no ssh cert to add to the agent")
+		}
+		cert, err := parseSSHCert(material.SSHCert)
+		if err != nil {
+			return err
+		}
+		sshAgent, conn, err := connectToAgent()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if err := addCertToAgent(sshAgent, privateKey, cert, time.Now()); err != nil {
+			return err
+		}
+		log.Printf("added the key and ssh cert %s to ssh-agent", cert.KeyId)
+		if material.X509Cert != nil && *debug {
+			log.Printf("x509 cert not stored, --memory-only only uses ssh-agent")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestKeyring(t *testing.T, comments ...string) agent.Agent {
+	keyring := agent.NewKeyring()
+	for _, comment := range comments {
+		privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = keyring.Add(agent.AddedKey{PrivateKey: privateKey, Comment: comment})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keyring
+}
+
+func TestSelectAgentSignerByComment(t *testing.T) {
+	keyring := newTestKeyring(t, "first", "second")
+	signer, err := selectAgentSigner(keyring, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := keyring.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agentKeyComment(keys, signer.sshSigner.PublicKey()) != "second" {
+		t.Fatal("selected the wrong agent key")
+	}
+	if _, ok := signer.Public().(*rsa.PublicKey); !ok {
+		t.Fatal("agent signer should expose the rsa public key")
+	}
+}
+
+func TestSelectAgentSignerByFingerprint(t *testing.T) {
+	keyring := newTestKeyring(t, "first", "second")
+	keys, err := keyring.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := ssh.FingerprintSHA256(keys[1])
+	signer, err := selectAgentSigner(keyring, fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssh.FingerprintSHA256(signer.sshSigner.PublicKey()) != fingerprint {
+		t.Fatal("selected the wrong agent key")
+	}
+}
+
+func TestSelectAgentSignerFailNoMatch(t *testing.T) {
+	keyring := newTestKeyring(t, "first")
+	_, err := selectAgentSigner(keyring, "nonexistent")
+	if err == nil {
+		t.Fatal("Should have failed with no matching key")
+	}
+}
+
+func TestGetCertFromTargetUrlsFakeServerAgentSigner(t *testing.T) {
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	keyring := agent.NewKeyring()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.Add(agent.AddedKey{PrivateKey: edKey, Comment: "ed25519"}); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := selectAgentSigner(keyring, "ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshCert, x509Cert, err := getCertFromTargetUrls(signer, "username", []byte("password"),
+		[]string{fake.URL}, fake.RootCAs(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sshCert == nil {
+		t.Fatal("missing ssh cert for the agent key")
+	}
+	block, _ := pem.Decode(x509Cert)
+	if block == nil {
+		t.Fatal("cannot decode the x509 cert")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !edKey.Public().(ed25519.PublicKey).Equal(cert.PublicKey) {
+		t.Fatal("x509 cert is not for the agent key")
+	}
+}
+
+func TestAddCertToAgent(t *testing.T) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caSigner, err := ssh.NewSignerFromSigner(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(privateKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             pub,
+		CertType:        ssh.UserCert,
+		KeyId:           "keymaster_username",
+		ValidPrincipals: []string{"username"},
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := addCertToAgent(keyring, privateKey, cert, now); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := keyring.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Format != ssh.CertAlgoRSAv01 || keys[0].Comment != "keymaster_username" {
+		t.Fatalf("expected the cert in the agent, got %v", keys)
+	}
+	if err := addCertToAgent(keyring, privateKey, cert, now.Add(2*time.Hour)); err == nil {
+		t.Fatal("should have refused an expired cert")
+	}
+}
+
+func TestAgentKeyCommitWithBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*useAgentKey = true
+	defer func() { *useAgentKey = false }()
+	privateKeyPath := filepath.Join(dir, "keymaster")
+	pubKeyPath := publicKeyPath(privateKeyPath)
+	if err := ioutil.WriteFile(pubKeyPath, []byte("old pub"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := selectAgentSigner(newTestKeyring(t, "agent"), "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backups, err := backupExisting(onExistingBackup, existingPaths(managedFiles(privateKeyPath)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || backups[0] != pubKeyPath {
+		t.Fatalf("unexpected backups %v", backups)
+	}
+	persisted := false
+	persist := func(material certMaterial) error {
+		persisted = true
+		return nil
+	}
+	err = writeNewKeysAndCerts(persist, []certMaterial{{}},
+		newKey{path: privateKeyPath, signer: signer, pubOnly: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !persisted {
+		t.Fatal("the certs were not persisted")
+	}
+	content, err := ioutil.ReadFile(pubKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != string(ssh.MarshalAuthorizedKey(signer.sshSigner.PublicKey())) {
+		t.Fatalf("%s does not hold the agent key: %s", pubKeyPath, content)
+	}
+	content, err = ioutil.ReadFile(pubKeyPath + backupSuffix)
+	if err != nil || string(content) != "old pub" {
+		t.Fatalf("expected the previous pub in the backup, got '%s': %v", content, err)
+	}
+	if _, err := os.Stat(privateKeyPath); err == nil {
+		t.Fatal("no private key should be written for an agent key")
+	}
+}
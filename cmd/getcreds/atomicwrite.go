@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// writeFileAtomic replaces path with content so that readers never see a
+// partial file, nor an empty one after a crash: the content is synced
+// before the rename, and the directory after it. The temp file, named after prefix, is created next to
+// path or in --temp-dir for directories only allowing the final files.
+// A rename across filesystems failing, the content is then copied over
+// path and synced instead, which is not atomic. Other rename errors, such
+// as a permission denied, are returned.
+func writeFileAtomic(path string, content []byte, mode os.FileMode, prefix string) error {
+	dir := filepath.Dir(path)
+	if len(*tempDir) > 0 {
+		dir = *tempDir
+	}
+	tmpFile, err := ioutil.TempFile(dir, prefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpFile.Name(), mode); err != nil {
+		return err
+	}
+	err = os.Rename(tmpFile.Name(), path)
+	if err == nil {
+		return syncDir(filepath.Dir(path))
+	}
+	if dir == filepath.Dir(path) || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if *debug {
+		log.Printf("cannot rename %s to %s, copying it instead: %s", tmpFile.Name(), path, err)
+	}
+	return copyFileSynced(path, content, mode)
+}
+
+func copyFileSynced(path string, content []byte, mode os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
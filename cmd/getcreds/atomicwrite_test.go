@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomicTempDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster-atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	targetDir, otherDir := filepath.Join(dir, "ssh"), filepath.Join(dir, "tmp")
+	for _, path := range []string{targetDir, otherDir} {
+		if err := os.Mkdir(path, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	*tempDir = otherDir
+	defer func() { *tempDir = "" }()
+	path := filepath.Join(targetDir, "known_hosts")
+	if err := writeFileAtomic(path, []byte("content"), 0644, ".keymaster-test-"); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil || string(content) != "content" {
+		t.Fatalf("unexpected content '%s': %v", content, err)
+	}
+	for _, checkDir := range []string{targetDir, otherDir} {
+		files, err := ioutil.ReadDir(checkDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checkDir == otherDir && len(files) != 0 || checkDir == targetDir && len(files) != 1 {
+			t.Fatalf("temp file left behind in %s", checkDir)
+		}
+	}
+}
+
+func TestCopyFileSynced(t *testing.T) {
+	tmpfile, err := createTempFileWithStringContent("test_copyFileSynced", "a longer previous content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+	if err := copyFileSynced(tmpfile.Name(), []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(tmpfile.Name())
+	if err != nil || string(content) != "new" {
+		t.Fatalf("unexpected content '%s': %v", content, err)
+	}
+	fileInfo, err := os.Stat(tmpfile.Name())
+	if err != nil || fileInfo.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected mode %v: %v", fileInfo.Mode(), err)
+	}
+}
+
+func TestSyncDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster-atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := syncDir(dir); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Prefix of the certgen form fields carrying the --attr attributes, which
+// keeps them apart from the fields the server already uses.
+const attributeFieldPrefix = "attr_"
+
+var attributeKeyRegexp = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+// attributesFlag collects the repeatable --attr key=value flags.
+type attributesFlag []string
+
+var identityAttributes attributesFlag
+
+func (attributes *attributesFlag) String() string {
+	return strings.Join(*attributes, ",")
+}
+
+func (attributes *attributesFlag) Set(value string) error {
+	splitValue := strings.SplitN(value, "=", 2)
+	if len(splitValue) != 2 || !attributeKeyRegexp.MatchString(splitValue[0]) {
+		return fmt.Errorf("attribute '%s' is not in key=value form", value)
+	}
+	*attributes = append(*attributes, value)
+	return nil
+}
+
+// attributeFields returns the --attr attributes as certgen form fields.
+func attributeFields() url.Values {
+	fields := url.Values{}
+	for _, attribute := range identityAttributes {
+		splitValue := strings.SplitN(attribute, "=", 2)
+		fields.Add(attributeFieldPrefix+splitValue[0], splitValue[1])
+	}
+	return fields
+}
+
+// sortedKeys returns the keys of values in order, for output that does not
+// change between runs.
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
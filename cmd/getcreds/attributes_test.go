@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+)
+
+func TestAttributesFlagSet(t *testing.T) {
+	var attributes attributesFlag
+	for _, valid := range []string{"ticket=OPS-1234", "project=key=master", "empty="} {
+		if err := attributes.Set(valid); err != nil {
+			t.Errorf("'%s' should be valid: %s", valid, err)
+		}
+	}
+	for _, invalid := range []string{"noequals", "=value", "bad key=value"} {
+		if err := attributes.Set(invalid); err == nil {
+			t.Errorf("'%s' should be rejected", invalid)
+		}
+	}
+}
+
+func TestGetCertFromTargetUrlsFakeServerSendsAttributes(t *testing.T) {
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityAttributes = attributesFlag{"ticket=OPS-1234", "department=sre"}
+	defer func() { identityAttributes = nil }()
+	_, _, err = getCertFromTargetUrls(privateKey, "username", []byte("password"),
+		[]string{fake.URL}, fake.RootCAs(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range fake.Requests {
+		if !strings.HasPrefix(r.URL.Path, "/certgen/") {
+			continue
+		}
+		if r.MultipartForm == nil || strings.Join(r.MultipartForm.Value["attr_ticket"], ",") != "OPS-1234" ||
+			strings.Join(r.MultipartForm.Value["attr_department"], ",") != "sre" {
+			t.Fatalf("attributes not sent as form fields with the %s request", r.Form.Get("type"))
+		}
+	}
+}
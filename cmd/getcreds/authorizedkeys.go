@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"golang.org/x/crypto/ssh"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// findAuthorizedKey returns the line numbers of authorizedKeysPath holding
+// the same raw key as pub, whatever their options or comment. A missing
+// file holds no keys.
+func findAuthorizedKey(authorizedKeysPath string, pub ssh.PublicKey) ([]int, error) {
+	file, err := os.Open(authorizedKeysPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	rawKey := pub.Marshal()
+	var lines []int
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		key, _, _, _, err := ssh.ParseAuthorizedKey(scanner.Bytes())
+		if err != nil {
+			// comments, blank or unparseable lines
+			continue
+		}
+		if bytes.Equal(key.Marshal(), rawKey) {
+			lines = append(lines, lineNumber)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// checkAuthorizedKeys implements --check-authorized-keys, warning when the
+// public key just written is also in the authorized_keys next to it, which
+// is usually a stale manual entry granting access without any cert.
+func checkAuthorizedKeys(privateKeyPath string, pub ssh.PublicKey) {
+	authorizedKeysPath := filepath.Join(filepath.Dir(privateKeyPath), "authorized_keys")
+	lines, err := findAuthorizedKey(authorizedKeysPath, pub)
+	if err != nil {
+		log.Printf("cannot check %s: %s", authorizedKeysPath, err)
+		return
+	}
+	for _, line := range lines {
+		log.Printf("WARNING: the key %s is already in %s line %d", ssh.FingerprintSHA256(pub),
+			authorizedKeysPath, line)
+	}
+}
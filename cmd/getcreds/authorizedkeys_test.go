@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindAuthorizedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster-authorized-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var pubs []ssh.PublicKey
+	for i := 0; i < 2; i++ {
+		privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := ssh.NewPublicKey(privateKey.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubs = append(pubs, pub)
+	}
+	authorizedKeysPath := filepath.Join(dir, "authorized_keys")
+	if lines, err := findAuthorizedKey(authorizedKeysPath, pubs[0]); err != nil || lines != nil {
+		t.Fatalf("missing file should hold no keys, got %v %v", lines, err)
+	}
+	authorizedKeys := "# managed by hand\n" +
+		string(ssh.MarshalAuthorizedKey(pubs[1])) +
+		"\n" +
+		`from="10.0.0.0/8" ` + string(ssh.MarshalAuthorizedKey(pubs[0]))
+	if err := ioutil.WriteFile(authorizedKeysPath, []byte(authorizedKeys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	lines, err := findAuthorizedKey(authorizedKeysPath, pubs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lines, []int{4}) {
+		t.Fatalf("expected the key on line 4, got %v", lines)
+	}
+}
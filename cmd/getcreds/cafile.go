@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// caFilesInPath returns path itself when it is a file or the regular files
+// directly inside it when it is a directory. Hashed directories such as
+// /etc/ssl/certs only hold symlinks, so links are followed.
+func caFilesInPath(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var filenames []string
+	for _, entry := range entries {
+		filename := filepath.Join(path, entry.Name())
+		entryInfo, err := os.Stat(filename)
+		if err != nil || !entryInfo.Mode().IsRegular() {
+			continue
+		}
+		filenames = append(filenames, filename)
+	}
+	return filenames, nil
+}
+
+// loadRootCAs builds the pool of CAs used to verify the keymaster servers
+// from a comma separated list of PEM files or directories of PEM files.
+// Files without any PEM cert are skipped, but at least one cert must load.
+func loadRootCAs(caPaths string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	loaded := 0
+	for _, caPath := range strings.Split(caPaths, ",") {
+		caPath = strings.TrimSpace(caPath)
+		if len(caPath) < 1 {
+			continue
+		}
+		filenames, err := caFilesInPath(caPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, filename := range filenames {
+			pemData, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pemData) {
+				if *debug {
+					log.Printf("no CA certs found in '%s', skipping", filename)
+				}
+				continue
+			}
+			loaded++
+		}
+	}
+	if loaded < 1 {
+		return nil, errors.New("no CA certs could be loaded from " + caPaths)
+	}
+	if *debug {
+		log.Printf("loaded CA certs from %d files", loaded)
+	}
+	return pool, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadRootCAsFromFilesAndDirectory(t *testing.T) {
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	dir, err := ioutil.TempDir("", "keymaster-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caDir := filepath.Join(dir, "certs")
+	if err := os.Mkdir(caDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: fake.Certificate().Raw})
+	if err := ioutil.WriteFile(filepath.Join(caDir, "internal.pem"), caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(caDir, "README"), []byte("not a cert"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	extraFile := filepath.Join(dir, "extra.pem")
+	if err := ioutil.WriteFile(extraFile, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := loadRootCAs(caDir + "," + extraFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fake.Certificate().Verify(x509.VerifyOptions{Roots: pool}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadRootCAs(filepath.Join(caDir, "README")); err == nil {
+		t.Fatal("should have failed with no loadable certs")
+	}
+	if _, err := loadRootCAs(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("should have failed on a missing path")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"log"
+	"time"
+)
+
+// sshCertLifetime is the validity period of cert, the validity dates
+// themselves change on every issuance.
+func sshCertLifetime(cert *ssh.Certificate) time.Duration {
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		return 0
+	}
+	return time.Duration(cert.ValidBefore-cert.ValidAfter) * time.Second
+}
+
+func describeLifetime(lifetime time.Duration) string {
+	if lifetime == 0 {
+		return "forever"
+	}
+	return lifetime.String()
+}
+
+// diffStringMaps describes the entries of kind added, removed or changed
+// between previous and current.
+func diffStringMaps(kind string, previous, current map[string]string) []string {
+	var changes []string
+	for _, name := range sortedKeys(current) {
+		previousValue, ok := previous[name]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("%s %s added", kind, name))
+		case previousValue != current[name]:
+			changes = append(changes, fmt.Sprintf("%s %s changed from '%s' to '%s'",
+				kind, name, previousValue, current[name]))
+		}
+	}
+	for _, name := range sortedKeys(previous) {
+		if _, ok := current[name]; !ok {
+			changes = append(changes, fmt.Sprintf("%s %s removed", kind, name))
+		}
+	}
+	return changes
+}
+
+// diffSSHCerts describes the policy changes between the previous and the
+// current ssh cert: principals, critical options, extensions, lifetime,
+// key id and signing CA.
+func diffSSHCerts(previous, current *ssh.Certificate) []string {
+	previousPrincipals := make(map[string]string)
+	for _, principal := range previous.ValidPrincipals {
+		previousPrincipals[principal] = ""
+	}
+	currentPrincipals := make(map[string]string)
+	for _, principal := range current.ValidPrincipals {
+		currentPrincipals[principal] = ""
+	}
+	changes := diffStringMaps("principal", previousPrincipals, currentPrincipals)
+	changes = append(changes, diffStringMaps("critical option",
+		previous.CriticalOptions, current.CriticalOptions)...)
+	changes = append(changes, diffStringMaps("extension",
+		previous.Extensions, current.Extensions)...)
+	if previousLifetime, lifetime := sshCertLifetime(previous), sshCertLifetime(current); previousLifetime != lifetime {
+		changes = append(changes, fmt.Sprintf("lifetime changed from %s to %s",
+			describeLifetime(previousLifetime), describeLifetime(lifetime)))
+	}
+	if previous.KeyId != current.KeyId {
+		changes = append(changes, fmt.Sprintf("key id changed from '%s' to '%s'",
+			previous.KeyId, current.KeyId))
+	}
+	previousCA, currentCA := ssh.FingerprintSHA256(previous.SignatureKey),
+		ssh.FingerprintSHA256(current.SignatureKey)
+	if previousCA != currentCA {
+		changes = append(changes, fmt.Sprintf("signing CA changed from %s to %s",
+			previousCA, currentCA))
+	}
+	return changes
+}
+
+// logSSHCertDiff implements --cert-diff, logging how the new ssh cert
+// differs from the one it replaces. Nothing is logged without a previous
+// cert.
+func logSSHCertDiff(previousCert, currentCert []byte) {
+	if previousCert == nil || currentCert == nil {
+		return
+	}
+	previous, err := parseSSHCert(previousCert)
+	if err != nil {
+		log.Printf("cannot parse the previous ssh cert: %s", err)
+		return
+	}
+	current, err := parseSSHCert(currentCert)
+	if err != nil {
+		return
+	}
+	changes := diffSSHCerts(previous, current)
+	if len(changes) < 1 {
+		log.Printf("ssh cert policy unchanged from the previous cert")
+		return
+	}
+	for _, change := range changes {
+		log.Printf("ssh cert %s", change)
+	}
+}
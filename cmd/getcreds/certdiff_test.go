@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"golang.org/x/crypto/ssh"
+	"reflect"
+	"testing"
+)
+
+func TestDiffSSHCerts(t *testing.T) {
+	caKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPub, err := ssh.NewPublicKey(caKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := &ssh.Certificate{
+		KeyId:           "keymaster_username",
+		ValidPrincipals: []string{"username", "admin"},
+		ValidAfter:      1000,
+		ValidBefore:     1000 + 16*3600,
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{"permit-pty": "", "permit-port-forwarding": ""},
+		},
+		SignatureKey: caPub,
+	}
+	current := &ssh.Certificate{
+		KeyId:           "keymaster_username",
+		ValidPrincipals: []string{"username"},
+		ValidAfter:      90000,
+		ValidBefore:     90000 + 16*3600,
+		Permissions: ssh.Permissions{
+			CriticalOptions: map[string]string{"source-address": "10.0.0.0/8"},
+			Extensions:      map[string]string{"permit-pty": ""},
+		},
+		SignatureKey: caPub,
+	}
+	if changes := diffSSHCerts(previous, previous); len(changes) != 0 {
+		t.Fatalf("unexpected changes %v", changes)
+	}
+	expected := []string{
+		"principal admin removed",
+		"critical option source-address added",
+		"extension permit-port-forwarding removed",
+	}
+	if changes := diffSSHCerts(previous, current); !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("expected %v got %v", expected, changes)
+	}
+	current.ValidBefore = ssh.CertTimeInfinity
+	changes := diffSSHCerts(previous, current)
+	if changes[len(changes)-1] != "lifetime changed from 16h0m0s to forever" {
+		t.Fatalf("unexpected lifetime change %v", changes)
+	}
+}
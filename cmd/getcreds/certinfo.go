@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Exit codes used by --validate-only
+const (
+	exitCodeCertExpiring = 4
+	exitCodeCertExpired  = 5
+	exitCodeCertInvalid  = 6
+)
+
+func parseSSHCert(certBytes []byte) (*ssh.Certificate, error) {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("not an ssh certificate")
+	}
+	return cert, nil
+}
+
+// validateSourceAddress checks the value follows the format of the
+// source-address critical option: a comma separated list of addresses or
+// CIDR blocks.
+func validateSourceAddress(sourceAddress string) error {
+	for _, entry := range strings.Split(sourceAddress, ",") {
+		if strings.Contains(entry, "/") {
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				return fmt.Errorf("invalid source address '%s'", entry)
+			}
+			continue
+		}
+		if net.ParseIP(entry) == nil {
+			return fmt.Errorf("invalid source address '%s'", entry)
+		}
+	}
+	return nil
+}
+
+// logSSHCertRestrictions displays the restrictions the server granted,
+// warning when a requested source-address was not applied.
+func logSSHCertRestrictions(certBytes []byte) error {
+	cert, err := parseSSHCert(certBytes)
+	if err != nil {
+		return err
+	}
+	granted, ok := cert.CriticalOptions["source-address"]
+	if ok {
+		log.Printf("ssh cert restricted to source-address: %s", granted)
+	}
+	if len(*sourceAddress) > 0 && granted != *sourceAddress {
+		log.Printf("WARNING: requested source-address '%s' was not granted by the server", *sourceAddress)
+	}
+	for _, warning := range checkSSHCertSignature(cert, *sshSignatureAlgorithm) {
+		log.Printf("WARNING: %s", warning)
+	}
+	log.Printf("ssh cert key id: %s", cert.KeyId)
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		log.Printf("ssh cert %s", describeExpiry(time.Unix(int64(cert.ValidBefore), 0), time.Now()))
+	}
+	if warning := checkSSHCertKeyID(cert, *sshKeyID); len(warning) > 0 {
+		log.Printf("WARNING: %s", warning)
+	}
+	if *includeHostname {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		if where := findEmbeddedHostname(cert, hostname); len(where) > 0 {
+			log.Printf("ssh cert embeds the hostname %s in its %s", hostname, where)
+		} else {
+			log.Printf("the server did not embed the hostname %s in the ssh cert", hostname)
+		}
+	}
+	return nil
+}
+
+// Longest --ssh-key-id accepted, key ids end up in every sshd log line.
+const maxSSHKeyIDLength = 256
+
+func validateSSHKeyID(keyID string) error {
+	if len(keyID) > maxSSHKeyIDLength {
+		return fmt.Errorf("ssh key id is longer than %d characters", maxSSHKeyIDLength)
+	}
+	for _, r := range keyID {
+		if !unicode.IsPrint(r) {
+			return fmt.Errorf("ssh key id %q contains non printable characters", keyID)
+		}
+	}
+	return nil
+}
+
+// checkSSHCertKeyID returns a warning when the server did not embed the
+// requested key id in cert.
+func checkSSHCertKeyID(cert *ssh.Certificate, requested string) string {
+	if len(requested) < 1 || cert.KeyId == requested {
+		return ""
+	}
+	return fmt.Sprintf("requested key id '%s' was not granted by the server", requested)
+}
+
+// Signature algorithms that can be requested for the ssh cert.
+var sshSignatureAlgorithms = []string{"rsa-sha2-512", "rsa-sha2-256", "ssh-rsa",
+	"ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521", "ssh-ed25519"}
+
+func validateSSHSignatureAlgorithm(algorithm string) error {
+	for _, known := range sshSignatureAlgorithms {
+		if algorithm == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown ssh signature algorithm '%s', use one of %s",
+		algorithm, strings.Join(sshSignatureAlgorithms, ", "))
+}
+
+// checkSSHCertSignature returns warnings when the CA signed cert with
+// another algorithm than the requested one or with the SHA-1 based ssh-rsa
+// that current OpenSSH versions reject.
+func checkSSHCertSignature(cert *ssh.Certificate, requested string) []string {
+	var warnings []string
+	if cert.Signature == nil {
+		return []string{"ssh cert has no signature"}
+	}
+	format := cert.Signature.Format
+	if len(requested) > 0 && format != requested {
+		warnings = append(warnings, fmt.Sprintf(
+			"requested ssh cert signature algorithm %s but the server used %s", requested, format))
+	}
+	if format == "ssh-rsa" {
+		warnings = append(warnings,
+			"ssh cert is signed with the deprecated SHA-1 ssh-rsa algorithm, newer ssh servers will reject it")
+	}
+	return warnings
+}
+
+// findEmbeddedHostname returns where in cert the server placed hostname:
+// the key id, a critical option or an extension, or "" if it is absent.
+func findEmbeddedHostname(cert *ssh.Certificate, hostname string) string {
+	if strings.Contains(cert.KeyId, hostname) {
+		return "key id"
+	}
+	for name, value := range cert.CriticalOptions {
+		if strings.Contains(value, hostname) {
+			return "critical option " + name
+		}
+	}
+	for name, value := range cert.Extensions {
+		if strings.Contains(value, hostname) {
+			return "extension " + name
+		}
+	}
+	return ""
+}
+
+// checkSSHCertValidity returns the --validate-only exit code for cert
+// together with a description of the problem found, if any.
+func checkSSHCertValidity(cert *ssh.Certificate, userName string, now time.Time, minValidity time.Duration) (int, string) {
+	if cert.CertType != ssh.UserCert {
+		return exitCodeCertInvalid, "not a user certificate"
+	}
+	if len(cert.ValidPrincipals) > 0 {
+		found := false
+		for _, principal := range cert.ValidPrincipals {
+			if principal == userName {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return exitCodeCertInvalid, fmt.Sprintf("user %s is not in the cert principals %v",
+				userName, cert.ValidPrincipals)
+		}
+	}
+	if uint64(now.Unix()) < cert.ValidAfter {
+		return exitCodeCertInvalid, "cert is not yet valid"
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		validBefore := time.Unix(int64(cert.ValidBefore), 0)
+		if !now.Before(validBefore) {
+			return exitCodeCertExpired, "cert " + describeExpiry(validBefore, now)
+		}
+		if validBefore.Sub(now) < minValidity {
+			return exitCodeCertExpiring, "cert " + describeExpiry(validBefore, now)
+		}
+		return 0, "cert is valid, " + describeExpiry(validBefore, now)
+	}
+	return 0, "cert is valid"
+}
+
+// describeExpiry describes validBefore in the local timezone together with
+// the time left, as in "expires at 2017-01-05 18:30 CET (in 7h23m)", which
+// is easier to act on than a UTC timestamp.
+func describeExpiry(validBefore time.Time, now time.Time) string {
+	local := validBefore.Local().Format("2006-01-02 15:04 MST")
+	left := validBefore.Sub(now)
+	if left <= 0 {
+		return fmt.Sprintf("expired at %s (%s ago)", local, formatRelative(-left))
+	}
+	return fmt.Sprintf("expires at %s (in %s)", local, formatRelative(left))
+}
+
+// formatRelative rounds d to the minute, or to the second under a minute,
+// and drops the zero units of time.Duration.String, as in 7h23m or 2d3h.
+func formatRelative(d time.Duration) string {
+	if d < time.Minute {
+		return d.Round(time.Second).String()
+	}
+	d = d.Round(time.Minute)
+	var relative string
+	if days := d / (24 * time.Hour); days > 0 {
+		relative = fmt.Sprintf("%dd", days)
+		d -= days * 24 * time.Hour
+	}
+	if hours := d / time.Hour; hours > 0 {
+		relative += fmt.Sprintf("%dh", hours)
+		d -= hours * time.Hour
+	}
+	if minutes := d / time.Minute; minutes > 0 {
+		relative += fmt.Sprintf("%dm", minutes)
+	}
+	return relative
+}
+
+// validateCertFile implements --validate-only, it never touches the network.
+func validateCertFile(certPath string, minValidity time.Duration) (int, error) {
+	certBytes, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return 0, err
+	}
+	cert, err := parseSSHCert(certBytes)
+	if err != nil {
+		return exitCodeCertInvalid, err
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return 0, err
+	}
+	exitCode, reason := checkSSHCertValidity(cert, usr.Username, time.Now(), minValidity)
+	log.Printf("%s: %s", certPath, reason)
+	return exitCode, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateSourceAddress(t *testing.T) {
+	for _, valid := range []string{"10.0.0.1", "10.0.0.0/8,192.168.1.1", "2001:db8::/32"} {
+		if err := validateSourceAddress(valid); err != nil {
+			t.Fatalf("'%s' should be valid: %s", valid, err)
+		}
+	}
+	for _, invalid := range []string{"", "office", "10.0.0.0/33", "10.0.0.1, 10.0.0.2"} {
+		if err := validateSourceAddress(invalid); err == nil {
+			t.Fatalf("'%s' should be invalid", invalid)
+		}
+	}
+}
+
+func TestParseSSHCertFailNotACert(t *testing.T) {
+	_, err := parseSSHCert([]byte(testUserPublicKey))
+	if err == nil {
+		t.Fatal("Should have failed on a plain public key")
+	}
+}
+
+func TestCheckSSHCertValidity(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	cert := &ssh.Certificate{
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"username"},
+		ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(now.Add(8 * time.Hour).Unix()),
+	}
+	if code, reason := checkSSHCertValidity(cert, "username", now, time.Hour); code != 0 {
+		t.Fatalf("cert should be valid: %s", reason)
+	}
+	if code, _ := checkSSHCertValidity(cert, "username", now, 10*time.Hour); code != exitCodeCertExpiring {
+		t.Fatalf("cert should be expiring, got %d", code)
+	}
+	if code, _ := checkSSHCertValidity(cert, "username", now.Add(9*time.Hour), time.Hour); code != exitCodeCertExpired {
+		t.Fatalf("cert should be expired, got %d", code)
+	}
+	if code, _ := checkSSHCertValidity(cert, "other", now, time.Hour); code != exitCodeCertInvalid {
+		t.Fatalf("cert should be invalid for another user, got %d", code)
+	}
+	if code, _ := checkSSHCertValidity(cert, "username", now.Add(-2*time.Hour), time.Hour); code != exitCodeCertInvalid {
+		t.Fatalf("cert should not be valid yet, got %d", code)
+	}
+}
+
+func TestFindEmbeddedHostname(t *testing.T) {
+	cert := &ssh.Certificate{KeyId: "keymaster_username"}
+	if where := findEmbeddedHostname(cert, "laptop1"); where != "" {
+		t.Fatalf("hostname should not be found, got %s", where)
+	}
+	cert.Extensions = map[string]string{"origin-host@keymaster": "laptop1"}
+	if where := findEmbeddedHostname(cert, "laptop1"); where != "extension origin-host@keymaster" {
+		t.Fatalf("unexpected location '%s'", where)
+	}
+	cert.KeyId = "keymaster_username_laptop1"
+	if where := findEmbeddedHostname(cert, "laptop1"); where != "key id" {
+		t.Fatalf("unexpected location '%s'", where)
+	}
+}
+
+func TestCheckSSHCertSignature(t *testing.T) {
+	cert := &ssh.Certificate{Signature: &ssh.Signature{Format: "rsa-sha2-512"}}
+	if warnings := checkSSHCertSignature(cert, "rsa-sha2-512"); len(warnings) != 0 {
+		t.Fatalf("unexpected warnings %v", warnings)
+	}
+	cert.Signature.Format = "ssh-rsa"
+	if warnings := checkSSHCertSignature(cert, "rsa-sha2-512"); len(warnings) != 2 {
+		t.Fatalf("expected downgrade and SHA-1 warnings, got %v", warnings)
+	}
+	if warnings := checkSSHCertSignature(cert, ""); len(warnings) != 1 {
+		t.Fatalf("expected a SHA-1 warning, got %v", warnings)
+	}
+	if err := validateSSHSignatureAlgorithm("rsa-sha1"); err == nil {
+		t.Fatal("should have rejected an unknown algorithm")
+	}
+}
+
+func TestValidateSSHKeyID(t *testing.T) {
+	if err := validateSSHKeyID("username@laptop1 ticket-1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateSSHKeyID("username\nforged log line"); err == nil {
+		t.Fatal("should have failed on a newline")
+	}
+	if err := validateSSHKeyID(strings.Repeat("a", maxSSHKeyIDLength+1)); err == nil {
+		t.Fatal("should have failed on a too long key id")
+	}
+}
+
+func TestCheckSSHCertKeyID(t *testing.T) {
+	cert := &ssh.Certificate{KeyId: "keymaster_username"}
+	if warning := checkSSHCertKeyID(cert, ""); warning != "" {
+		t.Fatalf("unexpected warning %s", warning)
+	}
+	if warning := checkSSHCertKeyID(cert, "ticket-1234"); warning == "" {
+		t.Fatal("expected a warning for the key id not granted")
+	}
+	cert.KeyId = "ticket-1234"
+	if warning := checkSSHCertKeyID(cert, "ticket-1234"); warning != "" {
+		t.Fatalf("unexpected warning %s", warning)
+	}
+}
+
+func TestDescribeExpiry(t *testing.T) {
+	now := time.Date(2017, 1, 5, 10, 0, 0, 0, time.UTC)
+	tests := map[time.Duration]string{
+		7*time.Hour + 23*time.Minute + 10*time.Second: "in 7h23m",
+		50*time.Hour + 10*time.Second:                 "in 2d2h",
+		45 * time.Second:                              "in 45s",
+		-2 * time.Hour:                                "2h ago",
+	}
+	for left, expected := range tests {
+		description := describeExpiry(now.Add(left), now)
+		if !strings.HasSuffix(description, "("+expected+")") {
+			t.Errorf("expected '%s' in '%s'", expected, description)
+		}
+		local := now.Add(left).Local().Format("2006-01-02 15:04 MST")
+		if !strings.Contains(description, local) {
+			t.Errorf("expected the local time %s in '%s'", local, description)
+		}
+	}
+}
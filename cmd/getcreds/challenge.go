@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/Symantec/keymaster/lib/certgen"
+	"io/ioutil"
+)
+
+// signChallenge signs message with signer returning the name of the
+// algorithm used together with the signature.
+func signChallenge(signer crypto.Signer, message []byte) (string, []byte, error) {
+	if agentKey, ok := signer.(*agentSigner); ok {
+		signature, err := agentKey.sshSigner.Sign(rand.Reader, message)
+		if err != nil {
+			return "", nil, err
+		}
+		return signature.Format, signature.Blob, nil
+	}
+	switch signer.Public().(type) {
+	case ed25519.PublicKey:
+		signature, err := signer.Sign(rand.Reader, message, crypto.Hash(0))
+		return "Ed25519", signature, err
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if _, isRSA := signer.Public().(*rsa.PublicKey); isRSA {
+			return "RSA-PKCS1v15-SHA256", signature, err
+		}
+		return "ECDSA-SHA256", signature, err
+	}
+	return "", nil, errors.New("unsupported key type")
+}
+
+// signChallengeCommand signs the challenge given as argument with the
+// current keymaster key so that proof of possession flows can be debugged
+// without involving the server.
+func signChallengeCommand(args []string, privateKeyPath string) error {
+	if len(args) != 1 {
+		return errors.New("usage: sign-challenge <challenge>")
+	}
+	var signer crypto.Signer
+	var err error
+	if *useAgentKey {
+		sshAgent, conn, err := connectToAgent()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		signer, err = selectAgentSigner(sshAgent, *agentKeyMatch)
+		if err != nil {
+			return err
+		}
+	} else {
+		pemKey, err := ioutil.ReadFile(privateKeyPath)
+		if err != nil {
+			return err
+		}
+		signer, err = certgen.GetSignerFromPEMBytes(pemKey)
+		if err != nil {
+			return err
+		}
+	}
+	algorithm, signature, err := signChallenge(signer, []byte(args[0]))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("algorithm: %s\nsignature: %s\n", algorithm,
+		base64.StdEncoding.EncodeToString(signature))
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"golang.org/x/crypto/ssh"
+	"testing"
+)
+
+func TestSignChallengeRSA(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	algorithm, signature, err := signChallenge(privateKey, []byte("challenge"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algorithm != "RSA-PKCS1v15-SHA256" {
+		t.Fatalf("unexpected algorithm %s", algorithm)
+	}
+	digest := sha256.Sum256([]byte("challenge"))
+	err = rsa.VerifyPKCS1v15(&privateKey.PublicKey, crypto.SHA256, digest[:], signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignChallengeECDSA(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	algorithm, signature, err := signChallenge(privateKey, []byte("challenge"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algorithm != "ECDSA-SHA256" {
+		t.Fatalf("unexpected algorithm %s", algorithm)
+	}
+	digest := sha256.Sum256([]byte("challenge"))
+	if !ecdsa.VerifyASN1(&privateKey.PublicKey, digest[:], signature) {
+		t.Fatal("signature does not verify")
+	}
+}
+
+func TestSignChallengeEd25519(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, signature, err := signChallenge(privateKey, []byte("challenge"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(publicKey, []byte("challenge"), signature) {
+		t.Fatal("signature does not verify")
+	}
+}
+
+func TestSignChallengeAgent(t *testing.T) {
+	signer, err := selectAgentSigner(newTestKeyring(t, "agentkey"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	algorithm, blob, err := signChallenge(signer, []byte("challenge"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := &ssh.Signature{Format: algorithm, Blob: blob}
+	err = signer.sshSigner.PublicKey().Verify([]byte("challenge"), signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/zalando/go-keyring"
+	"io/ioutil"
+	"log"
+	"os/user"
+	"sync"
+)
+
+var (
+	clientCertOnce sync.Once
+	clientCert     *tls.Certificate
+	clientCertErr  error
+)
+
+// getClientCertificate returns the TLS client cert presented to the
+// servers, nil when none is configured. It is loaded once as reading the
+// keyring may prompt the user.
+func getClientCertificate() (*tls.Certificate, error) {
+	clientCertOnce.Do(func() {
+		clientCert, clientCertErr = loadClientCertificate()
+	})
+	return clientCert, clientCertErr
+}
+
+// loadClientCertificate loads the client cert from the --tls-client-cert
+// and --tls-client-key PEM files, or from the --tls-client-keyring entry
+// so that it never needs to be on disk.
+func loadClientCertificate() (*tls.Certificate, error) {
+	if len(*tlsClientKeyring) > 0 {
+		if len(*tlsClientCert) > 0 {
+			return nil, errors.New("use either --tls-client-keyring or --tls-client-cert")
+		}
+		pemData, err := keyring.Get(*keyringService, *tlsClientKeyring)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get the client cert '%s' from keyring service '%s': %s",
+				*tlsClientKeyring, *keyringService, err)
+		}
+		return parseClientCertificate([]byte(pemData))
+	}
+	if len(*tlsClientCert) < 1 {
+		return nil, nil
+	}
+	keyPath := *tlsClientKey
+	if len(keyPath) < 1 {
+		keyPath = *tlsClientCert
+	}
+	cert, err := tls.LoadX509KeyPair(*tlsClientCert, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load the client cert: %s", err)
+	}
+	return &cert, nil
+}
+
+// parseClientCertificate parses PEM data holding both the cert chain and
+// its private key.
+func parseClientCertificate(pemData []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(pemData, pemData)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the client cert: %s", err)
+	}
+	return &cert, nil
+}
+
+// clientCertUserName returns the user of --mtls-only runs, --mtls-user
+// when set, else the common name of the client cert.
+func clientCertUserName(cert *tls.Certificate, mtlsUser string) (string, error) {
+	if len(mtlsUser) > 0 {
+		return mtlsUser, nil
+	}
+	if cert == nil || len(cert.Certificate) < 1 {
+		return "", errors.New("--mtls-only requires a TLS client cert")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return "", fmt.Errorf("cannot parse the client cert: %s", err)
+	}
+	if len(leaf.Subject.CommonName) < 1 {
+		return "", errors.New("client cert has no common name, use --mtls-user")
+	}
+	return leaf.Subject.CommonName, nil
+}
+
+// getMTLSUserInfo replaces getUserInfoAndCreds for --mtls-only service
+// accounts, which authenticate with their client cert alone: there is no
+// password and the user name comes from the client cert. The local user
+// still provides the home directory.
+func getMTLSUserInfo() (*user.User, error) {
+	cert, err := getClientCertificate()
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		return nil, errors.New("--mtls-only requires --tls-client-cert or --tls-client-keyring")
+	}
+	userName, err := clientCertUserName(cert, *mtlsUser)
+	if err != nil {
+		return nil, err
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	mtlsUsr := *usr
+	mtlsUsr.Username = userName
+	return &mtlsUsr, nil
+}
+
+// importClientCertCommand implements the import-client-cert command,
+// storing a PEM file with the client cert and key in the keyring entry
+// used by --tls-client-keyring. The file can be removed afterwards.
+func importClientCertCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: import-client-cert <pem file with cert and key>")
+	}
+	if len(*tlsClientKeyring) < 1 {
+		return errors.New("--tls-client-keyring is required to name the keyring entry")
+	}
+	pemData, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	if _, err := parseClientCertificate(pemData); err != nil {
+		return err
+	}
+	if err := keyring.Set(*keyringService, *tlsClientKeyring, string(pemData)); err != nil {
+		return err
+	}
+	log.Printf("stored the client cert as '%s' in keyring service '%s', %s can now be removed",
+		*tlsClientKeyring, *keyringService, args[0])
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/zalando/go-keyring"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestLoadClientCertificateFromFiles(t *testing.T) {
+	certFile, err := createTempFileWithStringContent("test_ClientCert", localhostCertPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(certFile.Name())
+	certFile.Close()
+	keyFile, err := createTempFileWithStringContent("test_ClientKey", localhostKeyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name())
+	keyFile.Close()
+	*tlsClientCert = certFile.Name()
+	*tlsClientKey = keyFile.Name()
+	defer func() {
+		*tlsClientCert = ""
+		*tlsClientKey = ""
+	}()
+	cert, err := loadClientCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert == nil || len(cert.Certificate) != 1 {
+		t.Fatal("expected the client cert to be loaded")
+	}
+}
+
+func TestLoadClientCertificateFromKeyring(t *testing.T) {
+	keyring.MockInit()
+	*tlsClientKeyring = "client-cert"
+	defer func() { *tlsClientKeyring = "" }()
+	if _, err := loadClientCertificate(); err == nil {
+		t.Fatal("should have failed with an empty keyring")
+	}
+	pemFile, err := createTempFileWithStringContent("test_ClientCertAndKey",
+		localhostCertPem+"\n"+localhostKeyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(pemFile.Name())
+	pemFile.Close()
+	if err := importClientCertCommand([]string{pemFile.Name()}); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := loadClientCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert == nil || len(cert.Certificate) != 1 {
+		t.Fatal("expected the client cert to be loaded from the keyring")
+	}
+}
+
+func TestNewTLSConfigPresentsClientCert(t *testing.T) {
+	keyring.MockInit()
+	err := keyring.Set(*keyringService, "client-cert", localhostCertPem+"\n"+localhostKeyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*tlsClientKeyring = "client-cert"
+	clientCertOnce = sync.Once{}
+	defer func() {
+		*tlsClientKeyring = ""
+		clientCertOnce = sync.Once{}
+	}()
+	expected, err := parseClientCertificate([]byte(localhostCertPem + "\n" + localhostKeyPem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) < 1 ||
+			!bytes.Equal(r.TLS.PeerCertificates[0].Raw, expected.Certificate[0]) {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+	tlsConfig, err := newTLSConfig(ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := newHTTPClient(tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("client cert was not presented, got %s", resp.Status)
+	}
+}
+
+func TestClientCertUserName(t *testing.T) {
+	cert, err := tls.X509KeyPair([]byte(localhostCertPem), []byte(localhostKeyPem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	userName, err := clientCertUserName(&cert, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userName != "localhost" {
+		t.Fatalf("expected the common name, got '%s'", userName)
+	}
+	if userName, _ := clientCertUserName(&cert, "svc-deploy"); userName != "svc-deploy" {
+		t.Fatalf("expected --mtls-user to win, got '%s'", userName)
+	}
+	if _, err := clientCertUserName(nil, ""); err == nil {
+		t.Fatal("should have failed without a client cert")
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type endpointConfig struct {
+	URL string `yaml:"url"`
+	// Endpoints with a higher weight are tried first.
+	Weight int `yaml:"weight"`
+	// Optional TLS overrides, CAFile replaces the CAs used for the other
+	// endpoints and ServerName the name verified in the server cert.
+	CAFile     string `yaml:"ca_file,omitempty"`
+	ServerName string `yaml:"server_name,omitempty"`
+	// ExpectedSAN is a name or IP the server cert must also hold, on top
+	// of the usual hostname verification.
+	ExpectedSAN string `yaml:"expected_san,omitempty"`
+}
+
+func (endpoint endpointConfig) hasTLSOverrides() bool {
+	return len(endpoint.CAFile) > 0 || len(endpoint.ServerName) > 0 ||
+		len(endpoint.ExpectedSAN) > 0
+}
+
+type baseConfig struct {
+	Gen_Cert_URLS string `yaml:"gen_cert_urls,omitempty"`
+	//UserAuth          string
+	Endpoints             []endpointConfig `yaml:"endpoints,omitempty"`
+	RandomizeEqualWeights bool             `yaml:"randomize_equal_weights,omitempty"`
+	// DNS SRV record (e.g. _keymaster._tcp.example.com) listing more
+	// endpoints, resolved on every run. DNS is not authenticated, a
+	// spoofed answer could send the password to any host with a trusted
+	// cert: the targets must be in the domain of the record, and either
+	// SRVCAFile pins the CAs of the discovered servers or SRVTrust
+	// explicitly accepts the risk.
+	SRVRecord string `yaml:"srv_record,omitempty"`
+	SRVCAFile string `yaml:"srv_ca_file,omitempty"`
+	SRVTrust  bool   `yaml:"srv_trust,omitempty"`
+	// HTTP methods for servers using other REST conventions, POST when
+	// empty.
+	LoginMethod   string `yaml:"login_method,omitempty"`
+	CertgenMethod string `yaml:"certgen_method,omitempty"`
+	// How the login credentials are sent, form (the default), json or
+	// basic, and the names of their fields.
+	LoginBody          string `yaml:"login_body,omitempty"`
+	LoginUsernameField string `yaml:"login_username_field,omitempty"`
+	LoginPasswordField string `yaml:"login_password_field,omitempty"`
+	// When a login response is a success, see loginSuccessConfig.
+	LoginSuccess loginSuccessConfig `yaml:"login_success,omitempty"`
+	// Friendly messages for the server errors, see errorMessageConfig.
+	ErrorMessages []errorMessageConfig `yaml:"error_messages,omitempty"`
+	// JSON fields holding the cert for servers wrapping it in a JSON
+	// response, keyed by cert type (ssh, x509 or ssh_host).
+	CertResponseFields map[string]string `yaml:"cert_response_fields,omitempty"`
+	// Extra destinations for the key and certs, see outputConfig.
+	Outputs []outputConfig `yaml:"outputs,omitempty"`
+	// Keymaster username when it is not the local one, and the defaults
+	// of --key-bits and --also-ed25519, see setUserPreferences.
+	Username    string `yaml:"username,omitempty"`
+	KeyBits     int    `yaml:"key_bits,omitempty"`
+	AlsoEd25519 bool   `yaml:"also_ed25519,omitempty"`
+}
+
+// HTTP methods used for the login and certgen requests, how the login
+// credentials are sent and checked, the messages of the server errors and
+// the JSON fields of the certgen responses, set from the config by
+// setRequestMethods.
+var (
+	loginMethod        = "POST"
+	certgenMethod      = "POST"
+	loginBody          = loginBodyForm
+	loginUsernameField = "username"
+	loginPasswordField = "password"
+	loginSuccess       loginSuccessConfig
+	errorMessages      []errorMessageConfig
+	certResponseFields map[string]string
+)
+
+func validateRequestMethod(method string) error {
+	switch method {
+	case "", "POST", "PUT":
+		return nil
+	}
+	return fmt.Errorf("unsupported request method '%s', use POST or PUT", method)
+}
+
+func setRequestMethods(config AppConfigFile) {
+	if len(config.Base.LoginMethod) > 0 {
+		loginMethod = config.Base.LoginMethod
+	}
+	if len(config.Base.CertgenMethod) > 0 {
+		certgenMethod = config.Base.CertgenMethod
+	}
+	if len(config.Base.LoginBody) > 0 {
+		loginBody = config.Base.LoginBody
+	}
+	if len(config.Base.LoginUsernameField) > 0 {
+		loginUsernameField = config.Base.LoginUsernameField
+	}
+	if len(config.Base.LoginPasswordField) > 0 {
+		loginPasswordField = config.Base.LoginPasswordField
+	}
+	loginSuccess = config.Base.LoginSuccess
+	errorMessages = config.Base.ErrorMessages
+	certResponseFields = config.Base.CertResponseFields
+}
+
+// Keymaster username from the config, the local username when empty.
+var configUsername string
+
+// setUserPreferences applies the username and the key preferences of the
+// config, the flags given on the command line taking precedence.
+func setUserPreferences(config AppConfigFile) {
+	configUsername = config.Base.Username
+	setFlags := setFlagNames()
+	if config.Base.KeyBits > 0 && !setFlags["key-bits"] {
+		*rsaKeyBits = config.Base.KeyBits
+	}
+	if config.Base.AlsoEd25519 && !setFlags["also-ed25519"] {
+		*alsoEd25519 = true
+	}
+}
+
+type AppConfigFile struct {
+	Base baseConfig
+}
+
+func loadVerifyConfigFile(configFilename string) (AppConfigFile, error) {
+	var config AppConfigFile
+	if _, err := os.Stat(configFilename); os.IsNotExist(err) {
+		err = errors.New("mising config file failure")
+		return config, err
+	}
+	source, err := ioutil.ReadFile(configFilename)
+	if err != nil {
+		err = errors.New("cannot read config file")
+		return config, err
+	}
+	err = yaml.Unmarshal(source, &config)
+	if err != nil {
+		err = errors.New("Cannot parse config file")
+		return config, err
+	}
+
+	if len(getEndpoints(config)) < 1 && len(config.Base.SRVRecord) < 1 {
+		err = errors.New("Invalid Config file... no place get the certs")
+		return config, err
+	}
+	if err := validateSRVTrust(config.Base); err != nil {
+		return config, err
+	}
+	for _, endpoint := range config.Base.Endpoints {
+		if len(strings.TrimSpace(endpoint.URL)) < 1 {
+			err = errors.New("Invalid Config file... endpoint without url")
+			return config, err
+		}
+	}
+	for _, method := range []string{config.Base.LoginMethod, config.Base.CertgenMethod} {
+		if err := validateRequestMethod(method); err != nil {
+			return config, err
+		}
+	}
+	if err := validateLoginBody(config.Base.LoginBody); err != nil {
+		return config, err
+	}
+	if err := validateLoginSuccess(config.Base.LoginSuccess); err != nil {
+		return config, err
+	}
+	if err := validateErrorMessages(config.Base.ErrorMessages); err != nil {
+		return config, err
+	}
+	if err := validateCertResponseFields(config.Base.CertResponseFields); err != nil {
+		return config, err
+	}
+	if err := validateOutputs(config.Base.Outputs); err != nil {
+		return config, err
+	}
+	// TODO: ensure all enpoints are https urls
+
+	return config, nil
+}
+
+// splitURLList splits a comma separated list of urls, trimming the
+// whitespace around each entry and dropping the empty ones.
+func splitURLList(urlList string) []string {
+	var urls []string
+	for _, entry := range strings.Split(urlList, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) < 1 {
+			continue
+		}
+		urls = append(urls, entry)
+	}
+	return urls
+}
+
+// getEndpoints returns the configured endpoints, the gen_cert_urls entries
+// are added after the explicit endpoints with a weight of zero.
+func getEndpoints(config AppConfigFile) []endpointConfig {
+	var endpoints []endpointConfig
+	for _, endpoint := range config.Base.Endpoints {
+		endpoint.URL = strings.TrimSpace(endpoint.URL)
+		endpoints = append(endpoints, endpoint)
+	}
+	for _, url := range splitURLList(config.Base.Gen_Cert_URLS) {
+		endpoints = append(endpoints, endpointConfig{URL: url})
+	}
+	return endpoints
+}
+
+// orderEndpoints sorts the endpoints by decreasing weight keeping the
+// configured order for equal weights, or shuffling them to spread the
+// load when randomize is set.
+func orderEndpoints(endpoints []endpointConfig, randomize bool) []endpointConfig {
+	ordered := make([]endpointConfig, len(endpoints))
+	copy(ordered, endpoints)
+	if randomize {
+		random := rand.New(rand.NewSource(time.Now().UnixNano()))
+		random.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Weight > ordered[j].Weight
+	})
+	return ordered
+}
+
+func getEndpointURLs(endpoints []endpointConfig) []string {
+	var urls []string
+	for _, endpoint := range endpoints {
+		urls = append(urls, endpoint.URL)
+	}
+	return urls
+}
+
+// configProblems fully validates the config file, returning every problem
+// found instead of stopping at the first one. Unlike loadVerifyConfigFile
+// it rejects unknown keys and endpoints that are not https urls.
+func configProblems(configFilename string) []string {
+	source, err := ioutil.ReadFile(configFilename)
+	if err != nil {
+		return []string{fmt.Sprintf("cannot read config file: %s", err)}
+	}
+	var config AppConfigFile
+	if err := yaml.UnmarshalStrict(source, &config); err != nil {
+		return []string{fmt.Sprintf("cannot parse config file: %s", err)}
+	}
+	var problems []string
+	endpoints := getEndpoints(config)
+	if len(endpoints) < 1 && len(config.Base.SRVRecord) < 1 {
+		problems = append(problems, "no endpoints, gen_cert_urls or srv_record configured")
+	}
+	if err := validateSRVTrust(config.Base); err != nil {
+		problems = append(problems, err.Error())
+	}
+	for i, endpoint := range endpoints {
+		if len(strings.TrimSpace(endpoint.URL)) < 1 {
+			problems = append(problems, fmt.Sprintf("endpoint %d has no url", i))
+			continue
+		}
+		endpointURL, err := url.Parse(endpoint.URL)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("endpoint '%s' is not a valid url: %s", endpoint.URL, err))
+			continue
+		}
+		if endpointURL.Scheme != "https" {
+			problems = append(problems, fmt.Sprintf("endpoint '%s' is not an https url", endpoint.URL))
+		}
+		if len(endpointURL.Host) < 1 {
+			problems = append(problems, fmt.Sprintf("endpoint '%s' has no host", endpoint.URL))
+		}
+		if len(endpoint.CAFile) > 0 {
+			if _, err := loadRootCAs(endpoint.CAFile); err != nil {
+				problems = append(problems, fmt.Sprintf("endpoint '%s' ca_file: %s", endpoint.URL, err))
+			}
+		}
+	}
+	for _, method := range []string{config.Base.LoginMethod, config.Base.CertgenMethod} {
+		if err := validateRequestMethod(method); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if err := validateLoginBody(config.Base.LoginBody); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := validateLoginSuccess(config.Base.LoginSuccess); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := validateErrorMessages(config.Base.ErrorMessages); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := validateCertResponseFields(config.Base.CertResponseFields); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := validateOutputs(config.Base.Outputs); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(*caFile) > 0 {
+		if _, err := loadRootCAs(*caFile); err != nil {
+			problems = append(problems, fmt.Sprintf("ca file: %s", err))
+		}
+	}
+	return problems
+}
+
+// userConfigPath is the standard location of the config, where init
+// writes it: keymaster/config.yml in the user config dir (~/.config on
+// Linux).
+func userConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "keymaster", "config.yml"), nil
+}
+
+// resolveConfigFilename applies the default of --config when it is not
+// given: the config of userConfigPath when it exists, else config.yml in
+// the current directory for the setups predating init.
+func resolveConfigFilename() {
+	if setFlagNames()["config"] {
+		return
+	}
+	path, err := userConfigPath()
+	if err != nil {
+		return
+	}
+	if _, err := os.Stat(path); err == nil {
+		*configFilename = path
+	}
+}
+
+// validateConfigCommand implements the validate-config command, printing
+// OK or one problem per line. It returns the process exit code.
+func validateConfigCommand(args []string, out io.Writer) int {
+	configPath := *configFilename
+	switch len(args) {
+	case 0:
+	case 1:
+		configPath = args[0]
+	default:
+		fmt.Fprintln(out, "usage: validate-config [config file]")
+		return 2
+	}
+	problems := configProblems(configPath)
+	if len(problems) < 1 {
+		fmt.Fprintln(out, "OK")
+		return 0
+	}
+	for _, problem := range problems {
+		fmt.Fprintln(out, problem)
+	}
+	return 1
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const weightedEndpointsConfigFile = `base:
+    gen_cert_urls: "https://fallback.example.com/"
+    endpoints:
+        - url: "https://secondary.example.com/"
+          weight: 5
+        - url: "https://primary.example.com/"
+          weight: 10
+`
+
+func TestLoadVerifyConfigFileWeightedEndpoints(t *testing.T) {
+	tmpfile, err := createTempFileWithStringContent("test_LoadVerifyConfig", weightedEndpointsConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+	config, err := loadVerifyConfigFile(tmpfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := getEndpointURLs(orderEndpoints(getEndpoints(config), false))
+	expected := []string{"https://primary.example.com/", "https://secondary.example.com/",
+		"https://fallback.example.com/"}
+	if !reflect.DeepEqual(urls, expected) {
+		t.Fatalf("expected %v got %v", expected, urls)
+	}
+}
+
+func TestOrderEndpointsRandomizeKeepsWeights(t *testing.T) {
+	endpoints := []endpointConfig{
+		{URL: "https://low1/", Weight: 1},
+		{URL: "https://high1/", Weight: 10},
+		{URL: "https://low2/", Weight: 1},
+		{URL: "https://high2/", Weight: 10},
+	}
+	for i := 0; i < 20; i++ {
+		ordered := orderEndpoints(endpoints, true)
+		if ordered[0].Weight != 10 || ordered[1].Weight != 10 ||
+			ordered[2].Weight != 1 || ordered[3].Weight != 1 {
+			t.Fatalf("randomizing must not cross weights: %v", ordered)
+		}
+	}
+}
+
+func TestValidateConfigCommand(t *testing.T) {
+	tmpfile, err := createTempFileWithStringContent("test_ValidateConfig", weightedEndpointsConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+	var out bytes.Buffer
+	if exitCode := validateConfigCommand([]string{tmpfile.Name()}, &out); exitCode != 0 {
+		t.Fatalf("unexpected exit code %d: %s", exitCode, out.String())
+	}
+	if out.String() != "OK\n" {
+		t.Fatalf("unexpected output '%s'", out.String())
+	}
+
+	badConfig := `base:
+    gen_cert_urls: "http://insecure.example.com/,https:///"
+    unknown_key: true
+`
+	badfile, err := createTempFileWithStringContent("test_ValidateConfig", badConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(badfile.Name())
+	badfile.Close()
+	out.Reset()
+	if exitCode := validateConfigCommand([]string{badfile.Name()}, &out); exitCode != 1 {
+		t.Fatalf("unexpected exit code %d", exitCode)
+	}
+	if !strings.Contains(out.String(), "unknown_key") {
+		t.Fatalf("unknown key not reported: %s", out.String())
+	}
+}
+
+func TestConfigProblems(t *testing.T) {
+	config := `base:
+    gen_cert_urls: "http://insecure.example.com/,https:///"
+`
+	tmpfile, err := createTempFileWithStringContent("test_ConfigProblems", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+	problems := configProblems(tmpfile.Name())
+	expected := []string{
+		"endpoint 'http://insecure.example.com/' is not an https url",
+		"endpoint 'https:///' has no host",
+	}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Fatalf("expected %v got %v", expected, problems)
+	}
+}
+
+func TestSetRequestMethodsFakeServerPUT(t *testing.T) {
+	configFile := `base:
+    gen_cert_urls: "https://keymaster.example.com/"
+    certgen_method: "PUT"
+`
+	tmpfile, err := createTempFileWithStringContent("test_RequestMethods", configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+	config, err := loadVerifyConfigFile(tmpfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setRequestMethods(config)
+	defer func() { loginMethod, certgenMethod = "POST", "POST" }()
+	if loginMethod != "POST" || certgenMethod != "PUT" {
+		t.Fatalf("unexpected methods login=%s certgen=%s", loginMethod, certgenMethod)
+	}
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	fake.CertgenMethod = "PUT"
+	privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = getCertFromTargetUrls(privateKey, "username", []byte("password"),
+		[]string{fake.URL}, fake.RootCAs(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.Base.LoginMethod = "GET"
+	if err := validateRequestMethod(config.Base.LoginMethod); err == nil {
+		t.Fatal("GET should be rejected")
+	}
+}
+
+func TestSetUserPreferences(t *testing.T) {
+	configFile := `base:
+    gen_cert_urls: "https://keymaster.example.com/"
+    username: "alice"
+    key_bits: 4096
+    also_ed25519: true
+`
+	tmpfile, err := createTempFileWithStringContent("test_UserPreferences", configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+	config, err := loadVerifyConfigFile(tmpfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setUserPreferences(config)
+	defer func() {
+		configUsername, *rsaKeyBits, *alsoEd25519 = "", RSAKeySize, false
+	}()
+	if configUsername != "alice" || *rsaKeyBits != 4096 || !*alsoEd25519 {
+		t.Fatalf("unexpected preferences username=%s key-bits=%d also-ed25519=%v",
+			configUsername, *rsaKeyBits, *alsoEd25519)
+	}
+}
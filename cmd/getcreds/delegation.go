@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// validateForUser checks the --for-user target, which ends up in the
+// certgen url and in the key file names.
+func validateForUser(target string) error {
+	if err := validateUserName(target); err != nil {
+		return err
+	}
+	if filepath.Base(target) != target || target == "." || target == ".." {
+		return fmt.Errorf("invalid user to delegate for '%s'", target)
+	}
+	return nil
+}
+
+// delegatedKeyPrefix is the key file prefix for the certs of --for-user,
+// leaving the key and certs of the authenticated user untouched.
+func delegatedKeyPrefix(target string) string {
+	return FilePrefix + "-for-" + target
+}
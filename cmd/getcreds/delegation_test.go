@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+)
+
+func TestValidateForUser(t *testing.T) {
+	if err := validateForUser("other"); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"", "..", "../other", "dir/other"} {
+		if err := validateForUser(target); err == nil {
+			t.Fatalf("'%s' should have been rejected", target)
+		}
+	}
+}
+
+func TestGetCertsForOtherUser(t *testing.T) {
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*forUser = "other"
+	defer func() { *forUser = "" }()
+	_, _, err = getCertFromTargetUrls(privateKey, "username", []byte("password"),
+		[]string{fake.URL}, fake.RootCAs(), false)
+	if err == nil {
+		t.Fatal("the delegation should be refused for a non admin")
+	}
+	fake.DelegationAdmins = []string{"username"}
+	sshCert, _, err := getCertFromTargetUrls(privateKey, "username", []byte("password"),
+		[]string{fake.URL}, fake.RootCAs(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := parseSSHCert(sshCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.ValidPrincipals) != 1 || cert.ValidPrincipals[0] != "other" {
+		t.Fatalf("expected a cert for other, got %v", cert.ValidPrincipals)
+	}
+}
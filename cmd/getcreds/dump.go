@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Symantec/keymaster/lib/webapi/v0/proto"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const redacted = "REDACTED"
+
+// Response headers whose values are credentials.
+var dumpRedactedHeaders = []string{"Set-Cookie", proto.RefreshTokenHeader}
+
+// dumpTransport implements --dump-responses, writing the status, headers
+// and body of every response to a file of dir for offline debugging. The
+// cookies and refresh tokens are redacted, the requests, with the
+// password, are never written.
+type dumpTransport struct {
+	base  http.RoundTripper
+	dir   string
+	mutex sync.Mutex
+	count int
+}
+
+func (t *dumpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	t.mutex.Lock()
+	t.count++
+	count := t.count
+	t.mutex.Unlock()
+	path := filepath.Join(t.dir, dumpFilename(count, req))
+	if err := ioutil.WriteFile(path, formatResponseDump(req, resp, body), 0600); err != nil {
+		log.Printf("cannot dump the response: %s", err)
+	} else if *debug {
+		log.Printf("dumped the response of %s to %s", req.URL.Path, path)
+	}
+	return resp, nil
+}
+
+// dumpFilename numbers the dumps in the order of the requests and names
+// them after the request path, such as 001-POST-api-v0-login.txt.
+func dumpFilename(count int, req *http.Request) string {
+	name := strings.Trim(req.URL.Path, "/")
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '-'
+	}, name)
+	return fmt.Sprintf("%03d-%s-%s.txt", count, req.Method, name)
+}
+
+func formatResponseDump(req *http.Request, resp *http.Response, body []byte) []byte {
+	var dump bytes.Buffer
+	fmt.Fprintf(&dump, "%s %s\n%s %s\n", req.Method, req.URL.Path, resp.Proto, resp.Status)
+	header := resp.Header.Clone()
+	for _, name := range dumpRedactedHeaders {
+		for i := range header.Values(name) {
+			header[http.CanonicalHeaderKey(name)][i] = redacted
+		}
+	}
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			fmt.Fprintf(&dump, "%s: %s\n", name, value)
+		}
+	}
+	dump.WriteString("\n")
+	dump.Write(body)
+	return dump.Bytes()
+}
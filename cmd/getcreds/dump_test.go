@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/Symantec/keymaster/lib/webapi/v0/proto"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDumpTransport(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "auth_cookie", Value: "secret-session"})
+		w.Header().Set(proto.RefreshTokenHeader, "secret-token")
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "keymaster-dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := &http.Client{Transport: &dumpTransport{base: http.DefaultTransport, dir: dir}}
+	resp, err := client.Post(ts.URL+proto.LoginPath, "application/x-www-form-urlencoded",
+		strings.NewReader("username=user&password=secret-password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != `{"message":"success"}` {
+		t.Fatalf("the response body should be left to the caller, got '%s'", body)
+	}
+	dump, err := ioutil.ReadFile(filepath.Join(dir, "001-POST-api-v0-login.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"secret-session", "secret-token", "secret-password"} {
+		if strings.Contains(string(dump), secret) {
+			t.Fatalf("dump should not contain %s:\n%s", secret, dump)
+		}
+	}
+	if !strings.HasSuffix(string(dump), `{"message":"success"}`) {
+		t.Fatalf("dump should end with the body:\n%s", dump)
+	}
+}
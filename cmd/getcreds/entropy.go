@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Below this many bits in the kernel pool, reading rand.Reader may block
+// on older kernels.
+const minEntropyBits = 128
+
+// entropyAvailWarning returns a warning when the content of
+// /proc/sys/kernel/random/entropy_avail shows a depleted pool.
+func entropyAvailWarning(content string) string {
+	bits, err := strconv.Atoi(strings.TrimSpace(content))
+	if err != nil || bits >= minEntropyBits {
+		return ""
+	}
+	return fmt.Sprintf("only %d bits of entropy available, key generation may be slow", bits)
+}
+
+// warnLowEntropy explains a slow key generation up front instead of
+// leaving the user with what looks like a hang, as happens on freshly
+// booted VMs and embedded systems.
+func warnLowEntropy() {
+	if warning := entropyWarning(); len(warning) > 0 {
+		log.Printf("WARNING: %s", warning)
+	}
+}
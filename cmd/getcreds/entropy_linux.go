@@ -0,0 +1,20 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+)
+
+const entropyAvailPath = "/proc/sys/kernel/random/entropy_avail"
+
+func entropyWarning() string {
+	// Fails instead of blocking until the pool is initialized
+	if _, err := unix.Getrandom(make([]byte, 1), unix.GRND_NONBLOCK); err == unix.EAGAIN {
+		return "the kernel random pool is not initialized yet, key generation blocks until it is"
+	}
+	content, err := ioutil.ReadFile(entropyAvailPath)
+	if err != nil {
+		return ""
+	}
+	return entropyAvailWarning(string(content))
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// Other systems do not expose their entropy pool, and their random
+// sources do not block after boot.
+func entropyWarning() string {
+	return ""
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEntropyAvailWarning(t *testing.T) {
+	if warning := entropyAvailWarning("3500\n"); len(warning) > 0 {
+		t.Fatalf("unexpected warning '%s'", warning)
+	}
+	if warning := entropyAvailWarning("invalid"); len(warning) > 0 {
+		t.Fatalf("unexpected warning '%s'", warning)
+	}
+	if warning := entropyAvailWarning("20\n"); len(warning) < 1 {
+		t.Fatal("expected a warning for a depleted pool")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// errorMessageConfig is an entry of the error_messages setting, replacing
+// the raw server errors with the guidance of the organization:
+//
+//	error_messages:
+//	  - status: 403
+//	    body_contains: E_NO_2FA
+//	    message: "enroll a security key at https://keymaster.example.com first"
+//
+// The first entry whose set fields all match is used.
+type errorMessageConfig struct {
+	// login or certgen, any step when empty
+	Step         string `yaml:"step"`
+	Status       int    `yaml:"status"`
+	BodyContains string `yaml:"body_contains"`
+	Message      string `yaml:"message"`
+}
+
+// Longest failed response body read, enough to find the maintenance marker
+// or match the error messages in an error page.
+const maxErrorBody = 4096
+
+// readErrorBody reads the start of the body of a failed response, read once
+// for both checkMaintenance and newStatusError.
+func readErrorBody(resp *http.Response) []byte {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	return body
+}
+
+func validateErrorMessages(entries []errorMessageConfig) error {
+	for i, entry := range entries {
+		switch entry.Step {
+		case "", "login", "certgen":
+		default:
+			return fmt.Errorf("error_messages entry %d: unknown step '%s', use login or certgen", i+1, entry.Step)
+		}
+		if len(entry.Message) < 1 {
+			return fmt.Errorf("error_messages entry %d has no message", i+1)
+		}
+		if entry.Status == 0 && len(entry.BodyContains) < 1 {
+			return fmt.Errorf("error_messages entry %d matches every error, set status or body_contains", i+1)
+		}
+	}
+	return nil
+}
+
+// errorMessageFor returns the configured message for a failed step, empty
+// when no entry matches.
+func errorMessageFor(entries []errorMessageConfig, step string, code int, body string) string {
+	for _, entry := range entries {
+		if len(entry.Step) > 0 && entry.Step != step {
+			continue
+		}
+		if entry.Status != 0 && entry.Status != code {
+			continue
+		}
+		if len(entry.BodyContains) > 0 && !strings.Contains(body, entry.BodyContains) {
+			continue
+		}
+		return entry.Message
+	}
+	return ""
+}
+
+// newStatusError describes the failed step answered by resp, with the
+// configured message matching its status and body.
+func newStatusError(step string, resp *http.Response, body []byte) *statusError {
+	return &statusError{
+		step:    step,
+		status:  resp.Status,
+		code:    resp.StatusCode,
+		message: errorMessageFor(errorMessages, step, resp.StatusCode, string(body)),
+	}
+}
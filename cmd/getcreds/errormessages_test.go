@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestErrorMessageFor(t *testing.T) {
+	entries := []errorMessageConfig{
+		{Status: 403, BodyContains: "E_NO_2FA", Message: "enroll in 2FA first"},
+		{Step: "login", Status: 401, Message: "check your password"},
+		{Status: 403, Message: "not allowed"},
+	}
+	if message := errorMessageFor(entries, "certgen", 403, "error E_NO_2FA"); message != "enroll in 2FA first" {
+		t.Fatalf("unexpected message '%s'", message)
+	}
+	if message := errorMessageFor(entries, "certgen", 403, "forbidden"); message != "not allowed" {
+		t.Fatalf("unexpected message '%s'", message)
+	}
+	if message := errorMessageFor(entries, "certgen", 401, ""); message != "" {
+		t.Fatalf("the login entry should not match certgen, got '%s'", message)
+	}
+	if message := errorMessageFor(entries, "login", 401, ""); message != "check your password" {
+		t.Fatalf("unexpected message '%s'", message)
+	}
+}
+
+func TestValidateErrorMessages(t *testing.T) {
+	if err := validateErrorMessages([]errorMessageConfig{{Status: 403, Message: "denied"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []errorMessageConfig{
+		{Status: 403},
+		{Message: "matches everything"},
+		{Step: "refresh", Status: 403, Message: "denied"},
+	} {
+		if err := validateErrorMessages([]errorMessageConfig{entry}); err == nil {
+			t.Errorf("should have refused %+v", entry)
+		}
+	}
+}
+
+func TestNewStatusErrorMessage(t *testing.T) {
+	errorMessages = []errorMessageConfig{{BodyContains: "E_NO_2FA", Message: "enroll in 2FA first"}}
+	defer func() { errorMessages = nil }()
+	resp := &http.Response{
+		Status:     "503 Service Unavailable",
+		StatusCode: http.StatusServiceUnavailable,
+		Body:       ioutil.NopCloser(strings.NewReader("E_NO_2FA")),
+	}
+	body := readErrorBody(resp)
+	if err := checkMaintenance(resp, body); err != nil {
+		t.Fatal(err)
+	}
+	err := newStatusError("certgen", resp, body)
+	if err.Error() != "certgen failed: 503 Service Unavailable: enroll in 2FA first" {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+}
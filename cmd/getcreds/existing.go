@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// Values of --on-existing.
+const (
+	onExistingSkip      = "skip"
+	onExistingOverwrite = "overwrite"
+	onExistingBackup    = "backup"
+	onExistingFail      = "fail"
+)
+
+const backupSuffix = ".bak"
+
+func validateOnExisting(policy string) error {
+	switch policy {
+	case onExistingSkip, onExistingOverwrite, onExistingBackup, onExistingFail:
+		return nil
+	}
+	return fmt.Errorf("unknown --on-existing policy '%s', use skip, overwrite, backup or fail", policy)
+}
+
+// managedFiles returns the files a run replaces. Keys that are reused or
+// held by the agent are not replaced, only their certs are.
+func managedFiles(privateKeyPath string) []string {
+	files := []string{privateKeyPath + "-cert.pub", x509CertPath(privateKeyPath)}
+	if *useAgentKey {
+		return append(files, publicKeyPath(privateKeyPath))
+	}
+	if *reuseKey {
+		return files
+	}
+	return append(files, privateKeyPath, publicKeyPath(privateKeyPath))
+}
+
+func existingPaths(paths []string) []string {
+	var existing []string
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			existing = append(existing, path)
+		}
+	}
+	return existing
+}
+
+// checkOnExisting enforces the skip and fail policies of --on-existing on
+// paths before any request is made. It returns false when the run should
+// stop without writing anything. The backups are only made, by
+// backupExisting, once the new certs are in hand so that a failed run
+// leaves the previous files in use.
+func checkOnExisting(policy string, paths []string) (bool, error) {
+	existing := existingPaths(paths)
+	if len(existing) < 1 {
+		return true, nil
+	}
+	switch policy {
+	case onExistingSkip:
+		log.Printf("%s already exists, skipping", existing[0])
+		return false, nil
+	case onExistingFail:
+		return false, fmt.Errorf("%s already exists", existing[0])
+	}
+	return true, nil
+}
+
+// backupExisting moves paths to their backups with the backup policy,
+// returning the moved ones for restoreBackups. paths are the files that
+// existed before the run, from existingPaths, so that a file the run
+// wrote itself is never taken for a previous one.
+func backupExisting(policy string, paths []string) ([]string, error) {
+	if policy != onExistingBackup {
+		return nil, nil
+	}
+	var moved []string
+	for _, path := range paths {
+		// checked one at a time, a path listed twice is only moved once
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := os.Rename(path, path+backupSuffix); err != nil {
+			restoreBackups(moved)
+			return nil, err
+		}
+		moved = append(moved, path)
+		if *debug {
+			log.Printf("backed up %s to %s", path, path+backupSuffix)
+		}
+	}
+	return moved, nil
+}
+
+// restoreBackups puts back the files moved by backupExisting when the new
+// ones could not be written.
+func restoreBackups(paths []string) {
+	for _, path := range paths {
+		if err := os.Rename(path+backupSuffix, path); err != nil {
+			log.Printf("cannot restore %s from its backup: %s", path, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOnExisting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster-existing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	existingPath := filepath.Join(dir, "keymaster-cert.pub")
+	if err := ioutil.WriteFile(existingPath, []byte("old cert"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{existingPath, filepath.Join(dir, "keymaster-x509Cert.pem")}
+
+	if proceed, err := checkOnExisting(onExistingSkip, paths); err != nil || proceed {
+		t.Fatalf("skip should stop without error, got %v %v", proceed, err)
+	}
+	if _, err := checkOnExisting(onExistingFail, paths); err == nil {
+		t.Fatal("fail should return an error")
+	}
+	for _, policy := range []string{onExistingOverwrite, onExistingBackup} {
+		if proceed, err := checkOnExisting(policy, paths); err != nil || !proceed {
+			t.Fatalf("%s should proceed, got %v %v", policy, proceed, err)
+		}
+	}
+	if _, err := os.Stat(existingPath); err != nil {
+		t.Fatal("the files should only be moved by backupExisting")
+	}
+	if moved, err := backupExisting(onExistingOverwrite, paths); err != nil || len(moved) > 0 {
+		t.Fatalf("overwrite should not back up, got %v %v", moved, err)
+	}
+	moved, err := backupExisting(onExistingBackup, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 1 || moved[0] != existingPath {
+		t.Fatalf("unexpected backups %v", moved)
+	}
+	content, err := ioutil.ReadFile(existingPath + backupSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "old cert" {
+		t.Fatal("backup does not hold the old content")
+	}
+	if proceed, err := checkOnExisting(onExistingFail, paths); err != nil || !proceed {
+		t.Fatalf("nothing left to protect after the backup, got %v %v", proceed, err)
+	}
+	// a failed write puts the previous files back
+	restoreBackups(moved)
+	content, err = ioutil.ReadFile(existingPath)
+	if err != nil || string(content) != "old cert" {
+		t.Fatalf("expected the old cert back, got '%s': %v", content, err)
+	}
+
+	// a file the run wrote after the snapshot is not a previous file
+	snapshot := existingPaths(paths)
+	if err := ioutil.WriteFile(paths[1], []byte("new cert"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	moved, err = backupExisting(onExistingBackup, append(snapshot, snapshot...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 1 || moved[0] != existingPath {
+		t.Fatalf("only the snapshot should be backed up, got %v", moved)
+	}
+	if _, err := os.Stat(paths[1] + backupSuffix); err == nil {
+		t.Fatal("the file written by the run should not be backed up")
+	}
+}
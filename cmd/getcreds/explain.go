@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// explainf logs a decision taken by the client when --explain is set.
+func explainf(format string, v ...interface{}) {
+	if *explain {
+		log.Printf("explain: "+format, v...)
+	}
+}
+
+// describeKeySource returns how the key that gets signed is obtained.
+func describeKeySource() string {
+	newKey := fmt.Sprintf("a new %d bit RSA key", *rsaKeyBits)
+	if len(*keygenCommand) > 0 {
+		newKey = fmt.Sprintf("a new key from '%s'", *keygenCommand)
+	}
+	switch {
+	case *useAgentKey && len(*agentKeyMatch) > 0:
+		return fmt.Sprintf("ssh-agent key matching '%s'", *agentKeyMatch)
+	case *useAgentKey:
+		return "first ssh-agent key"
+	case *reuseKey && *keyMaxAge > 0:
+		return fmt.Sprintf("existing key if younger than %s, else %s", *keyMaxAge, newKey)
+	case *reuseKey:
+		return fmt.Sprintf("existing key, or %s if missing", newKey)
+	}
+	return newKey
+}
+
+// explainPlan logs everything the client is going to do for --explain,
+// before any network call is made.
+func explainPlan(configPath string, targetUrls []string) {
+	if !*explain {
+		return
+	}
+	usr, err := user.Current()
+	if err != nil {
+		explainf("cannot get current user info: %s", err)
+		return
+	}
+	userName := usr.Username
+	privateKeyPath, err := getDefaultPrivateKeyPath()
+	if err != nil {
+		explainf("cannot get the key location: %s", err)
+		return
+	}
+	if len(*forUser) > 0 {
+		privateKeyPath = keyFilePath(filepath.Dir(privateKeyPath), delegatedKeyPrefix(*forUser))
+	}
+	if absPath, err := filepath.Abs(configPath); err == nil {
+		configPath = absPath
+	}
+	explainf("config loaded from %s", configPath)
+	if setFlags := setFlagNames(); len(setFlags) > 0 {
+		names := make([]string, 0, len(setFlags))
+		for name := range setFlags {
+			names = append(names, "--"+name)
+		}
+		sort.Strings(names)
+		explainf("flags given on the command line, the others use their default: %s",
+			strings.Join(names, " "))
+	}
+	for i, targetUrl := range targetUrls {
+		explainf("endpoint %d: %s", i+1, targetUrl)
+	}
+	if len(*caFile) > 0 {
+		explainf("servers verified with the CAs from %s", *caFile)
+	} else {
+		explainf("servers verified with the system CAs")
+	}
+	if *ipVersion != "any" {
+		explainf("servers only dialed over IPv%s", *ipVersion)
+	}
+	if *rejectSelfSigned {
+		explainf("self-signed server certs refused even when trusted")
+	}
+	if *useKeyring {
+		explainf("password for %s from the keyring service '%s', prompting if missing",
+			getKeyringAccount(userName), *keyringService)
+	} else {
+		explainf("password for %s prompted on the terminal", userName)
+	}
+	explainf("u2f used unless the server allows password only certs")
+	if len(*hostCert) > 0 {
+		explainf("requesting a host cert for %s, signing %s", *hostCert, *hostKeyPath)
+		explainf("host cert written to %s", hostCertPath(*hostKeyPath))
+		return
+	}
+	if len(*policyFile) > 0 {
+		explainf("issued certs checked against the policy in %s before use", *policyFile)
+	}
+	if len(*forUser) > 0 {
+		explainf("certs requested for %s on behalf of %s, the server must allow the delegation",
+			*forUser, userName)
+	}
+	explainf("key: %s", describeKeySource())
+	if *memoryOnly {
+		explainf("key and ssh cert added to ssh-agent, nothing written to disk")
+		return
+	}
+	if !*useAgentKey {
+		explainf("private key written to %s", privateKeyPath)
+	}
+	explainf("public key written to %s", publicKeyPath(privateKeyPath))
+	explainf("ssh cert written to %s-cert.pub", privateKeyPath)
+	explainf("x509 cert written to %s as %s", x509CertPath(privateKeyPath), *x509Format)
+	if *alsoEd25519 {
+		ed25519KeyPath := keyFilePath(filepath.Dir(privateKeyPath), ed25519FilePrefix)
+		explainf("extra Ed25519 key and certs written to %s*, with the same login", ed25519KeyPath)
+	}
+	if len(*metricsFilename) > 0 {
+		explainf("metrics written to %s", *metricsFilename)
+	}
+	if *retries > 0 {
+		explainf("up to %d retries with %s backoff", *retries, *backoffName)
+	}
+}
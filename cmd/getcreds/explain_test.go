@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExplainPlanLogsEndpointsInOrder(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	*explain = true
+	defer func() { *explain = false }()
+	explainPlan("config.yml", []string{"https://primary.example.com/", "https://secondary.example.com/"})
+	output := buf.String()
+	primary := strings.Index(output, "endpoint 1: https://primary.example.com/")
+	secondary := strings.Index(output, "endpoint 2: https://secondary.example.com/")
+	if primary < 0 || secondary < primary {
+		t.Fatalf("endpoints not explained in order: %s", output)
+	}
+	if !strings.Contains(output, "key: a new 2048 bit RSA key") {
+		t.Fatalf("key source not explained: %s", output)
+	}
+}
+
+func TestDescribeKeySource(t *testing.T) {
+	*useAgentKey = true
+	*agentKeyMatch = "work"
+	defer func() { *useAgentKey = false; *agentKeyMatch = "" }()
+	if source := describeKeySource(); source != "ssh-agent key matching 'work'" {
+		t.Fatalf("unexpected key source '%s'", source)
+	}
+}
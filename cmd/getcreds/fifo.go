@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// fifoPersister implements --fifo-out, writing the PEM private key (when
+// not held by the agent) followed by the certs to the named pipe at path.
+// The write blocks until a reader opens the pipe. Anything else than a
+// named pipe is refused so that the key is never left in a regular file.
+func fifoPersister(path string, pemKey []byte) persistFunc {
+	return func(material certMaterial) error {
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if fileInfo.Mode()&os.ModeNamedPipe == 0 {
+			return fmt.Errorf("%s is not a named pipe", path)
+		}
+		fifo, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		for _, data := range [][]byte{pemKey, material.SSHCert, material.X509Cert} {
+			if _, err := fifo.Write(data); err != nil {
+				fifo.Close()
+				return fmt.Errorf("cannot write to %s: %s", path, err)
+			}
+		}
+		return fifo.Close()
+	}
+}
@@ -0,0 +1,44 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestFifoPersister(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster-fifo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fifoPath := filepath.Join(dir, "creds")
+	if err := syscall.Mkfifo(fifoPath, 0600); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadFile(fifoPath)
+		received <- data
+	}()
+	material := certMaterial{SSHCert: []byte("ssh cert\n"), X509Cert: []byte("x509 cert\n")}
+	if err := fifoPersister(fifoPath, []byte("key\n"))(material); err != nil {
+		t.Fatal(err)
+	}
+	if data := string(<-received); data != "key\nssh cert\nx509 cert\n" {
+		t.Fatalf("unexpected data read from the pipe '%s'", data)
+	}
+
+	regularPath := filepath.Join(dir, "regular")
+	if err := ioutil.WriteFile(regularPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := fifoPersister(regularPath, []byte("key\n"))(material); err == nil {
+		t.Fatal("should have refused to write to a regular file")
+	}
+}
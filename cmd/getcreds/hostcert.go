@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Cert type requested from certgen for ssh host certificates.
+const hostCertType = "ssh_host"
+
+// hostCertPath returns where sshd expects the cert for a host key, the
+// path used by ssh-keygen -s and referenced by HostCertificate.
+func hostCertPath(hostKeyPath string) string {
+	return strings.TrimSuffix(hostKeyPath, ".pub") + "-cert.pub"
+}
+
+// checkHostCert makes sure the server returned a host cert valid for
+// exactly the requested hostnames.
+func checkHostCert(certBytes []byte, hostnames []string) error {
+	cert, err := parseSSHCert(certBytes)
+	if err != nil {
+		return err
+	}
+	if cert.CertType != ssh.HostCert {
+		return errors.New("server returned a user cert instead of a host cert")
+	}
+	principals := make(map[string]bool)
+	for _, principal := range cert.ValidPrincipals {
+		principals[principal] = true
+	}
+	for _, hostname := range hostnames {
+		if !principals[hostname] {
+			return fmt.Errorf("host cert is not valid for '%s'", hostname)
+		}
+	}
+	return nil
+}
+
+func getHostCertFromServer(hostPubKey []byte, hostnames []string, userName string, password []byte, baseUrl string, client *http.Client) ([]byte, error) {
+	checkServerVersion(client, baseUrl)
+	if err := loginToServer(client, userName, password, baseUrl, false); err != nil {
+		return nil, err
+	}
+	params := url.Values{"hostname": hostnames}
+	hostCert, err := doCertRequest(client, certgenURL(baseUrl, userName, hostCertType, params), hostCertType,
+		string(hostPubKey))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkHostCert(hostCert, hostnames); err != nil {
+		return nil, err
+	}
+	return hostCert, nil
+}
+
+// getHostCertFromTargetUrls implements --host-cert, asking the servers to
+// sign the host public key for hostnames.
+func getHostCertFromTargetUrls(hostPubKey []byte, hostnames []string, userName string, password []byte, targetUrls []string, rootCAs *x509.CertPool) ([]byte, error) {
+	tlsConfig, err := newTLSConfig(rootCAs)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newHTTPClient(tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	for _, baseUrl := range targetUrls {
+		log.Printf("attempting to target '%s' for host cert of %s\n", baseUrl, strings.Join(hostnames, ","))
+		hostCert, err := getHostCertFromServer(hostPubKey, hostnames, userName, password, baseUrl, client)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		return hostCert, nil
+	}
+	return nil, errors.New("Failed to get host cert")
+}
+
+// hostCertCommand requests a host cert for the key at hostKeyPath and
+// writes it next to the key.
+func hostCertCommand(hostnames string, hostKeyPath string, userName string, password []byte, targetUrls []string, rootCAs *x509.CertPool) error {
+	hostPubKey, err := ioutil.ReadFile(hostKeyPath)
+	if err != nil {
+		return err
+	}
+	if _, _, _, _, err := ssh.ParseAuthorizedKey(hostPubKey); err != nil {
+		return fmt.Errorf("cannot parse host public key %s: %s", hostKeyPath, err)
+	}
+	hostnameList := splitURLList(hostnames)
+	if len(hostnameList) < 1 {
+		return errors.New("no hostnames given for the host cert")
+	}
+	hostCert, err := getHostCertFromTargetUrls(hostPubKey, hostnameList, userName, password, targetUrls, rootCAs)
+	if err != nil {
+		return err
+	}
+	certPath := hostCertPath(hostKeyPath)
+	if err := ioutil.WriteFile(certPath, hostCert, 0644); err != nil {
+		return err
+	}
+	log.Printf("wrote host cert to %s, point HostCertificate in sshd_config to it", certPath)
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHostCertCommandFakeServer(t *testing.T) {
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	dir, err := ioutil.TempDir("", "keymaster-hostcert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hostKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPub, err := ssh.NewPublicKey(&hostKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKeyPath := filepath.Join(dir, "ssh_host_rsa_key.pub")
+	if err := ioutil.WriteFile(hostKeyPath, ssh.MarshalAuthorizedKey(hostPub), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = hostCertCommand("web1.example.com, web1", hostKeyPath, fake.Username,
+		[]byte(fake.Password), []string{fake.URL}, fake.RootCAs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := filepath.Join(dir, "ssh_host_rsa_key-cert.pub")
+	if hostCertPath(hostKeyPath) != certPath {
+		t.Fatalf("unexpected host cert path %s", hostCertPath(hostKeyPath))
+	}
+	certBytes, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkHostCert(certBytes, []string{"web1.example.com", "web1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkHostCert(certBytes, []string{"web2.example.com"}); err == nil {
+		t.Fatal("host cert should not be valid for a host that was not requested")
+	}
+}
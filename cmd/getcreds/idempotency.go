@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+var (
+	idempotencyNonceOnce sync.Once
+	idempotencyNonce     []byte
+)
+
+// idempotencyKey returns the key sent with a certgen request so that a
+// server which already issued the cert for it, e.g. before a timeout, can
+// return the same cert instead of issuing a new one. It is the same for
+// every retry of the request within a run and differs across runs, cert
+// types and keys.
+func idempotencyKey(url, filedata string) string {
+	idempotencyNonceOnce.Do(func() {
+		idempotencyNonce = make([]byte, 16)
+		if _, err := rand.Read(idempotencyNonce); err != nil {
+			log.Printf("cannot generate the idempotency nonce: %s", err)
+		}
+	})
+	hash := sha256.New()
+	hash.Write(idempotencyNonce)
+	hash.Write([]byte(url))
+	hash.Write([]byte{0})
+	hash.Write([]byte(filedata))
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	key := idempotencyKey("https://keymaster/certgen/username?type=ssh", "ssh-rsa AAAA")
+	if key != idempotencyKey("https://keymaster/certgen/username?type=ssh", "ssh-rsa AAAA") {
+		t.Fatal("the key should be the same for the same request")
+	}
+	if key == idempotencyKey("https://keymaster/certgen/username?type=x509", "ssh-rsa AAAA") {
+		t.Fatal("the key should differ across cert types")
+	}
+	if key == idempotencyKey("https://keymaster/certgen/username?type=ssh", "ssh-rsa BBBB") {
+		t.Fatal("the key should differ across public keys")
+	}
+}
+
+func TestDoCertRequestSendsSameIdempotencyKeyOnRetry(t *testing.T) {
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(idempotencyKeyHeader))
+		if len(keys) < 2 {
+			http.Error(w, "", http.StatusGatewayTimeout)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("cert"))
+	}))
+	defer server.Close()
+	*certgenRetries = 1
+	*backoffBase = 0
+	defer func() {
+		*certgenRetries = 0
+		*backoffBase = time.Second
+	}()
+	if _, err := doCertRequest(server.Client(), server.URL+"/certgen/username", "ssh", "key"); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || len(keys[0]) < 1 || keys[0] != keys[1] {
+		t.Fatalf("expected the same idempotency key on both attempts, got %v", keys)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// initConfigCommand implements the init command, writing a config file
+// from the answers to a few prompts instead of writing the YAML by hand.
+// The config goes to userConfigPath unless --config or an argument names
+// another file. Existing config files are never overwritten.
+func initConfigCommand(args []string, in io.Reader, out io.Writer) error {
+	configPath := *configFilename
+	switch len(args) {
+	case 0:
+		if !setFlagNames()["config"] {
+			path, err := userConfigPath()
+			if err != nil {
+				return err
+			}
+			configPath = path
+		}
+	case 1:
+		configPath = args[0]
+	default:
+		return errors.New("usage: init [config file]")
+	}
+	if _, err := os.Stat(configPath); err == nil {
+		return fmt.Errorf("%s already exists, remove it first", configPath)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	config, err := promptConfig(bufio.NewReader(in), out)
+	if err != nil {
+		return err
+	}
+	content, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(configPath, content, 0644, ".keymaster-config-"); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "config written to %s\n", configPath)
+	return nil
+}
+
+// promptConfig asks for the endpoints and their CA file, the username and
+// the key preferences. The endpoints are tried in the given order. The
+// main key is always RSA, only its size is asked, Ed25519 keys being
+// generated in addition to it.
+func promptConfig(reader *bufio.Reader, out io.Writer) (AppConfigFile, error) {
+	var config AppConfigFile
+	var urls []string
+	for len(urls) < 1 {
+		answer, err := promptLine(reader, out, "Keymaster URLs, comma separated: ")
+		if err != nil {
+			return config, err
+		}
+		urls = splitURLList(answer)
+		for _, rawUrl := range urls {
+			if err := validateEndpointURL(rawUrl); err != nil {
+				fmt.Fprintln(out, err)
+				urls = nil
+				break
+			}
+		}
+	}
+	var caPath string
+	for {
+		answer, err := promptLine(reader, out, "CA file of the servers, empty for the system CAs: ")
+		if err != nil {
+			return config, err
+		}
+		caPath = strings.TrimSpace(answer)
+		if len(caPath) < 1 {
+			break
+		}
+		if _, err := loadRootCAs(caPath); err != nil {
+			fmt.Fprintln(out, err)
+			continue
+		}
+		if absPath, err := filepath.Abs(caPath); err == nil {
+			caPath = absPath
+		}
+		break
+	}
+	for {
+		answer, err := promptLine(reader, out, "Keymaster username, empty for the local user: ")
+		if err != nil {
+			return config, err
+		}
+		config.Base.Username = strings.TrimSpace(answer)
+		if len(config.Base.Username) < 1 {
+			break
+		}
+		if err := validateUserName(config.Base.Username); err != nil {
+			fmt.Fprintln(out, err)
+			continue
+		}
+		break
+	}
+	for {
+		answer, err := promptLine(reader, out,
+			fmt.Sprintf("RSA key size in bits, empty for %d: ", RSAKeySize))
+		if err != nil {
+			return config, err
+		}
+		answer = strings.TrimSpace(answer)
+		if len(answer) < 1 {
+			break
+		}
+		bits, err := strconv.Atoi(answer)
+		if err != nil || bits < RSAKeySize {
+			fmt.Fprintf(out, "'%s' is not a key size of at least %d bits\n", answer, RSAKeySize)
+			continue
+		}
+		if bits != RSAKeySize {
+			config.Base.KeyBits = bits
+		}
+		break
+	}
+	for {
+		answer, err := promptLine(reader, out, "Also generate an Ed25519 key [y/N]: ")
+		if err != nil {
+			return config, err
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			config.Base.AlsoEd25519 = true
+		case "", "n", "no":
+		default:
+			fmt.Fprintln(out, "answer y or n")
+			continue
+		}
+		break
+	}
+	for i, rawUrl := range urls {
+		config.Base.Endpoints = append(config.Base.Endpoints, endpointConfig{
+			URL:    rawUrl,
+			Weight: len(urls) - i,
+			CAFile: caPath,
+		})
+	}
+	return config, nil
+}
+
+func validateEndpointURL(rawUrl string) error {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil || parsed.Scheme != "https" || len(parsed.Host) < 1 {
+		return fmt.Errorf("'%s' is not an https url", rawUrl)
+	}
+	return nil
+}
+
+// promptLine writes prompt and returns the next line of reader, failing
+// when the input ends before an answer.
+func promptLine(reader *bufio.Reader, out io.Writer, prompt string) (string, error) {
+	fmt.Fprint(out, prompt)
+	line, err := reader.ReadString('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInitConfigCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster-init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caPath := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caPath, []byte(localhostCertPem), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "keymaster", "config.yml")
+	// The plain http url and the missing CA are asked again
+	answers := strings.Join([]string{
+		"http://keymaster.example.com",
+		"https://keymaster1.example.com, https://keymaster2.example.com:8443",
+		filepath.Join(dir, "missing.pem"),
+		caPath,
+		"alice",
+		"1024",
+		"4096",
+		"maybe",
+		"y",
+	}, "\n") + "\n"
+	var out bytes.Buffer
+	err = initConfigCommand([]string{configPath}, strings.NewReader(answers), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadVerifyConfigFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints := config.Base.Endpoints
+	if len(endpoints) != 2 || endpoints[0].URL != "https://keymaster1.example.com" ||
+		endpoints[0].Weight <= endpoints[1].Weight || endpoints[1].CAFile != caPath {
+		t.Fatalf("unexpected endpoints %+v", endpoints)
+	}
+	if config.Base.Username != "alice" || config.Base.KeyBits != 4096 || !config.Base.AlsoEd25519 {
+		t.Fatalf("unexpected user preferences %+v", config.Base)
+	}
+	err = initConfigCommand([]string{configPath}, strings.NewReader(answers), &out)
+	if err == nil {
+		t.Fatal("should not have overwritten the config")
+	}
+}
+
+func TestInitConfigCommandEndOfInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster-init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "config.yml")
+	var out bytes.Buffer
+	err = initConfigCommand([]string{configPath}, strings.NewReader(""), &out)
+	if err == nil {
+		t.Fatal("should have failed without answers")
+	}
+	if _, err := os.Stat(configPath); !os.IsNotExist(err) {
+		t.Fatal("no config should have been written")
+	}
+}
+
+func TestInitConfigCommandUserConfigDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster-init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The user config dir is under $HOME on macOS
+	for _, name := range []string{"XDG_CONFIG_HOME", "HOME"} {
+		previous, wasSet := os.LookupEnv(name)
+		os.Setenv(name, dir)
+		defer func(name string) {
+			if wasSet {
+				os.Setenv(name, previous)
+			} else {
+				os.Unsetenv(name)
+			}
+		}(name)
+	}
+	defer func() { *configFilename = "config.yml" }()
+	var out bytes.Buffer
+	err = initConfigCommand(nil, strings.NewReader("https://keymaster.example.com\n\n\n\n\n"), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath, err := userConfigPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(configPath, dir) {
+		t.Fatalf("unexpected user config %s", configPath)
+	}
+	if _, err := os.Stat(configPath); err != nil {
+		t.Fatal(err)
+	}
+	resolveConfigFilename()
+	if *configFilename != configPath {
+		t.Fatalf("expected the config of init to be used, got %s", *configFilename)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Values of --on-interrupt.
+const (
+	onInterruptRollback = "rollback"
+	onInterruptKeep     = "keep"
+)
+
+// Exit code of runs interrupted by SIGINT or SIGTERM, as shells use.
+const exitCodeInterrupted = 130
+
+func validateOnInterrupt(policy string) error {
+	switch policy {
+	case onInterruptRollback, onInterruptKeep:
+		return nil
+	}
+	return fmt.Errorf("unknown --on-interrupt policy '%s', use rollback or keep", policy)
+}
+
+// fileSnapshot is the content of a file before the run, nil when it did
+// not exist.
+type fileSnapshot struct {
+	content []byte
+	mode    os.FileMode
+}
+
+// interruptGuard implements --on-interrupt rollback. It snapshots the
+// files a run may change so that an interrupt before the certs are
+// written puts them back as they were, instead of leaving a new key
+// without a cert or the previous files moved to their backups.
+type interruptGuard struct {
+	mutex     sync.Mutex
+	snapshots map[string]*fileSnapshot
+	finished  bool
+	signals   chan os.Signal
+}
+
+func newInterruptGuard(paths []string) (*interruptGuard, error) {
+	guard := &interruptGuard{snapshots: make(map[string]*fileSnapshot)}
+	if err := guard.add(paths); err != nil {
+		return nil, err
+	}
+	return guard, nil
+}
+
+// add snapshots more paths, such as the cert files named by the server,
+// only known once the certs are issued. A nil guard does nothing.
+func (guard *interruptGuard) add(paths []string) error {
+	if guard == nil {
+		return nil
+	}
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	for _, path := range paths {
+		for _, snapshotPath := range []string{path, path + backupSuffix} {
+			if _, ok := guard.snapshots[snapshotPath]; ok {
+				continue
+			}
+			snapshot, err := takeFileSnapshot(snapshotPath)
+			if err != nil {
+				return err
+			}
+			guard.snapshots[snapshotPath] = snapshot
+		}
+	}
+	return nil
+}
+
+func takeFileSnapshot(path string) (*fileSnapshot, error) {
+	fileInfo, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSnapshot{content: content, mode: fileInfo.Mode().Perm()}, nil
+}
+
+// watch rolls back and exits on SIGINT or SIGTERM until finish is called.
+func (guard *interruptGuard) watch() {
+	guard.signals = make(chan os.Signal, 1)
+	signal.Notify(guard.signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		if _, ok := <-guard.signals; !ok {
+			return
+		}
+		guard.mutex.Lock()
+		if guard.finished {
+			os.Exit(exitCodeInterrupted)
+		}
+		if err := guard.rollback(); err != nil {
+			log.Printf("interrupted, restoring the previous files failed: %s", err)
+		} else {
+			log.Printf("interrupted, no changes made")
+		}
+		os.Exit(exitCodeInterrupted)
+	}()
+}
+
+// rollback restores every snapshot, removing the files created since.
+func (guard *interruptGuard) rollback() error {
+	var firstErr error
+	for path, snapshot := range guard.snapshots {
+		var err error
+		if snapshot == nil {
+			err = os.Remove(path)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			err = ioutil.WriteFile(path, snapshot.content, snapshot.mode)
+			if err == nil {
+				err = os.Chmod(path, snapshot.mode)
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// commit runs write, the step storing the certs, without being
+// interrupted, and stops rolling back once it is done. A nil guard, with
+// --on-interrupt keep, only runs write.
+func (guard *interruptGuard) commit(write func() error) error {
+	if guard == nil {
+		return write()
+	}
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	err := write()
+	guard.finished = true
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInterruptGuardRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster-interrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath := filepath.Join(dir, "keymaster-cert.pub")
+	keyPath := filepath.Join(dir, "keymaster")
+	if err := ioutil.WriteFile(certPath, []byte("old cert"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	guard, err := newInterruptGuard([]string{certPath, keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// what a run does before being interrupted
+	if _, err := backupExisting(onExistingBackup, []string{certPath}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, []byte("new key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := guard.rollback(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(certPath)
+	if err != nil || string(content) != "old cert" {
+		t.Fatalf("expected the old cert back, got '%s': %v", content, err)
+	}
+	for _, path := range []string{keyPath, certPath + backupSuffix} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s should have been removed", path)
+		}
+	}
+}
+
+func TestInterruptGuardCommit(t *testing.T) {
+	var guard *interruptGuard
+	if err := guard.commit(func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	guard, err := newInterruptGuard(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := errors.New("write failed")
+	if err := guard.commit(func() error { return expected }); err != expected {
+		t.Fatalf("expected the write error, got %v", err)
+	}
+	if !guard.finished {
+		t.Fatal("the guard should stop rolling back once committed")
+	}
+	if err := validateOnInterrupt("ignore"); err == nil {
+		t.Fatal("should have failed on an unknown policy")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// extractJSONCert returns the cert held by field in a JSON certgen
+// response, for servers wrapping the cert in an envelope such as
+// {"sshCert": "..."}. Nested fields are separated by dots, as in
+// "data.sshCert".
+func extractJSONCert(body []byte, field string) ([]byte, error) {
+	value, err := lookupJSONField(body, field)
+	if err != nil {
+		return nil, fmt.Errorf("certgen response %s", err)
+	}
+	cert, ok := value.(string)
+	if !ok || len(cert) < 1 {
+		return nil, fmt.Errorf("certgen response field '%s' is not a cert", field)
+	}
+	return []byte(cert), nil
+}
+
+// lookupJSONField returns the value of the dot separated field in the JSON
+// body. Errors are worded to follow the name of the response.
+func lookupJSONField(body []byte, field string) (interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return nil, fmt.Errorf("is not valid JSON: %s", err)
+	}
+	for _, name := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("has no object holding '%s'", name)
+		}
+		value, ok = object[name]
+		if !ok {
+			return nil, fmt.Errorf("has no '%s' field, found %s",
+				field, strings.Join(sortedKeys(object), ", "))
+		}
+	}
+	return value, nil
+}
+
+func validateCertResponseFields(fields map[string]string) error {
+	for certType, field := range fields {
+		switch certType {
+		case "ssh", "x509", hostCertType:
+		default:
+			return fmt.Errorf("unknown cert type '%s' in cert_response_fields", certType)
+		}
+		if len(strings.TrimSpace(field)) < 1 {
+			return errors.New("empty field name for " + certType + " in cert_response_fields")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExtractJSONCert(t *testing.T) {
+	body := []byte(`{"sshCert": "ssh-cert", "data": {"x509Cert": "x509-cert"}, "count": 1}`)
+	cert, err := extractJSONCert(body, "sshCert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cert) != "ssh-cert" {
+		t.Fatalf("unexpected cert '%s'", cert)
+	}
+	cert, err = extractJSONCert(body, "data.x509Cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cert) != "x509-cert" {
+		t.Fatalf("unexpected cert '%s'", cert)
+	}
+	for _, field := range []string{"missing", "count", "sshCert.inner", "data"} {
+		if _, err := extractJSONCert(body, field); err == nil {
+			t.Fatalf("field '%s' should have been rejected", field)
+		}
+	}
+	if _, err := extractJSONCert([]byte("ssh-rsa-cert-v01@openssh.com AAAA"), "sshCert"); err == nil {
+		t.Fatal("a plain cert should have been rejected")
+	}
+}
+
+func TestDoCertRequestJSONResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"sshCert": "cert"}`))
+	}))
+	defer server.Close()
+	if _, err := doCertRequest(server.Client(), server.URL+"/certgen/username", "ssh", "key"); err == nil {
+		t.Fatal("a JSON response should be rejected without cert_response_fields")
+	}
+	certResponseFields = map[string]string{"ssh": "sshCert"}
+	defer func() { certResponseFields = nil }()
+	cert, err := doCertRequest(server.Client(), server.URL+"/certgen/username", "ssh", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cert) != "cert" {
+		t.Fatalf("unexpected cert '%s'", cert)
+	}
+}
+
+func TestValidateCertResponseFields(t *testing.T) {
+	if err := validateCertResponseFields(map[string]string{"ssh": "sshCert", "x509": "x509Cert"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateCertResponseFields(map[string]string{"u2f": "cert"}); err == nil {
+		t.Fatal("unknown cert type should be rejected")
+	}
+	if err := validateCertResponseFields(map[string]string{"ssh": " "}); err == nil {
+		t.Fatal("empty field should be rejected")
+	}
+}
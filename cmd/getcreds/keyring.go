@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/zalando/go-keyring"
+	"log"
+)
+
+func getKeyringAccount(userName string) string {
+	if len(*keyringAccount) > 0 {
+		return *keyringAccount
+	}
+	return userName
+}
+
+// getPasswordFromKeyring looks up the password stored in the OS native
+// keyring (macOS Keychain, Windows Credential Manager or Secret Service).
+func getPasswordFromKeyring(userName string) ([]byte, error) {
+	password, err := keyring.Get(*keyringService, getKeyringAccount(userName))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(password), nil
+}
+
+func storePasswordInKeyring(userName string, password []byte) error {
+	err := keyring.Set(*keyringService, getKeyringAccount(userName), string(password))
+	if err != nil {
+		return err
+	}
+	if *debug {
+		log.Printf("stored password in keyring service '%s'", *keyringService)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/Symantec/keymaster/lib/certgen"
+	"github.com/Symantec/keymaster/lib/client"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shouldReuseKey decides if the private key at privateKeyPath can be
+// reused, returning the reason when it cannot. A maxAge of zero means the
+// key never needs to be rotated.
+func shouldReuseKey(privateKeyPath string, maxAge time.Duration, now time.Time) (bool, string) {
+	fileInfo, err := os.Stat(privateKeyPath)
+	if err != nil {
+		return false, fmt.Sprintf("no existing key at %s", privateKeyPath)
+	}
+	if maxAge > 0 {
+		age := now.Sub(fileInfo.ModTime())
+		if age > maxAge {
+			return false, fmt.Sprintf("key at %s is %s old, older than the maximum of %s",
+				privateKeyPath, age.Truncate(time.Second), maxAge)
+		}
+	}
+	return true, ""
+}
+
+// parseKeyTypes parses --reuse-key-types, a comma separated list of key
+// types with an optional minimum size in bits, such as
+// "rsa:2048,ecdsa:256,ed25519". It returns the minimum size by type.
+func parseKeyTypes(value string) (map[string]int, error) {
+	keyTypes := make(map[string]int)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) < 1 {
+			continue
+		}
+		keyType, bits := entry, 0
+		if i := strings.Index(entry, ":"); i >= 0 {
+			var err error
+			keyType = entry[:i]
+			bits, err = strconv.Atoi(entry[i+1:])
+			if err != nil || bits < 1 {
+				return nil, fmt.Errorf("invalid key size in '%s'", entry)
+			}
+		}
+		switch keyType {
+		case "rsa", "ecdsa", "ed25519":
+		default:
+			return nil, fmt.Errorf("unknown key type '%s', use rsa, ecdsa or ed25519", keyType)
+		}
+		keyTypes[keyType] = bits
+	}
+	if len(keyTypes) < 1 {
+		return nil, errors.New("no key type allowed")
+	}
+	return keyTypes, nil
+}
+
+// checkReusableKeyType rejects reusing a key whose type or size is not
+// in allowed, such as a legacy RSA 1024 key, so that it gets replaced.
+func checkReusableKeyType(signer crypto.Signer, allowed string) error {
+	keyTypes, err := parseKeyTypes(allowed)
+	if err != nil {
+		return err
+	}
+	var keyType string
+	var bits int
+	switch pub := signer.Public().(type) {
+	case *rsa.PublicKey:
+		keyType, bits = "rsa", pub.N.BitLen()
+	case *ecdsa.PublicKey:
+		keyType, bits = "ecdsa", pub.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		keyType, bits = "ed25519", 256
+	default:
+		return fmt.Errorf("%T keys are not allowed", pub)
+	}
+	minBits, ok := keyTypes[keyType]
+	if !ok {
+		return fmt.Errorf("%s keys are not allowed by --reuse-key-types", keyType)
+	}
+	if bits < minBits {
+		return fmt.Errorf("%d bit %s key is smaller than the minimum of %d", bits, keyType, minBits)
+	}
+	return nil
+}
+
+// parsePrivateKeyPEM parses the PKCS1, EC, PKCS8 or OpenSSH PEM private
+// keys produced by ssh-keygen, openssl and most crypto modules.
+func parsePrivateKeyPEM(pemKey []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return certgen.GetSignerFromPEMBytes(pemKey)
+	}
+	var privateKey interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "OPENSSH PRIVATE KEY":
+		privateKey, err = ssh.ParseRawPrivateKey(pemKey)
+	default:
+		return certgen.GetSignerFromPEMBytes(pemKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := privateKey.(*ed25519.PrivateKey); ok {
+		privateKey = *key
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("cannot sign with a %T key", privateKey)
+	}
+	return signer, nil
+}
+
+// genEd25519Key generates the extra key of --also-ed25519, see
+// client.NewEd25519KeyPair.
+func genEd25519Key(random io.Reader) (crypto.Signer, []byte, error) {
+	return client.NewEd25519KeyPair(random)
+}
+
+// runKeygenCommand implements --keygen-command, delegating the key
+// generation to an external program (e.g. a FIPS validated module) that
+// prints the new private key as PEM on its standard output.
+func runKeygenCommand(command string) (crypto.Signer, []byte, error) {
+	args := strings.Fields(command)
+	if len(args) < 1 {
+		return nil, nil, errors.New("empty keygen command")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	pemKey, err := cmd.Output()
+	if err != nil {
+		return nil, nil, fmt.Errorf("keygen command failed: %s", err)
+	}
+	signer, err := parsePrivateKeyPEM(pemKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot parse the key from the keygen command: %s", err)
+	}
+	return signer, pemKey, nil
+}
+
+func loadKeyPair(privateKeyPath string) (crypto.Signer, error) {
+	pemKey, err := ioutil.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return parsePrivateKeyPEM(pemKey)
+}
+
+// loadOrGenKeyPair implements --reuse-key: the existing key is loaded when
+// it is still acceptable, otherwise a new one is generated in its place.
+// generated reports which of the two happened.
+func loadOrGenKeyPair(privateKeyPath string) (signer crypto.Signer, generated bool, err error) {
+	reuse, reason := shouldReuseKey(privateKeyPath, *keyMaxAge, time.Now())
+	if reuse {
+		signer, err := loadKeyPair(privateKeyPath)
+		if err == nil {
+			err = checkReusableKeyType(signer, *reuseKeyTypes)
+		}
+		if err == nil {
+			if *debug {
+				log.Printf("reusing key at %s", privateKeyPath)
+			}
+			return signer, false, nil
+		}
+		reason = fmt.Sprintf("cannot reuse key at %s: %s", privateKeyPath, err)
+	}
+	log.Printf("generating a new key: %s", reason)
+	signer, _, err = genKeyPair(privateKeyPath, rand.Reader)
+	return signer, true, err
+}
+
+// keyFilePath returns the private key path for the file prefix in dir,
+// ending with --key-suffix.
+func keyFilePath(dir string, prefix string) string {
+	return filepath.Join(dir, prefix+*keySuffix)
+}
+
+// publicKeyPath returns the public key paired with privateKeyPath, where
+// --pub-key-suffix replaces --key-suffix.
+func publicKeyPath(privateKeyPath string) string {
+	return strings.TrimSuffix(privateKeyPath, *keySuffix) + *pubKeySuffix
+}
+
+func validateKeySuffixes(keySuffix string, pubKeySuffix string) error {
+	for _, suffix := range []string{keySuffix, pubKeySuffix} {
+		if strings.ContainsAny(suffix, `/\`) {
+			return fmt.Errorf("key file suffix '%s' cannot contain a path separator", suffix)
+		}
+	}
+	if len(pubKeySuffix) < 1 || pubKeySuffix == keySuffix || pubKeySuffix == "-cert.pub" {
+		return fmt.Errorf("public key suffix '%s' would overwrite another key file", pubKeySuffix)
+	}
+	return nil
+}
+
+// removeKeyPair implements --cleanup-on-failure, removing a freshly
+// generated key pair that never got signed.
+func removeKeyPair(privateKeyPath string) {
+	for _, path := range []string{privateKeyPath, publicKeyPath(privateKeyPath)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("cannot remove unsigned key %s: %s", path, err)
+			continue
+		}
+		if *debug {
+			log.Printf("removed unsigned key %s", path)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShouldReuseKey(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "test_shouldReuseKey_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+	modTime := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(tmpfile.Name(), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	if reuse, reason := shouldReuseKey(tmpfile.Name(), 0, time.Now()); !reuse {
+		t.Fatalf("key without max age should be reused: %s", reason)
+	}
+	if reuse, reason := shouldReuseKey(tmpfile.Name(), 72*time.Hour, time.Now()); !reuse {
+		t.Fatalf("key younger than max age should be reused: %s", reason)
+	}
+	if reuse, _ := shouldReuseKey(tmpfile.Name(), 24*time.Hour, time.Now()); reuse {
+		t.Fatal("key older than max age should not be reused")
+	}
+	if reuse, _ := shouldReuseKey("/nonexistent/keymaster", 0, time.Now()); reuse {
+		t.Fatal("missing key should not be reused")
+	}
+}
+
+func TestLoadOrGenKeyPairReusesKey(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "test_loadOrGenKeyPair_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	defer os.Remove(tmpfile.Name() + ".pub")
+	tmpfile.Close()
+
+	// An empty file cannot be loaded so a new key is generated
+	first, generated, err := loadOrGenKeyPair(tmpfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !generated {
+		t.Fatal("key should have been generated")
+	}
+	second, generated, err := loadOrGenKeyPair(tmpfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generated {
+		t.Fatal("key should have been reused")
+	}
+	firstDer, err := x509.MarshalPKIXPublicKey(first.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondDer, err := x509.MarshalPKIXPublicKey(second.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(firstDer, secondDer) {
+		t.Fatal("key was not reused")
+	}
+}
+
+func TestGenKeyPairKeygenCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster-keygen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derKey, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	externalKeyPath := filepath.Join(dir, "external.pem")
+	err = ioutil.WriteFile(externalKeyPath,
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: derKey}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*keygenCommand = "cat " + externalKeyPath
+	defer func() { *keygenCommand = "" }()
+	signer, pubKeyPath, err := genKeyPair(filepath.Join(dir, "keymaster"), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecKey.PublicKey.Equal(signer.Public()) {
+		t.Fatal("signer does not use the key from the keygen command")
+	}
+	if _, err := os.Stat(pubKeyPath); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadKeyPair(filepath.Join(dir, "keymaster"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecKey.PublicKey.Equal(loaded.Public()) {
+		t.Fatal("written key does not match the key from the keygen command")
+	}
+
+	*keygenCommand = "false"
+	if _, _, err := genKeyPair(filepath.Join(dir, "failed"), rand.Reader); err == nil {
+		t.Fatal("should have failed when the keygen command fails")
+	}
+}
+
+func TestGenEd25519KeyRoundTrip(t *testing.T) {
+	signer, pemKey, err := genEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parsePrivateKeyPEM(pemKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !signer.Public().(ed25519.PublicKey).Equal(parsed.Public()) {
+		t.Fatal("parsed key does not match the generated key")
+	}
+}
+
+func TestKeyFileSuffixes(t *testing.T) {
+	defer func() { *keySuffix, *pubKeySuffix = "", ".pub" }()
+	if path := publicKeyPath("/home/user/.ssh/keymaster"); path != "/home/user/.ssh/keymaster.pub" {
+		t.Fatalf("unexpected default public key path %s", path)
+	}
+	*keySuffix, *pubKeySuffix = ".key", ".pub"
+	privateKeyPath := keyFilePath("/home/user/.ssh", FilePrefix)
+	if privateKeyPath != "/home/user/.ssh/keymaster.key" {
+		t.Fatalf("unexpected private key path %s", privateKeyPath)
+	}
+	if path := publicKeyPath(privateKeyPath); path != "/home/user/.ssh/keymaster.pub" {
+		t.Fatalf("unexpected public key path %s", path)
+	}
+	*keySuffix, *pubKeySuffix = "_rsa", "_rsa.pub"
+	if path := publicKeyPath(keyFilePath("/home/user/.ssh", FilePrefix)); path != "/home/user/.ssh/keymaster_rsa.pub" {
+		t.Fatalf("unexpected public key path %s", path)
+	}
+	for _, suffixes := range [][2]string{{".key", ".key"}, {"", ""}, {"/../x", ".pub"}, {"", "-cert.pub"}} {
+		if err := validateKeySuffixes(suffixes[0], suffixes[1]); err == nil {
+			t.Fatalf("suffixes %v should have been rejected", suffixes)
+		}
+	}
+}
+
+func TestCheckReusableKeyType(t *testing.T) {
+	weakKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkReusableKeyType(weakKey, "rsa:2048,ed25519"); err == nil {
+		t.Fatal("should have refused an RSA 1024 key")
+	}
+	if err := checkReusableKeyType(weakKey, "rsa"); err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkReusableKeyType(ed25519Key, "rsa:2048,ed25519"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkReusableKeyType(ed25519Key, "rsa:2048"); err == nil {
+		t.Fatal("should have refused an Ed25519 key")
+	}
+	for _, value := range []string{"dsa", "rsa:big", "", "rsa:0"} {
+		if _, err := parseKeyTypes(value); err == nil {
+			t.Errorf("should have refused '%s'", value)
+		}
+	}
+}
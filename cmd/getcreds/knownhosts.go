@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const x509CAPath = "/public/x509ca"
+
+// Markers delimiting the known_hosts entries managed by keymaster.
+const (
+	knownHostsBeginMarker = "# BEGIN keymaster cert-authority"
+	knownHostsEndMarker   = "# END keymaster cert-authority"
+)
+
+// getSSHCAPublicKey fetches the keymaster CA. The server signs both cert
+// types with the same key, so the ssh CA key is the x509 CA public key.
+func getSSHCAPublicKey(client *http.Client, baseUrl string) (ssh.PublicKey, error) {
+	resp, err := client.Get(baseUrl + x509CAPath)
+	if err != nil {
+		return nil, describeTLSError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got error from CA call %s", resp.Status)
+	}
+	pemCert, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pemCert)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("cannot decode the CA cert")
+	}
+	caCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewPublicKey(caCert.PublicKey)
+}
+
+// replaceKnownHostsBlock returns known_hosts content with the keymaster
+// managed block set to lines, replacing any previous block in place.
+func replaceKnownHostsBlock(content []byte, lines []string) []byte {
+	block := knownHostsBeginMarker + "\n" + strings.Join(lines, "\n") + "\n" + knownHostsEndMarker + "\n"
+	text := string(content)
+	begin := strings.Index(text, knownHostsBeginMarker+"\n")
+	end := strings.Index(text, knownHostsEndMarker+"\n")
+	if begin >= 0 && end > begin {
+		return []byte(text[:begin] + block + text[end+len(knownHostsEndMarker)+1:])
+	}
+	if len(text) > 0 && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return []byte(text + block)
+}
+
+// knownHostsBlockLines returns the entries of the keymaster managed block
+// of known_hosts content.
+func knownHostsBlockLines(content []byte) []string {
+	text := string(content)
+	begin := strings.Index(text, knownHostsBeginMarker+"\n")
+	end := strings.Index(text, knownHostsEndMarker+"\n")
+	if begin < 0 || end <= begin {
+		return nil
+	}
+	var lines []string
+	for _, line := range strings.Split(text[begin+len(knownHostsBeginMarker)+1:end], "\n") {
+		if len(strings.TrimSpace(line)) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// mergeKnownHostsLine sets the @cert-authority entry for pattern in lines,
+// replacing the entry for the same pattern and keeping the others.
+func mergeKnownHostsLine(lines []string, pattern string, line string) []string {
+	var merged []string
+	replaced := false
+	for _, existing := range lines {
+		fields := strings.Fields(existing)
+		if len(fields) > 1 && fields[0] == "@cert-authority" && fields[1] == pattern {
+			if !replaced {
+				merged = append(merged, line)
+				replaced = true
+			}
+			continue
+		}
+		merged = append(merged, existing)
+	}
+	if !replaced {
+		merged = append(merged, line)
+	}
+	return merged
+}
+
+// updateKnownHosts trusts caKey for the hosts matching pattern, keeping the
+// entries managed for other patterns, returning false when known_hosts
+// already had the same entry. The mode of an
+// existing file is kept.
+func updateKnownHosts(path string, pattern string, caKey ssh.PublicKey) (bool, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	mode := os.FileMode(0644)
+	if fileInfo, err := os.Stat(path); err == nil {
+		mode = fileInfo.Mode().Perm()
+	}
+	line := "@cert-authority " + pattern + " " +
+		strings.TrimSpace(string(ssh.MarshalAuthorizedKey(caKey)))
+	updated := replaceKnownHostsBlock(content,
+		mergeKnownHostsLine(knownHostsBlockLines(content), pattern, line))
+	if bytes.Equal(content, updated) {
+		return false, nil
+	}
+	return true, writeFileAtomic(path, updated, mode, ".keymaster-known_hosts-")
+}
+
+// checkCAFingerprint implements --ca-fingerprint, rejecting a CA key that
+// is not the one expected, as a MITM on the first download could otherwise
+// make the hosts trust its own CA. The SHA256: prefix is optional.
+func checkCAFingerprint(caKey ssh.PublicKey, expected string) error {
+	if len(expected) < 1 {
+		return nil
+	}
+	fingerprint := ssh.FingerprintSHA256(caKey)
+	if strings.TrimPrefix(fingerprint, "SHA256:") != strings.TrimPrefix(expected, "SHA256:") {
+		return fmt.Errorf("keymaster CA %s does not match the expected fingerprint %s", fingerprint, expected)
+	}
+	return nil
+}
+
+// trustHostCACommand implements the trust-host-ca command, adding the
+// keymaster CA as a @cert-authority for the hosts matching the pattern.
+func trustHostCACommand(args []string, knownHostsPath string) error {
+	pattern := "*"
+	switch len(args) {
+	case 0:
+	case 1:
+		pattern = args[0]
+	default:
+		return errors.New("usage: trust-host-ca [host pattern]")
+	}
+	config, err := loadVerifyConfigFile(*configFilename)
+	if err != nil {
+		return err
+	}
+	var rootCAs *x509.CertPool
+	if len(*caFile) > 0 {
+		rootCAs, err = loadRootCAs(*caFile)
+		if err != nil {
+			return err
+		}
+	}
+	tlsConfig, err := newTLSConfig(rootCAs)
+	if err != nil {
+		return err
+	}
+	client, err := newHTTPClient(tlsConfig)
+	if err != nil {
+		return err
+	}
+	endpoints, err := resolveEndpoints(config, lookupSRV)
+	if err != nil {
+		return err
+	}
+	for _, baseUrl := range getEndpointURLs(orderEndpoints(endpoints,
+		config.Base.RandomizeEqualWeights)) {
+		caKey, err := getSSHCAPublicKey(client, baseUrl)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		// A wrong CA is never worth trying the next endpoint for
+		if err := checkCAFingerprint(caKey, *caFingerprint); err != nil {
+			return err
+		}
+		changed, err := updateKnownHosts(knownHostsPath, pattern, caKey)
+		if err != nil {
+			return err
+		}
+		if changed {
+			log.Printf("added keymaster CA %s for '%s' to %s",
+				ssh.FingerprintSHA256(caKey), pattern, knownHostsPath)
+		} else {
+			log.Printf("%s already trusts the keymaster CA for '%s'", knownHostsPath, pattern)
+		}
+		return nil
+	}
+	return errors.New("Failed to get the CA from any url")
+}
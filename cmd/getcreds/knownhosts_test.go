@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUpdateKnownHostsIsIdempotent(t *testing.T) {
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	dir, err := ioutil.TempDir("", "keymaster-known_hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "known_hosts")
+	existing := "github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+	if err := ioutil.WriteFile(path, []byte(existing), 0600); err != nil {
+		t.Fatal(err)
+	}
+	client, err := newHTTPClient(&tls.Config{RootCAs: fake.RootCAs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey, err := getSSHCAPublicKey(client, fake.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssh.FingerprintSHA256(caKey) != ssh.FingerprintSHA256(fake.sshSigner.PublicKey()) {
+		t.Fatal("fetched CA key does not match the ssh CA")
+	}
+	changed, err := updateKnownHosts(path, "*.example.com", caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Fatal("known_hosts should have been updated")
+	}
+	changed, err = updateKnownHosts(path, "*.example.com", caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Fatal("second update should be a no-op")
+	}
+	if _, err := updateKnownHosts(path, "*.corp.example.com", caKey); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(content)
+	if !strings.HasPrefix(text, existing+"\n") {
+		t.Fatalf("existing entries were not kept: %s", text)
+	}
+	if strings.Count(text, knownHostsBeginMarker) != 1 ||
+		strings.Count(text, "@cert-authority") != 2 ||
+		!strings.Contains(text, "@cert-authority *.corp.example.com ") {
+		t.Fatalf("expected an entry per pattern in a single block: %s", text)
+	}
+	if fileInfo, err := os.Stat(path); err != nil || fileInfo.Mode().Perm() != 0600 {
+		t.Fatal("the mode of known_hosts should have been kept")
+	}
+}
+
+func TestUpdateKnownHostsMergesPatterns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster-known_hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	newCAKey := func() ssh.PublicKey {
+		public, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		caKey, err := ssh.NewPublicKey(public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return caKey
+	}
+	caKey, rotatedKey := newCAKey(), newCAKey()
+	for i, patterns := range [][]string{
+		{"*.a.example", "*.b.example"},
+		{"*.b.example", "*.a.example"},
+	} {
+		path := filepath.Join(dir, fmt.Sprintf("known_hosts%d", i))
+		for _, pattern := range patterns {
+			if _, err := updateKnownHosts(path, pattern, caKey); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Only the entry of the same pattern is replaced
+		if _, err := updateKnownHosts(path, patterns[0], rotatedKey); err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := knownHostsBlockLines(content)
+		expected := []string{
+			"@cert-authority " + patterns[0] + " " +
+				strings.TrimSpace(string(ssh.MarshalAuthorizedKey(rotatedKey))),
+			"@cert-authority " + patterns[1] + " " +
+				strings.TrimSpace(string(ssh.MarshalAuthorizedKey(caKey))),
+		}
+		if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+			t.Fatalf("%v: unexpected managed entries %v", patterns, lines)
+		}
+		if strings.Count(string(content), knownHostsBeginMarker) != 1 {
+			t.Fatalf("%v: expected a single managed block: %s", patterns, content)
+		}
+	}
+}
+
+func TestCheckCAFingerprint(t *testing.T) {
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	caKey := fake.sshSigner.PublicKey()
+	fingerprint := ssh.FingerprintSHA256(caKey)
+	for _, expected := range []string{"", fingerprint, strings.TrimPrefix(fingerprint, "SHA256:")} {
+		if err := checkCAFingerprint(caKey, expected); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := checkCAFingerprint(caKey, "SHA256:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU"); err == nil {
+		t.Fatal("should have rejected another CA")
+	}
+}
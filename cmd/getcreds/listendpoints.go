@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// listEndpoints implements --list-endpoints, printing the configured
+// endpoints in the order they are tried, without any network call. The
+// endpoints of srvRecord are only known once it is resolved, at run time,
+// so the record itself is printed.
+func listEndpoints(out io.Writer, endpoints []endpointConfig, randomized bool, srvRecord string) error {
+	writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "#\tURL\tWEIGHT\tTLS OVERRIDES")
+	for i, endpoint := range endpoints {
+		var overrides []string
+		if len(endpoint.CAFile) > 0 {
+			overrides = append(overrides, "ca_file="+endpoint.CAFile)
+		}
+		if len(endpoint.ServerName) > 0 {
+			overrides = append(overrides, "server_name="+endpoint.ServerName)
+		}
+		if len(endpoint.ExpectedSAN) > 0 {
+			overrides = append(overrides, "expected_san="+endpoint.ExpectedSAN)
+		}
+		if len(overrides) < 1 {
+			overrides = append(overrides, "-")
+		}
+		fmt.Fprintf(writer, "%d\t%s\t%d\t%s\n", i+1, endpoint.URL, endpoint.Weight,
+			strings.Join(overrides, " "))
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if len(srvRecord) > 0 {
+		fmt.Fprintf(out, "more endpoints from the SRV record %s, not resolved here\n", srvRecord)
+	}
+	if randomized {
+		_, err := fmt.Fprintln(out, "endpoints of equal weight are shuffled on every run")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestListEndpoints(t *testing.T) {
+	endpoints := orderEndpoints([]endpointConfig{
+		{URL: "https://km2.example.com"},
+		{URL: "https://km1.example.com", Weight: 10, ServerName: "keymaster.example.com"},
+	}, false)
+	var out bytes.Buffer
+	if err := listEndpoints(&out, endpoints, false, "_keymaster._tcp.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || !strings.Contains(lines[3], "_keymaster._tcp.example.com") {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+	if !strings.HasPrefix(lines[1], "1  https://km1.example.com") ||
+		!strings.HasSuffix(lines[1], "server_name=keymaster.example.com") {
+		t.Fatalf("unexpected first endpoint '%s'", lines[1])
+	}
+	if !strings.HasPrefix(lines[2], "2  https://km2.example.com") {
+		t.Fatalf("unexpected second endpoint '%s'", lines[2])
+	}
+}
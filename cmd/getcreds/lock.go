@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const lockRetryInterval = 100 * time.Millisecond
+
+var errLockHeld = errors.New("lock held by another process")
+
+// acquireLock takes an exclusive lock on path so that concurrent runs do
+// not overwrite each other's keys and certs. A zero timeout fails right
+// away when the lock is held and a negative timeout waits forever. The
+// returned function releases the lock.
+func acquireLock(path string, timeout time.Duration) (func(), error) {
+	lockFile, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	for {
+		err = tryLockFile(lockFile)
+		if err == nil {
+			return func() {
+				unlockFile(lockFile)
+				lockFile.Close()
+			}, nil
+		}
+		if err != errLockHeld {
+			lockFile.Close()
+			return nil, err
+		}
+		if timeout >= 0 && time.Since(start) >= timeout {
+			lockFile.Close()
+			return nil, fmt.Errorf("another instance holds the lock %s, gave up after %s", path, timeout)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func tryLockFile(lockFile *os.File) error {
+	err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLockHeld
+	}
+	return err
+}
+
+func unlockFile(lockFile *os.File) {
+	syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAcquireLockTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lockPath := filepath.Join(dir, "keymaster.lock")
+	release, err := acquireLock(lockPath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acquireLock(lockPath, 0); err == nil {
+		t.Fatal("second lock should fail immediately with a zero timeout")
+	}
+	start := time.Now()
+	if _, err := acquireLock(lockPath, 300*time.Millisecond); err == nil {
+		t.Fatal("second lock should fail after the timeout")
+	}
+	if time.Since(start) < 300*time.Millisecond {
+		t.Fatal("gave up before the timeout")
+	}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		release()
+	}()
+	releaseWaiting, err := acquireLock(lockPath, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseWaiting()
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+func tryLockFile(lockFile *os.File) error {
+	overlapped := new(windows.Overlapped)
+	err := windows.LockFileEx(windows.Handle(lockFile.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, overlapped)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return errLockHeld
+	}
+	return err
+}
+
+func unlockFile(lockFile *os.File) {
+	windows.UnlockFileEx(windows.Handle(lockFile.Fd()), 0, 1, 0, new(windows.Overlapped))
+}
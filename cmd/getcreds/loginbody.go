@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Ways to send the login credentials, set with login_body.
+const (
+	loginBodyForm  = "form"
+	loginBodyJSON  = "json"
+	loginBodyBasic = "basic"
+)
+
+func validateLoginBody(body string) error {
+	switch body {
+	case "", loginBodyForm, loginBodyJSON, loginBodyBasic:
+		return nil
+	}
+	return fmt.Errorf("unsupported login_body '%s', use form, json or basic", body)
+}
+
+// buildLoginRequest returns the login request sending the credentials as
+// form fields, the default, a JSON object or a basic auth header with no
+// body, named after the configured fields.
+func buildLoginRequest(loginUrl string, userName string, password []byte) (*http.Request, error) {
+	var body []byte
+	var contentType string
+	switch loginBody {
+	case loginBodyJSON:
+		var err error
+		body, err = json.Marshal(map[string]string{
+			loginUsernameField: userName,
+			loginPasswordField: string(password),
+		})
+		if err != nil {
+			return nil, err
+		}
+		contentType = "application/json"
+	case loginBodyBasic:
+	default:
+		form := url.Values{}
+		form.Add(loginUsernameField, userName)
+		form.Add(loginPasswordField, string(password[:]))
+		body = []byte(form.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	}
+	req, err := http.NewRequest(loginMethod, loginUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if loginBody == loginBodyBasic {
+		req.SetBasicAuth(userName, string(password))
+	} else {
+		req.Header.Add("Content-Length", strconv.Itoa(len(body)))
+		req.Header.Add("Content-Type", contentType)
+	}
+	req.Header.Add("Accept", "application/json")
+	return req, nil
+}
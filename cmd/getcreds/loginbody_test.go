@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestBuildLoginRequest(t *testing.T) {
+	defer func() {
+		loginBody, loginUsernameField, loginPasswordField = loginBodyForm, "username", "password"
+	}()
+	req, err := buildLoginRequest("https://keymaster.example.com/api/v0/login", "user", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+	if req.PostForm.Get("username") != "user" || req.PostForm.Get("password") != "secret" {
+		t.Fatalf("unexpected form %v", req.PostForm)
+	}
+
+	loginBody, loginUsernameField, loginPasswordField = loginBodyJSON, "login", "pass"
+	req, err = buildLoginRequest("https://keymaster.example.com/api/v0/login", "user", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]string
+	if err := json.NewDecoder(req.Body).Decode(&fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["login"] != "user" || fields["pass"] != "secret" {
+		t.Fatalf("unexpected json body %v", fields)
+	}
+
+	loginBody = loginBodyBasic
+	req, err = buildLoginRequest("https://keymaster.example.com/api/v0/login", "user", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userName, password, ok := req.BasicAuth(); !ok || userName != "user" || password != "secret" {
+		t.Fatal("expected the credentials as basic auth")
+	}
+	if err := validateLoginBody("xml"); err == nil {
+		t.Fatal("should have failed on an unknown login body")
+	}
+}
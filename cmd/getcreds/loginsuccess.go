@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// loginSuccessConfig is the login_success setting, for servers answering
+// a failed login with a 200 status, such as {"status": "fail"}. Every set
+// criterion must hold for the login to succeed:
+//
+//	login_success:
+//	  status_code: 200
+//	  cookie: auth_cookie
+//	  json_field: status
+//	  json_value: ok
+//
+// The default is a 200 status with at least one cookie.
+type loginSuccessConfig struct {
+	StatusCode int    `yaml:"status_code"`
+	Cookie     string `yaml:"cookie"`
+	JSONField  string `yaml:"json_field"`
+	JSONValue  string `yaml:"json_value"`
+}
+
+func validateLoginSuccess(criteria loginSuccessConfig) error {
+	if criteria.StatusCode != 0 && (criteria.StatusCode < 200 || criteria.StatusCode > 299) {
+		return fmt.Errorf("login_success status_code %d is not a success status", criteria.StatusCode)
+	}
+	if len(criteria.JSONValue) > 0 && len(criteria.JSONField) < 1 {
+		return errors.New("login_success json_value needs a json_field")
+	}
+	return nil
+}
+
+// expectedStatusCode returns the status of a successful login.
+func (criteria loginSuccessConfig) expectedStatusCode() int {
+	if criteria.StatusCode == 0 {
+		return http.StatusOK
+	}
+	return criteria.StatusCode
+}
+
+// checkLoginSuccess applies the criteria other than the status code to a
+// login response and its body.
+func (criteria loginSuccessConfig) checkLoginSuccess(resp *http.Response, body []byte) error {
+	cookies := resp.Cookies()
+	if len(cookies) < 1 {
+		return errors.New("No cookies from login")
+	}
+	if len(criteria.Cookie) > 0 {
+		found := false
+		for _, cookie := range cookies {
+			if cookie.Name == criteria.Cookie {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("login response has no '%s' cookie", criteria.Cookie)
+		}
+	}
+	if len(criteria.JSONField) > 0 {
+		value, err := lookupJSONField(body, criteria.JSONField)
+		if err != nil {
+			return fmt.Errorf("login response %s", err)
+		}
+		if len(criteria.JSONValue) > 0 && fmt.Sprint(value) != criteria.JSONValue {
+			return fmt.Errorf("login failed, '%s' is '%v' instead of '%s'",
+				criteria.JSONField, value, criteria.JSONValue)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckLoginSuccess(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	http.SetCookie(recorder, &http.Cookie{Name: "auth_cookie", Value: "session"})
+	resp := recorder.Result()
+	criteria := loginSuccessConfig{Cookie: "auth_cookie", JSONField: "status", JSONValue: "ok"}
+	if err := criteria.checkLoginSuccess(resp, []byte(`{"status":"ok"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := criteria.checkLoginSuccess(resp, []byte(`{"status":"fail"}`)); err == nil {
+		t.Fatal("should have failed on a failed status")
+	}
+	criteria.Cookie = "other_cookie"
+	if err := criteria.checkLoginSuccess(resp, []byte(`{"status":"ok"}`)); err == nil {
+		t.Fatal("should have failed without the required cookie")
+	}
+	var defaults loginSuccessConfig
+	if err := defaults.checkLoginSuccess(httptest.NewRecorder().Result(), nil); err == nil {
+		t.Fatal("should have failed without any cookie")
+	}
+	if defaults.expectedStatusCode() != http.StatusOK {
+		t.Fatal("a 200 status should be expected by default")
+	}
+	if err := validateLoginSuccess(loginSuccessConfig{JSONValue: "ok"}); err == nil {
+		t.Fatal("should have refused a json_value without json_field")
+	}
+	if err := validateLoginSuccess(loginSuccessConfig{StatusCode: 401}); err == nil {
+		t.Fatal("should have refused a failure status code")
+	}
+}
@@ -1,12 +1,11 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha256"
-	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
@@ -21,21 +20,23 @@ import (
 	// server side:
 	"github.com/tstranex/u2f"
 
+	"github.com/Symantec/keymaster/lib/client"
 	"github.com/Symantec/keymaster/lib/webapi/v0/proto"
 
 	"github.com/howeyc/gopass"
+	"github.com/zalando/go-keyring"
 	"golang.org/x/crypto/ssh"
-	"gopkg.in/yaml.v2"
+	"golang.org/x/crypto/ssh/terminal"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -44,21 +45,90 @@ const DefaultKeysLocation = "/.ssh/"
 const RSAKeySize = 2048
 const FilePrefix = "keymaster"
 
-const ClientDataAuthenticationTypeValue = "navigator.id.getAssertion"
+// Name of the extra key files written with --also-ed25519.
+const ed25519FilePrefix = FilePrefix + "-ed25519"
 
-type baseConfig struct {
-	Gen_Cert_URLS string
-	//UserAuth          string
-}
+const ClientDataAuthenticationTypeValue = "navigator.id.getAssertion"
 
-type AppConfigFile struct {
-	Base baseConfig
-}
+// Exit code used when only some of the cert types could be obtained.
+const exitCodePartialSuccess = 3
 
 var (
-	Version        = "No version provided"
-	configFilename = flag.String("config", "config.yml", "The filename of the configuration")
-	debug          = flag.Bool("debug", false, "Enable debug messages to console")
+	Version               = "No version provided"
+	configFilename        = flag.String("config", "config.yml", "The filename of the configuration (default the one written by init in the user config dir when it exists)")
+	debug                 = flag.Bool("debug", false, "Enable debug messages to console")
+	useAgentKey           = flag.Bool("use-agent-key", false, "Use a key held by ssh-agent instead of generating one")
+	agentKeyMatch         = flag.String("agent-key", "", "Comment or SHA256 fingerprint of the agent key to use (default first key)")
+	retries               = flag.Int("retries", 0, "Number of times to retry getting the certs after a failure")
+	backoffName           = flag.String("backoff", "exponential", "Backoff strategy between retries: linear, exponential or constant")
+	backoffBase           = flag.Duration("backoff-base", time.Second, "Base delay for the retry backoff")
+	backoffCap            = flag.Duration("backoff-cap", 30*time.Second, "Maximum delay between retries (0 for the default of 5m)")
+	printPubKey           = flag.String("print-pubkey", "", "Print the public key as authorized_keys, pem, base64 or hex (DER)")
+	useKeyring            = flag.Bool("keyring", false, "Load and store the password in the OS native keyring")
+	keyringService        = flag.String("keyring-service", "keymaster", "Service name used for the keyring entry")
+	keyringAccount        = flag.String("keyring-account", "", "Account name used for the keyring entry (default username)")
+	sourceAddress         = flag.String("source-address", "", "Comma separated list of addresses/CIDRs the ssh cert should be restricted to")
+	allowPartial          = flag.Bool("allow-partial", false, "Write whichever certs were obtained when one of the cert types fails")
+	dnsResolver           = flag.String("resolver", "", "DNS server (ip[:port]) used to resolve the keymaster hostnames")
+	metricsFilename       = flag.String("metrics-file", "", "Write node_exporter textfile collector metrics to this file")
+	pubKeyFilename        = flag.String("pubkey-filename", "", "Filename sent with the public key in certgen requests (default the public key filename)")
+	validateOnly          = flag.String("validate-only", "", "Validate the ssh cert at this path and exit without contacting the server")
+	minValidity           = flag.Duration("min-validity", time.Hour, "Minimum remaining validity for --validate-only to consider a cert valid")
+	reuseKey              = flag.Bool("reuse-key", false, "Reuse the existing private key instead of generating a new one on every run")
+	keyMaxAge             = flag.Duration("key-max-age", 0, "With --reuse-key, regenerate the key when it is older than this (0 for no limit)")
+	cleanupOnFailure      = flag.Bool("cleanup-on-failure", false, "Remove a newly generated private key when no cert could be obtained for it")
+	hostCert              = flag.String("host-cert", "", "Comma separated list of hostnames to request an ssh host cert for instead of user certs")
+	hostKeyPath           = flag.String("host-key", "/etc/ssh/ssh_host_rsa_key.pub", "Host public key signed by --host-cert, the cert is written next to it")
+	disableSessionTickets = flag.Bool("disable-session-tickets", false, "Disable TLS session ticket resumption")
+	tlsRenegotiation      = flag.String("tls-renegotiation", "never", "TLS renegotiation allowed by the server: never, once or freely")
+	proxyProtocol         = flag.Bool("proxy-protocol", false, "Send a PROXY protocol v1 header on every connection to the servers")
+	includeHostname       = flag.Bool("include-hostname", false, "Send the hostname of this machine with the cert requests")
+	certContentTypes      = flag.String("cert-content-types", "text/plain,application/x-pem-file,application/octet-stream", "Comma separated list of Content-Types accepted for certgen responses")
+	multipartBoundary     = flag.String("multipart-boundary", "", "Fixed boundary for the multipart certgen requests (default random)")
+	explain               = flag.Bool("explain", false, "Log every decision taken (config, endpoints, auth, key and output files) before contacting the servers")
+	keygenCommand         = flag.String("keygen-command", "", "Command printing a PEM private key to use instead of generating the key in process (e.g. a FIPS module)")
+	sshSignatureAlgorithm = flag.String("ssh-signature-algorithm", "", "Signature algorithm requested for the ssh cert, e.g. rsa-sha2-512 (default server choice)")
+	printConfig           = flag.Bool("print-config", false, "Print the effective configuration with secrets redacted and exit")
+	lockTimeout           = flag.Duration("lock-timeout", time.Minute, "How long to wait for another running instance to finish (0 fails immediately, negative waits forever)")
+	rsaKeyBits            = flag.Int("key-bits", RSAKeySize, "Size in bits of the generated RSA key")
+	onExisting            = flag.String("on-existing", onExistingBackup, "What to do when the key or cert files already exist: skip, overwrite, backup or fail")
+	vaultPath             = flag.String("vault-path", "", "Also write the key and certs to this Vault KV path (e.g. secret/data/keymaster), using VAULT_ADDR and VAULT_TOKEN")
+	vaultKVVersion        = flag.Int("vault-kv-version", 2, "Version of the Vault KV secrets engine at --vault-path")
+	alsoEd25519           = flag.Bool("also-ed25519", false, "Also generate an Ed25519 key and get its certs with the same login, written to "+ed25519FilePrefix+"*")
+	sshKeyID              = flag.String("ssh-key-id", "", "Key id the server is asked to embed in the ssh cert, for auditing (default server choice)")
+	checkAuthKeys         = flag.Bool("check-authorized-keys", false, "Warn when the written public key is already in the authorized_keys next to it")
+	loginRetries          = flag.Int("login-retries", 0, "Number of times to retry a login failing on network or server errors")
+	certgenRetries        = flag.Int("certgen-retries", 0, "Number of times to retry a cert request failing on network or server errors (may issue several certs)")
+	fifoOut               = flag.String("fifo-out", "", "Write the private key and certs to this named pipe instead of files, so the key never hits the disk")
+	x509Format            = flag.String("x509-format", "pem", "Encoding of the written x509 cert: pem, der or base64")
+	resume                = flag.Bool("resume", false, "With --allow-partial, keep the certs of a partial run and only request the missing ones on the next run")
+	tlsClientCert         = flag.String("tls-client-cert", "", "PEM file with the TLS client cert presented to the servers")
+	tlsClientKey          = flag.String("tls-client-key", "", "PEM file with the key of --tls-client-cert (default the cert file)")
+	tlsClientKeyring      = flag.String("tls-client-keyring", "", "Keyring entry of --keyring-service holding the TLS client cert and key, see import-client-cert")
+	certDiff              = flag.Bool("cert-diff", false, "Log how the new ssh cert differs from the one it replaces (principals, options, extensions, lifetime)")
+	memoryOnly            = flag.Bool("memory-only", false, "Keep the key in memory and add it with its ssh cert to ssh-agent, writing nothing to disk")
+	policyFile            = flag.String("policy-file", "", "YAML file with rules (max_validity, required_principals, forbidden_extensions) the issued certs must follow, refusing to write them otherwise")
+	promptText            = flag.String("prompt", "", "Text shown when asking for the password, instead of the server hint or the default 'Password for <user>: '")
+	useRefreshToken       = flag.Bool("refresh-token", false, "Store the refresh token issued after 2FA in the keyring and use it to skip the password, login and 2FA while valid")
+	verifyHost            = flag.String("verify-host", "", "Log in to this user@host[:port] with the new ssh cert, without running anything, to check the cert is accepted")
+	forUser               = flag.String("for-user", "", "Request the certs on behalf of this user, if the server allows you to delegate, written to "+FilePrefix+"-for-<user>*")
+	keySuffix             = flag.String("key-suffix", "", "Suffix of the private key file name, such as _rsa or .key")
+	pubKeySuffix          = flag.String("pub-key-suffix", ".pub", "Suffix of the public key file name, replacing --key-suffix")
+	rejectSelfSigned      = flag.Bool("reject-self-signed", false, "Refuse servers presenting a self-signed TLS cert, even when trusted by the CAs")
+	receiptOut            = flag.String("receipt-out", "", "Write a JSON receipt of the latest issuance (endpoint, fingerprints, serials, validity) to this file")
+	ipVersion             = flag.String("ip-version", "any", "IP version used to reach the servers: any (both, racing them), 4 or 6")
+	ignoreInstructions    = flag.Bool("ignore-write-instructions", false, "Ignore the server instructions on the cert file names, modes and adding them to ssh-agent")
+	once                  = flag.Bool("once", false, "Exit right away, with code 9, when another run is already getting certs instead of waiting for it")
+	reuseKeyTypes         = flag.String("reuse-key-types", "rsa:2048,ecdsa:256,ed25519", "Key types, with their minimum bits, reused by --reuse-key, other keys get replaced")
+	mtlsOnly              = flag.Bool("mtls-only", false, "Authenticate with the TLS client cert alone, for service accounts, no password is asked")
+	mtlsUser              = flag.String("mtls-user", "", "User name with --mtls-only, the client cert common name by default")
+	ppkOut                = flag.String("ppk-out", "", "Also write the key and ssh cert as a PuTTY key file to this path, for PuTTY and pageant 0.78 or later")
+	listEndpointsOnly     = flag.Bool("list-endpoints", false, "Print the endpoints in the order they are tried and exit, without contacting them")
+	caFingerprint         = flag.String("ca-fingerprint", "", "Expected SHA256 fingerprint of the keymaster CA added by trust-host-ca")
+	onInterrupt           = flag.String("on-interrupt", onInterruptRollback, "What to do on SIGINT or SIGTERM before the certs are written: rollback the key and cert files or keep them")
+	dumpResponses         = flag.String("dump-responses", "", "Directory to write the raw server responses to for debugging, with the credentials redacted")
+	tempDir               = flag.String("temp-dir", "", "Directory for the temp files of atomic writes, next to the written files by default")
+	caFile                = flag.String("ca-file", "", "Comma separated list of PEM files or directories with the CAs trusted for the servers (default system CAs)")
 )
 
 func getUserHomeDir(usr *user.User) (string, error) {
@@ -68,125 +138,245 @@ func getUserHomeDir(usr *user.User) (string, error) {
 
 // generateKeyPair uses internal golang functions to be portable
 // mostly comes from: http://stackoverflow.com/questions/21151714/go-generate-an-ssh-public-key
-func genKeyPair(privateKeyPath string) (crypto.Signer, string, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+// random is rand.Reader, tests may pass a seeded source for fixed keys.
+func genKeyPair(privateKeyPath string, random io.Reader) (crypto.Signer, string, error) {
+	signer, pemKey, err := newKeyPair(random)
 	if err != nil {
 		return nil, "", err
 	}
+	return writeKeyPair(privateKeyPath, signer, pemKey)
+}
 
+// newKeyPair generates the key in memory, returning it with its PEM
+// encoding.
+func newKeyPair(random io.Reader) (crypto.Signer, []byte, error) {
+	if len(*keygenCommand) > 0 {
+		return runKeygenCommand(*keygenCommand)
+	}
+	warnLowEntropy()
+	stopSpinner := startKeygenSpinner(*rsaKeyBits)
+	defer stopSpinner()
+	return newRSAKeyPair(random)
+}
+
+// newRSAKeyPair generates the --key-bits RSA key from random, see
+// client.NewRSAKeyPair.
+func newRSAKeyPair(random io.Reader) (crypto.Signer, []byte, error) {
+	return client.NewRSAKeyPair(random, *rsaKeyBits)
+}
+
+// writeKeyPair writes the private key and its ssh public key, returning
+// the path of the latter.
+func writeKeyPair(privateKeyPath string, signer crypto.Signer, pemKey []byte) (crypto.Signer, string, error) {
 	// privateKeyPath := BasePath + prefix
-	pubKeyPath := privateKeyPath + ".pub"
+	pubKeyPath := publicKeyPath(privateKeyPath)
 
-	err = ioutil.WriteFile(
-		privateKeyPath,
-		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}),
-		0600)
+	err := writeFileAtomic(privateKeyPath, pemKey, 0600, ".keymaster-key-")
 	if err != nil {
 		log.Printf("Failed to save privkey")
 		return nil, "", err
 	}
 
-	// generate and write public key
-	pub, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	pub, err := writePublicKey(pubKeyPath, signer.Public())
 	if err != nil {
 		return nil, "", err
 	}
-	return privateKey, pubKeyPath, ioutil.WriteFile(pubKeyPath, ssh.MarshalAuthorizedKey(pub), 0644)
-}
-func loadVerifyConfigFile(configFilename string) (AppConfigFile, error) {
-	var config AppConfigFile
-	if _, err := os.Stat(configFilename); os.IsNotExist(err) {
-		err = errors.New("mising config file failure")
-		return config, err
+	if *checkAuthKeys {
+		checkAuthorizedKeys(privateKeyPath, pub)
 	}
-	source, err := ioutil.ReadFile(configFilename)
+	return signer, pubKeyPath, nil
+}
+
+// writePublicKey writes pub in the authorized_keys format to pubKeyPath.
+func writePublicKey(pubKeyPath string, pub crypto.PublicKey) (ssh.PublicKey, error) {
+	sshPub, err := ssh.NewPublicKey(pub)
 	if err != nil {
-		err = errors.New("cannot read config file")
-		return config, err
+		return nil, err
 	}
-	err = yaml.Unmarshal(source, &config)
+	err = writeFileAtomic(pubKeyPath, ssh.MarshalAuthorizedKey(sshPub), 0644, ".keymaster-key-")
 	if err != nil {
-		err = errors.New("Cannot parse config file")
-		return config, err
-	}
-
-	if len(config.Base.Gen_Cert_URLS) < 1 {
-		err = errors.New("Invalid Config file... no place get the certs")
-		return config, err
+		return nil, err
 	}
-	// TODO: ensure all enpoints are https urls
-
-	return config, nil
+	return sshPub, nil
 }
 
-// This is now copy-paste from the server test side... probably make public and reuse.
-func createKeyBodyRequest(method, urlStr, filedata string) (*http.Request, error) {
-	//create attachment....
+// buildMultipartKeyRequest builds a multipart/form-data request carrying
+// data as the file upload fieldName. Authentication is left to the caller.
+// The body is buffered so that it is sent with a Content-Length instead of
+// chunked, and uses the --multipart-boundary when given. fields are sent as
+// plain form fields ahead of the file.
+func buildMultipartKeyRequest(method, urlStr string, fields url.Values, fieldName, filename string, data io.Reader) (*http.Request, error) {
 	bodyBuf := &bytes.Buffer{}
 	bodyWriter := multipart.NewWriter(bodyBuf)
+	if len(*multipartBoundary) > 0 {
+		if err := bodyWriter.SetBoundary(*multipartBoundary); err != nil {
+			return nil, fmt.Errorf("invalid multipart boundary: %s", err)
+		}
+	}
 
-	//
-	fileWriter, err := bodyWriter.CreateFormFile("pubkeyfile", "somefilename.pub")
+	for _, key := range sortedKeys(fields) {
+		for _, value := range fields[key] {
+			if err := bodyWriter.WriteField(key, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	fileWriter, err := bodyWriter.CreateFormFile(fieldName, filename)
 	if err != nil {
-		fmt.Println("error writing to buffer")
 		return nil, err
 	}
-	// When using a file this used to be: fh, err := os.Open(pubKeyFilename)
-	fh := strings.NewReader(filedata)
-
-	_, err = io.Copy(fileWriter, fh)
+	_, err = io.Copy(fileWriter, data)
+	if err != nil {
+		return nil, err
+	}
+	err = bodyWriter.Close()
 	if err != nil {
 		return nil, err
 	}
-
-	contentType := bodyWriter.FormDataContentType()
-	bodyWriter.Close()
 
 	req, err := http.NewRequest(method, urlStr, bodyBuf)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", contentType)
+	req.ContentLength = int64(bodyBuf.Len())
+	req.Header.Set("Content-Type", bodyWriter.FormDataContentType())
 
 	return req, nil
 }
 
-func doCertRequest(client *http.Client, authCookies []*http.Cookie, url, filedata string) ([]byte, error) {
+// Usernames longer than this would build certgen urls beyond what servers
+// and proxies commonly accept, the username being part of the path.
+const maxUserNameLength = 256
 
-	req, err := createKeyBodyRequest("POST", url, filedata)
-	if err != nil {
-		return nil, err
+func validateUserName(userName string) error {
+	if len(userName) < 1 {
+		return errors.New("empty username")
 	}
-	// Add the login cookies
-	for _, cookie := range authCookies {
-		req.AddCookie(cookie)
+	if escaped := url.PathEscape(userName); len(escaped) > maxUserNameLength {
+		return fmt.Errorf("username is %d characters long once escaped, longer than the %d supported in certgen urls",
+			len(escaped), maxUserNameLength)
 	}
+	return nil
+}
+
+func certgenURL(baseUrl string, userName string, certType string, params url.Values) string {
+	query := url.Values{}
+	for key, values := range params {
+		query[key] = values
+	}
+	query.Set("type", certType)
+	return baseUrl + "/certgen/" + url.PathEscape(userName) + "?" + query.Encode()
+}
+
+// pubKeyUploadFilename is the filename sent along with the public key in
+// certgen requests, which is the name of the public key file we write.
+func pubKeyUploadFilename() string {
+	if len(*pubKeyFilename) > 0 {
+		return *pubKeyFilename
+	}
+	return FilePrefix + *pubKeySuffix
+}
+
+// doCertRequest requests a cert, retrying up to --certgen-retries times.
+// Those retries are off by default as every request may issue a cert on
+// servers ignoring the idempotency key.
+func doCertRequest(client *http.Client, url, certType, filedata string) ([]byte, error) {
+	cert, _, err := doInstructedCertRequest(client, url, certType, filedata)
+	return cert, err
+}
+
+// doInstructedCertRequest is doCertRequest also returning how the server
+// asked the cert to be stored.
+func doInstructedCertRequest(client *http.Client, url, certType, filedata string) ([]byte, writeInstructions, error) {
+	var cert []byte
+	var instructions writeInstructions
+	key := idempotencyKey(url, filedata)
+	err := retryStep("certgen", *certgenRetries, func() error {
+		var err error
+		cert, instructions, err = doCertRequestOnce(client, url, certType, filedata, key)
+		return err
+	})
+	return cert, instructions, err
+}
+
+func doCertRequestOnce(client *http.Client, url, certType, filedata, idempotencyKey string) ([]byte, writeInstructions, error) {
+	var instructions writeInstructions
+	req, err := buildMultipartKeyRequest(certgenMethod, url, attributeFields(), "pubkeyfile", pubKeyUploadFilename(),
+		strings.NewReader(filedata))
+	if err != nil {
+		return nil, instructions, err
+	}
+	req.Header.Set(idempotencyKeyHeader, idempotencyKey)
+	// The login cookies are added by the client cookie jar
 	resp, err := client.Do(req) // Client.Get(targetUrl)
 	if err != nil {
 		log.Printf("Failure to do x509 req %s", err)
-		return nil, err
+		return nil, instructions, err
 	}
 
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
+		body := readErrorBody(resp)
+		if err := checkMaintenance(resp, body); err != nil {
+			return nil, instructions, err
+		}
 		log.Printf("got error from call %s, url='%s'\n", resp.Status, url)
-		return nil, err
+		err = newStatusError("certgen", resp, body)
+		return nil, instructions, err
 	}
-	return ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, instructions, err
+	}
+	instructions, err = parseWriteInstructions(resp.Header, certType)
+	if err != nil {
+		return nil, instructions, err
+	}
+	if field, ok := certResponseFields[certType]; ok {
+		cert, err := extractJSONCert(body, field)
+		return cert, instructions, err
+	}
+	if err := checkCertContentType(resp.Header.Get("Content-Type"), body); err != nil {
+		log.Printf("unexpected certgen response from url='%s'", url)
+		return nil, instructions, err
+	}
+	return body, instructions, nil
 
 }
 
-func doU2FAuthenticate(client *http.Client, authCookies []*http.Cookie, baseURL string) error {
+const maxBodyPreview = 200
+
+// checkCertContentType rejects certgen responses whose Content-Type is not
+// one of --cert-content-types, such as an HTML error page served with a
+// 200 status, so that they are never written as a cert.
+func checkCertContentType(contentType string, body []byte) error {
+	if len(contentType) < 1 {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("invalid certgen response Content-Type '%s': %s", contentType, err)
+	}
+	for _, accepted := range strings.Split(*certContentTypes, ",") {
+		if strings.EqualFold(mediaType, strings.TrimSpace(accepted)) {
+			return nil
+		}
+	}
+	preview := body
+	if len(preview) > maxBodyPreview {
+		preview = preview[:maxBodyPreview]
+	}
+	return fmt.Errorf("unexpected certgen response Content-Type '%s', body starts with %q",
+		mediaType, preview)
+}
+
+func doU2FAuthenticate(client *http.Client, userName string, baseURL string) error {
 	log.Printf("top of doU2fAuthenticate")
 	url := baseURL + "/u2f/SignRequest"
 	signRequest, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
-	// Add the login cookies
-	for _, cookie := range authCookies {
-		signRequest.AddCookie(cookie)
-	}
 	signRequestResp, err := client.Do(signRequest) // Client.Get(targetUrl)
 	if err != nil {
 		log.Printf("Failure to sign request req %s", err)
@@ -309,10 +499,6 @@ func doU2FAuthenticate(client *http.Client, authCookies []*http.Cookie, baseURL
 
 	url = baseURL + "/u2f/SignResponse"
 	webSignRequest2, err := http.NewRequest("POST", url, webSignRequestBuf)
-	// Add the login cookies
-	for _, cookie := range authCookies {
-		webSignRequest2.AddCookie(cookie)
-	}
 	signRequestResp2, err := client.Do(webSignRequest2) // Client.Get(targetUrl)
 	if err != nil {
 		log.Printf("Failure to sign request req %s", err)
@@ -324,6 +510,11 @@ func doU2FAuthenticate(client *http.Client, authCookies []*http.Cookie, baseURL
 		log.Printf("got error from call %s, url='%s'\n", signRequestResp2.Status, url)
 		return err
 	}
+	if *useRefreshToken {
+		if err := saveRefreshToken(userName, baseURL, signRequestResp2.Header); err != nil {
+			log.Printf("cannot store the refresh token: %s", err)
+		}
+	}
 
 	return nil
 }
@@ -341,64 +532,50 @@ func getParseURLEnvVariable(name string) (*url.URL, error) {
 	return envUrl, nil
 }
 
-func getCertsFromServer(signer crypto.Signer, userName string, password []byte, baseUrl string, tlsConfig *tls.Config, skipu2f bool) (sshCert []byte, x509Cert []byte, err error) {
+// loginToServer authenticates userName against baseUrl, upgrading to u2f
+// when the server requires it. The auth cookies end up in the client jar.
+func loginToServer(client *http.Client, userName string, password []byte, baseUrl string, skipu2f bool) error {
 	//First Do Login
-
-	clientTransport := &http.Transport{
-		TLSClientConfig: tlsConfig,
-	}
-
-	// proxy env variables in ascending order of preference, lower case 'http_proxy' dominates
-	// just like curl
-	proxyEnvVariables := []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy"}
-	for _, proxyVar := range proxyEnvVariables {
-		httpProxy, err := getParseURLEnvVariable(proxyVar)
-		if err == nil && httpProxy != nil {
-			clientTransport.Proxy = http.ProxyURL(httpProxy)
-		}
-	}
-
-	// TODO: change timeout const for a flag
-	client := &http.Client{Transport: clientTransport, Timeout: 5 * time.Second}
-
 	loginUrl := baseUrl + proto.LoginPath
-	form := url.Values{}
-	form.Add("username", userName)
-	form.Add("password", string(password[:]))
-	req, err := http.NewRequest("POST", loginUrl, strings.NewReader(form.Encode()))
+	req, err := buildLoginRequest(loginUrl, userName, password)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-	req.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Add("Accept", "application/json")
 
 	loginResp, err := client.Do(req) //client.Get(targetUrl)
 	if err != nil {
+		err = describeTLSError(err)
 		log.Printf("got error from req")
 		log.Println(err)
 		// TODO: differentiate between 400 and 500 errors
 		// is OK to fail.. try next
-		return nil, nil, err
+		return err
 	}
 	defer loginResp.Body.Close()
-	if loginResp.StatusCode != 200 {
+	if loginResp.StatusCode != loginSuccess.expectedStatusCode() {
+		body := readErrorBody(loginResp)
+		if err := checkMaintenance(loginResp, body); err != nil {
+			return err
+		}
 		log.Printf("got error from login call %s", loginResp.Status)
-		return nil, nil, err
+		err = newStatusError("login", loginResp, body)
+		return err
 	}
-	//Enusre we have at least one cookie
-	if len(loginResp.Cookies()) < 1 {
-		err = errors.New("No cookies from login")
-		return nil, nil, err
+	// reading it all also drains the body so that we can reuse the channel
+	body, err := ioutil.ReadAll(loginResp.Body)
+	if err != nil {
+		return err
+	}
+	loginResp.Body.Close()
+	if err := loginSuccess.checkLoginSuccess(loginResp, body); err != nil {
+		return err
 	}
 
 	loginJSONResponse := proto.LoginResponse{}
-	//body := jsonrr.Result().Body
-	err = json.NewDecoder(loginResp.Body).Decode(&loginJSONResponse)
+	err = json.Unmarshal(body, &loginJSONResponse)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-	loginResp.Body.Close() //so that we can reuse the channel
 
 	for _, backend := range loginJSONResponse.CertAuthBackend {
 		if backend == proto.AuthTypePassword {
@@ -407,100 +584,670 @@ func getCertsFromServer(signer crypto.Signer, userName string, password []byte,
 	}
 	// upgrade to u2f
 	if !skipu2f {
-		err = doU2FAuthenticate(client, loginResp.Cookies(), baseUrl)
+		err = doU2FAuthenticate(client, userName, baseUrl)
 		if err != nil {
 
-			return nil, nil, err
+			return err
 		}
 	}
-	//now get x509 cert
-	pubKey := signer.Public()
-	derKey, err := x509.MarshalPKIXPublicKey(pubKey)
+	return nil
+}
+
+// x509PublicKeyPEM encodes pub as the PEM PUBLIC KEY expected by the x509
+// certgen endpoint.
+func x509PublicKeyPEM(pub crypto.PublicKey) (string, error) {
+	derKey, err := x509.MarshalPKIXPublicKey(pub)
 	if err != nil {
+		return "", fmt.Errorf("cannot use %T key for an x509 cert: %s", pub, err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: derKey})), nil
+}
+
+func getCertsFromServer(signer crypto.Signer, userName string, password []byte, baseUrl string, client *http.Client, skipu2f bool) (sshCert []byte, x509Cert []byte, err error) {
+	materials, err := getCertsForKeysFromServer([]crypto.Signer{signer}, userName, knownPassword(password), baseUrl, client, skipu2f)
+	if materials == nil {
 		return nil, nil, err
 	}
-	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: derKey}))
+	return materials[0].SSHCert, materials[0].X509Cert, err
+}
+
+// getCertsForKeysFromServer logs in once and then gets the certs of every
+// key with that session, so that --also-ed25519 needs no second login.
+// The materials are in the same order as signers.
+func getCertsForKeysFromServer(signers []crypto.Signer, userName string, password *lazyPassword, baseUrl string, client *http.Client, skipu2f bool) ([]certMaterial, error) {
+	client, tracker := withConnTracker(client)
+	defer checkConnReuse(tracker, baseUrl)
+	checkServerVersion(client, baseUrl)
 
-	// TODO: urlencode the userName
-	x509Cert, err = doCertRequest(client, loginResp.Cookies(), baseUrl+"/certgen/"+userName+"?type=x509", pemKey)
+	err := loginOrRefresh(client, userName, password, baseUrl, skipu2f)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	requestParams := url.Values{}
+	certUserName := userName
+	if len(*forUser) > 0 {
+		certUserName = *forUser
+		requestParams.Set(proto.DelegatedByParam, userName)
+	}
+	if *includeHostname {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		requestParams.Set("client_hostname", hostname)
 	}
 
-	//// Now we do sshCert!
+	failures := make(map[string]error)
+	materials := make([]certMaterial, 0, len(signers))
+	for _, signer := range signers {
+		material, err := getCertsForKey(client, signer.Public(), certUserName, baseUrl,
+			requestParams, len(signers) > 1, failures)
+		if err != nil {
+			return nil, err
+		}
+		material.Endpoint = baseUrl
+		material.TLSVersion, material.TLSCipherSuite = tracker.negotiatedTLS()
+		materials = append(materials, material)
+	}
+	switch len(failures) {
+	case 0:
+		return materials, nil
+	case 2 * len(signers):
+		return nil, errors.New("failed to get any certs")
+	}
+	return materials, &partialCertsError{failures: failures}
+}
+
+// getCertsForKey requests the x509 and ssh certs for pubKey with an already
+// logged in client. With --allow-partial the failed cert types are recorded
+// in failures, named after the key type when labelKeyType is set.
+func getCertsForKey(client *http.Client, pubKey crypto.PublicKey, userName string, baseUrl string, requestParams url.Values, labelKeyType bool, failures map[string]error) (certMaterial, error) {
+	var material certMaterial
 	// generate and write public key
 	sshPub, err := ssh.NewPublicKey(pubKey)
 	if err != nil {
-		return nil, nil, err
+		return material, err
+	}
+	failureName := func(certType string) string {
+		if labelKeyType {
+			return sshPub.Type() + " " + certType
+		}
+		return certType
+	}
+
+	//now get x509 cert
+	// Only the public key is needed, so this also works for agent held keys
+	if cert := resumeCerts.lookup("x509", sshPub, time.Now()); cert != nil {
+		log.Printf("reusing the x509 cert of the previous partial run")
+		material.X509Cert = cert
+	} else {
+		pemKey, err := x509PublicKeyPEM(pubKey)
+		if err == nil {
+			material.X509Cert, material.X509Instructions, err = doInstructedCertRequest(client,
+				certgenURL(baseUrl, userName, "x509", requestParams), "x509", pemKey)
+		}
+		if err != nil {
+			if !*allowPartial {
+				return material, err
+			}
+			failures[failureName("x509")] = err
+		}
+	}
+
+	//// Now we do sshCert!
+	if cert := resumeCerts.lookup("ssh", sshPub, time.Now()); cert != nil {
+		log.Printf("reusing the ssh cert of the previous partial run")
+		material.SSHCert = cert
+		return material, nil
 	}
 	sshAuthFile := string(ssh.MarshalAuthorizedKey(sshPub))
-	sshCert, err = doCertRequest(client, loginResp.Cookies(), baseUrl+"/certgen/"+userName+"?type=ssh", sshAuthFile)
+	sshParams := url.Values{}
+	for key, values := range requestParams {
+		sshParams[key] = values
+	}
+	if len(*sourceAddress) > 0 {
+		sshParams.Set("source_address", *sourceAddress)
+	}
+	if len(*sshSignatureAlgorithm) > 0 {
+		sshParams.Set("signature_algorithm", *sshSignatureAlgorithm)
+	}
+	if len(*sshKeyID) > 0 {
+		sshParams.Set("key_id", *sshKeyID)
+	}
+	material.SSHCert, material.SSHInstructions, err = doInstructedCertRequest(client,
+		certgenURL(baseUrl, userName, "ssh", sshParams), "ssh", sshAuthFile)
 	if err != nil {
-		return nil, nil, err
+		if !*allowPartial {
+			return material, err
+		}
+		failures[failureName("ssh")] = err
 	}
+	return material, nil
+}
 
-	return sshCert, x509Cert, nil
+// partialCertsError is returned when only some of the cert types could be
+// obtained, failures is keyed by cert type.
+type partialCertsError struct {
+	failures map[string]error
+}
+
+func (e *partialCertsError) Error() string {
+	var messages []string
+	for certType, err := range e.failures {
+		messages = append(messages, fmt.Sprintf("failed to get %s cert: %s", certType, err))
+	}
+	return strings.Join(messages, ", ")
 }
 
 func getCertFromTargetUrls(signer crypto.Signer, userName string, password []byte, targetUrls []string, rootCAs *x509.CertPool, skipu2f bool) (sshCert []byte, x509Cert []byte, err error) {
-	success := false
-	tlsConfig := &tls.Config{RootCAs: rootCAs, MinVersion: tls.VersionTLS12}
+	endpoints := make([]endpointConfig, 0, len(targetUrls))
+	for _, targetUrl := range targetUrls {
+		endpoints = append(endpoints, endpointConfig{URL: targetUrl})
+	}
+	return getCertFromEndpoints(signer, userName, password, endpoints, rootCAs, skipu2f)
+}
 
-	for _, baseUrl := range targetUrls {
+// getCertFromEndpoints tries the endpoints in order. Endpoints with TLS
+// overrides get their own client, the others share one built from rootCAs.
+func getCertFromEndpoints(signer crypto.Signer, userName string, password []byte, endpoints []endpointConfig, rootCAs *x509.CertPool, skipu2f bool) (sshCert []byte, x509Cert []byte, err error) {
+	materials, err := getCertsForKeysFromEndpoints([]crypto.Signer{signer}, userName, knownPassword(password), endpoints, rootCAs, skipu2f)
+	if materials == nil {
+		return nil, nil, err
+	}
+	return materials[0].SSHCert, materials[0].X509Cert, err
+}
+
+// resolveOrderedEndpoints returns the endpoints of config, with the ones of
+// its SRV record, in the order they are tried.
+func resolveOrderedEndpoints(config AppConfigFile) ([]endpointConfig, error) {
+	configEndpoints, err := resolveEndpoints(config, lookupSRV)
+	if err != nil {
+		return nil, err
+	}
+	return orderEndpoints(configEndpoints, config.Base.RandomizeEqualWeights), nil
+}
+
+// caFileRootCAs returns the CAs of --ca-file, nil for the system CAs.
+func caFileRootCAs() (*x509.CertPool, error) {
+	if len(*caFile) < 1 {
+		return nil, nil
+	}
+	return loadRootCAs(*caFile)
+}
+
+// endpointClient returns the client for endpoint: defaultClient, or a
+// client of its own for the endpoints with TLS overrides.
+func endpointClient(endpoint endpointConfig, defaultClient *http.Client, rootCAs *x509.CertPool) (*http.Client, error) {
+	if !endpoint.hasTLSOverrides() {
+		return defaultClient, nil
+	}
+	return newEndpointHTTPClient(endpoint, rootCAs)
+}
+
+// getCertsForKeysFromEndpoints is getCertFromEndpoints for several keys,
+// all of them signed by the same server.
+func getCertsForKeysFromEndpoints(signers []crypto.Signer, userName string, password *lazyPassword, endpoints []endpointConfig, rootCAs *x509.CertPool, skipu2f bool) ([]certMaterial, error) {
+	tlsConfig, err := newTLSConfig(rootCAs)
+	if err != nil {
+		return nil, err
+	}
+	defaultClient, err := newHTTPClient(tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// The first partial result is kept in case no server can issue all.
+	var partialErr *partialCertsError
+	var partialMaterials []certMaterial
+	// Only reported when every server failed because of maintenance.
+	var maintenanceErr *maintenanceError
+	maintenanceOnly := true
+	// The reported failure, a rejection winning over a network error so
+	// that a bad password is not retried.
+	var failure error
+	for _, endpoint := range endpoints {
+		baseUrl := endpoint.URL
+		client, err := endpointClient(endpoint, defaultClient, rootCAs)
+		if err != nil {
+			log.Printf("cannot setup TLS for '%s': %s", baseUrl, err)
+			maintenanceOnly = false
+			if failure == nil || !isRetryableStepError(err) {
+				failure = err
+			}
+			continue
+		}
 		log.Printf("attempting to target '%s' for '%s'\n", baseUrl, userName)
-		sshCert, x509Cert, err = getCertsFromServer(signer, userName, password, baseUrl, tlsConfig, skipu2f)
+		materials, err := getCertsForKeysFromServer(signers, userName, password, baseUrl, client, skipu2f)
+		if e, ok := err.(*partialCertsError); ok {
+			log.Println(err)
+			if partialErr == nil {
+				partialErr, partialMaterials = e, materials
+			}
+			continue
+		}
+		if e, ok := err.(*maintenanceError); ok {
+			log.Println(err)
+			if maintenanceErr == nil {
+				maintenanceErr = e
+			}
+			continue
+		}
 		if err != nil {
 			log.Println(err)
+			maintenanceOnly = false
+			if failure == nil || !isRetryableStepError(err) {
+				failure = err
+			}
 			continue
 		}
-		success = true
-		break
+		return materials, nil
+	}
+	if partialErr != nil {
+		return partialMaterials, partialErr
+	}
+	if maintenanceErr != nil && maintenanceOnly {
+		return nil, maintenanceErr
+	}
+	log.Printf("failed to get creds")
+	if failure != nil {
+		return nil, fmt.Errorf("Failed to get creds: %w", failure)
+	}
+	return nil, errors.New("Failed to get creds")
+}
+
+// newKey is a key generated for a run, only written with its certs. A nil
+// pem means the key is already stored.
+type newKey struct {
+	path   string
+	signer crypto.Signer
+	pem    []byte
+	// Set for the keys held by ssh-agent, of which only the public key
+	// is written.
+	pubOnly bool
+}
 
+func (key newKey) write() error {
+	if key.pubOnly {
+		_, err := writePublicKey(publicKeyPath(key.path), key.signer.Public())
+		return err
+	}
+	if key.pem == nil {
+		return nil
 	}
-	if !success {
-		log.Printf("failed to get creds")
-		err := errors.New("Failed to get creds")
+	_, _, err := writeKeyPair(key.path, key.signer, key.pem)
+	return err
+}
+
+// writeNewKeysAndCerts is the commit step of a run, writing the new keys
+// and persisting the certs, with the ones of the --also-ed25519 key when
+// ed25519Key is set.
+func writeNewKeysAndCerts(persist persistFunc, materials []certMaterial, key newKey, ed25519Key *newKey) error {
+	if err := key.write(); err != nil {
+		return err
+	}
+	if err := persist(materials[0]); err != nil {
+		return err
+	}
+	if ed25519Key == nil {
+		return nil
+	}
+	if err := ed25519Key.write(); err != nil {
+		return err
+	}
+	return filePersister(ed25519Key.path)(materials[1])
+}
+
+// getRunUserAndCreds returns the user the certs are requested for with its
+// password: the user of the TLS client cert with --mtls-only, which needs
+// no password, else the current user, named as the username of the config
+// when there is one. With --refresh-token the password is
+// only read when no stored token gets a session.
+func getRunUserAndCreds(endpoints []endpointConfig, rootCAs *x509.CertPool) (*user.User, *lazyPassword, error) {
+	if *mtlsOnly {
+		usr, err := getMTLSUserInfo()
+		return usr, knownPassword(nil), err
+	}
+	usr, err := user.Current()
+	if err != nil {
+		log.Printf("cannot get current user info")
 		return nil, nil, err
 	}
+	if len(configUsername) > 0 {
+		named := *usr
+		named.Username = configUsername
+		usr = &named
+	}
+	password := &lazyPassword{read: func() ([]byte, error) {
+		return readPassword(usr.Username, func(userName string) string {
+			return passwordPrompt(userName, endpoints, rootCAs)
+		})
+	}}
+	if !*useRefreshToken {
+		if _, err := password.get(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return usr, password, nil
+}
 
-	return sshCert, x509Cert, nil
+// rememberPassword stores a password that worked in the keyring with
+// --keyring. There is none to store when a refresh token was used.
+func rememberPassword(userName string, password []byte) {
+	if !*useKeyring || password == nil {
+		return
+	}
+	if err := storePasswordInKeyring(userName, password); err != nil {
+		log.Printf("cannot store password in keyring: %s", err)
+	}
 }
 
-func getUserInfoAndCreds() (usr *user.User, password []byte, err error) {
+// getUserInfoAndCreds reads the password, prompt returning the text shown
+// when it has to be typed.
+func getUserInfoAndCreds(prompt func(userName string) string) (usr *user.User, password []byte, err error) {
 	usr, err = user.Current()
 	if err != nil {
 		log.Printf("cannot get current user info")
 		return nil, nil, err
 	}
-	userName := usr.Username
-
-	fmt.Printf("Password for %s: ", userName)
-	password, err = gopass.GetPasswd()
+	password, err = readPassword(usr.Username, prompt)
 	if err != nil {
 		return nil, nil, err
-		// Handle gopass.ErrInterrupted or getch() read error
 	}
 	return usr, password, nil
 }
 
+// readPassword reads the password of userName from the keyring with
+// --keyring, else from stdin or the terminal.
+func readPassword(userName string, prompt func(userName string) string) ([]byte, error) {
+	if *useKeyring {
+		password, err := getPasswordFromKeyring(userName)
+		if err == nil {
+			return password, nil
+		}
+		if err != keyring.ErrNotFound {
+			log.Printf("cannot read password from keyring: %s", err)
+		}
+	}
+
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return readPasswordFromStdin()
+	}
+	fmt.Print(prompt(userName))
+	// Fails on gopass.ErrInterrupted or getch() read errors
+	return gopass.GetPasswd()
+}
+
+// readPasswordFromStdin reads the password from stdin when it is a pipe
+// or a redirected file instead of a terminal, so that
+// `echo pass | getcreds` works. The secure prompt is used on terminals.
+func readPasswordFromStdin() ([]byte, error) {
+	fileInfo, err := os.Stdin.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fileInfo.Mode()&os.ModeNamedPipe == 0 && !fileInfo.Mode().IsRegular() {
+		return nil, errors.New("no terminal to prompt for the password and stdin is not a pipe")
+	}
+	return readPasswordLine(os.Stdin)
+}
+
+// readPasswordLine returns the first line of reader without its line end.
+func readPasswordLine(reader io.Reader) ([]byte, error) {
+	line, err := bufio.NewReader(reader).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	password := bytes.TrimRight(line, "\r\n")
+	if len(password) < 1 {
+		return nil, errors.New("empty password read from stdin")
+	}
+	return password, nil
+}
+
 func Usage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s (version %s):\n", os.Args[0], Version)
+	fmt.Fprintf(os.Stderr, "  %s [flags] [command]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	fmt.Fprintf(os.Stderr, "  sign-challenge <challenge>\tsign the challenge with the current key\n")
+	fmt.Fprintf(os.Stderr, "  init [config file]\tprompt for the servers and write a new config file, by default in the user config dir\n")
+	fmt.Fprintf(os.Stderr, "  validate-config [config file]\tcheck the config file and report every problem found\n")
+	fmt.Fprintf(os.Stderr, "  trust-host-ca [host pattern]\ttrust host certs signed by keymaster in ~/.ssh/known_hosts\n")
+	fmt.Fprintf(os.Stderr, "  import-client-cert <pem file>\tstore the TLS client cert and key in the keyring for --tls-client-keyring\n")
+	fmt.Fprintf(os.Stderr, "  provision-users <output dir> <user>...\tas a delegation admin, get a new key and certs for each user\n")
+	fmt.Fprintf(os.Stderr, "Flags:\n")
 	flag.PrintDefaults()
 }
 
+func getDefaultPrivateKeyPath() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	homeDir, err := getUserHomeDir(usr)
+	if err != nil {
+		return "", err
+	}
+	return keyFilePath(filepath.Join(homeDir, DefaultKeysLocation), FilePrefix), nil
+}
+
 func main() {
+	flag.Var(&identityAttributes, "attr", "Extra key=value attribute sent with the cert requests, can be repeated")
 	flag.Usage = Usage
 	flag.Parse()
+	resolveConfigFilename()
+
+	switch flag.Arg(0) {
+	case "":
+	case "sign-challenge":
+		privateKeyPath, err := getDefaultPrivateKeyPath()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := signChallengeCommand(flag.Args()[1:], privateKeyPath); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "trust-host-ca":
+		privateKeyPath, err := getDefaultPrivateKeyPath()
+		if err != nil {
+			log.Fatal(err)
+		}
+		knownHostsPath := filepath.Join(filepath.Dir(privateKeyPath), "known_hosts")
+		if err := trustHostCACommand(flag.Args()[1:], knownHostsPath); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "import-client-cert":
+		if err := importClientCertCommand(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "provision-users":
+		if err := provisionUsersCommand(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "init":
+		if err := initConfigCommand(flag.Args()[1:], os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "validate-config":
+		os.Exit(validateConfigCommand(flag.Args()[1:], os.Stdout))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if len(*validateOnly) > 0 {
+		exitCode, err := validateCertFile(*validateOnly, *minValidity)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(exitCode)
+	}
 
 	config, err := loadVerifyConfigFile(*configFilename)
 	if err != nil {
 		panic(err)
 	}
-	usr, password, err := getUserInfoAndCreds()
+	setRequestMethods(config)
+	setUserPreferences(config)
+	if *listEndpointsOnly {
+		err := listEndpoints(os.Stdout,
+			orderEndpoints(getEndpoints(config), config.Base.RandomizeEqualWeights),
+			config.Base.RandomizeEqualWeights, config.Base.SRVRecord)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	endpoints, err := resolveOrderedEndpoints(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	targetUrls := getEndpointURLs(endpoints)
+	backoff, err := newBackoff(*backoffName, *backoffBase, *backoffCap)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(*sourceAddress) > 0 {
+		if err := validateSourceAddress(*sourceAddress); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := validateOnExisting(*onExisting); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateOnInterrupt(*onInterrupt); err != nil {
+		log.Fatal(err)
+	}
+	if len(*tempDir) > 0 {
+		if fileInfo, err := os.Stat(*tempDir); err != nil || !fileInfo.IsDir() {
+			log.Fatalf("--temp-dir %s is not a directory", *tempDir)
+		}
+	}
+	if len(*dumpResponses) > 0 {
+		if fileInfo, err := os.Stat(*dumpResponses); err != nil || !fileInfo.IsDir() {
+			log.Fatalf("--dump-responses %s is not a directory", *dumpResponses)
+		}
+	}
+	if len(*verifyHost) > 0 {
+		if _, _, err := parseVerifyHost(*verifyHost); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(*forUser) > 0 {
+		if err := validateForUser(*forUser); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := validateKeySuffixes(*keySuffix, *pubKeySuffix); err != nil {
+		log.Fatal(err)
+	}
+	var policy *certPolicy
+	if len(*policyFile) > 0 {
+		policy, err = loadCertPolicy(*policyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *rsaKeyBits < RSAKeySize {
+		log.Fatalf("RSA keys smaller than %d bits are not supported", RSAKeySize)
+	}
+	if len(*sshSignatureAlgorithm) > 0 {
+		if err := validateSSHSignatureAlgorithm(*sshSignatureAlgorithm); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(*sshKeyID) > 0 {
+		if err := validateSSHKeyID(*sshKeyID); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(*dnsResolver) > 0 {
+		if _, err := normalizeResolverAddress(*dnsResolver); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if _, err := parseRenegotiation(*tlsRenegotiation); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := parseIPVersion(*ipVersion); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := parseKeyTypes(*reuseKeyTypes); err != nil {
+		log.Fatal(err)
+	}
+	if len(*ppkOut) > 0 && *useAgentKey {
+		log.Fatal("--ppk-out needs the private key, it cannot be used with --use-agent-key")
+	}
+	if *mtlsOnly && (*useKeyring || len(*hostCert) > 0) {
+		log.Fatal("--mtls-only cannot be used with --keyring or --host-cert")
+	}
+	if err := validateX509Format(*x509Format); err != nil {
+		log.Fatal(err)
+	}
+	if len(*fifoOut) > 0 && (*reuseKey || *alsoEd25519) {
+		log.Fatal("--fifo-out cannot be used with --reuse-key or --also-ed25519")
+	}
+	if *memoryOnly && (*useAgentKey || *reuseKey || *alsoEd25519 || *resume || len(*fifoOut) > 0) {
+		log.Fatal("--memory-only cannot be used with --use-agent-key, --reuse-key, --also-ed25519, --resume or --fifo-out")
+	}
+	if len(*multipartBoundary) > 0 {
+		if err := multipart.NewWriter(ioutil.Discard).SetBoundary(*multipartBoundary); err != nil {
+			log.Fatalf("invalid multipart boundary: %s", err)
+		}
+	}
+	rootCAs, err := caFileRootCAs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *printConfig {
+		if err := printEffectiveConfig(os.Stdout, *configFilename, config, endpoints); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	explainPlan(*configFilename, targetUrls)
+	if *once {
+		lockPath, err := onceLockPath()
+		if err != nil {
+			log.Fatal(err)
+		}
+		releaseOnce, err := acquireOnceLock(lockPath)
+		if err == errLockHeld {
+			log.Printf("another run is already getting certs, skipping this one")
+			os.Exit(exitCodeAlreadyRunning)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer releaseOnce()
+	}
+	var warmup *keyWarmup
+	if len(*hostCert) < 1 && !*useAgentKey && (len(*fifoOut) > 0 || !*reuseKey) {
+		// generated while the password is typed
+		warmup = startKeyWarmup()
+	}
+	usr, password, err := getRunUserAndCreds(endpoints, rootCAs)
 	if err != nil {
 		log.Fatal(err)
 	}
 	userName := usr.Username
+	if err := validateUserName(userName); err != nil {
+		log.Fatal(err)
+	}
+	if len(*hostCert) > 0 {
+		hostPassword, err := password.get()
+		if err == nil {
+			err = hostCertCommand(*hostCert, *hostKeyPath, userName, hostPassword, targetUrls, rootCAs)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	homeDir, err := getUserHomeDir(usr)
 	if err != nil {
@@ -509,37 +1256,251 @@ func main() {
 
 	//sshPath := homeDir + "/.ssh/"
 	commonCertPath := "/.ssh/"
-	privateKeyPath := filepath.Join(homeDir, commonCertPath, FilePrefix)
-	signer, _, err := genKeyPair(privateKeyPath)
+	keysDir := filepath.Join(homeDir, commonCertPath)
+	privateKeyPath := keyFilePath(keysDir, FilePrefix)
+	if len(*forUser) > 0 {
+		privateKeyPath = keyFilePath(keysDir, delegatedKeyPrefix(*forUser))
+	}
+	if !*memoryOnly {
+		releaseLock, err := acquireLock(privateKeyPath+".lock", *lockTimeout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer releaseLock()
+	}
+	runFiles := managedFiles(privateKeyPath)
+	ed25519KeyPath := keyFilePath(keysDir, ed25519FilePrefix)
+	if *alsoEd25519 {
+		runFiles = append(runFiles, ed25519KeyPath, publicKeyPath(ed25519KeyPath),
+			ed25519KeyPath+"-cert.pub", x509CertPath(ed25519KeyPath))
+	}
+	var previousSSHCert []byte
+	if *certDiff {
+		// read before --on-existing moves it away
+		previousSSHCert, _ = ioutil.ReadFile(privateKeyPath + "-cert.pub")
+	}
+	if len(*fifoOut) > 0 || *memoryOnly {
+		// nothing is written next to the key
+		runFiles = nil
+	}
+	// Only the files there before the run are backed up, not the ones the
+	// run itself writes before its commit step.
+	existingFiles := existingPaths(runFiles)
+	var guard *interruptGuard
+	if *onInterrupt == onInterruptRollback {
+		guardFiles := append([]string{privateKeyPath, publicKeyPath(privateKeyPath)}, runFiles...)
+		guard, err = newInterruptGuard(guardFiles)
+		if err != nil {
+			log.Fatal(err)
+		}
+		guard.watch()
+	}
+	proceed, err := checkOnExisting(*onExisting, existingFiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !proceed {
+		return
+	}
+	var signer crypto.Signer
+	// Only kept in memory with --fifo-out or --memory-only, which write
+	// no key file.
+	var inMemoryKey []byte
+	// New keys are written once the certs are issued, not to replace the
+	// previous key on a failed run.
+	var newKeyPEM []byte
+	var ed25519Key *newKey
+	// A key already written for --reuse-key, removed by
+	// --cleanup-on-failure.
+	generatedKey := false
+	if *useAgentKey {
+		signer, err = getAgentSigner(*agentKeyMatch)
+	} else if len(*fifoOut) > 0 || *memoryOnly {
+		signer, inMemoryKey, err = warmup.take()
+	} else if *reuseKey {
+		signer, generatedKey, err = loadOrGenKeyPair(privateKeyPath)
+	} else {
+		signer, newKeyPEM, err = warmup.take()
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	sshCert, x509Cert, err := getCertFromTargetUrls(signer, userName,
-		password, strings.Split(config.Base.Gen_Cert_URLS, ","), nil, false)
+	keyLocation := outputKey{signer: signer, path: privateKeyPath, pem: inMemoryKey}
+	targets := []outputTarget{{name: "files", persist: filePersister(privateKeyPath)}}
+	if *useAgentKey || len(*fifoOut) > 0 || *memoryOnly {
+		keyLocation.path = ""
+	}
+	if len(*fifoOut) > 0 {
+		targets = []outputTarget{{name: "fifo " + *fifoOut, persist: fifoPersister(*fifoOut, inMemoryKey)}}
+	}
+	if *memoryOnly {
+		targets = []outputTarget{{name: "ssh-agent", persist: agentPersister(signer)}}
+	}
+	if len(*vaultPath) > 0 {
+		persistVault, err := vaultPersister(*vaultPath, *vaultKVVersion, keyLocation.path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		targets = append(targets, outputTarget{name: "vault " + *vaultPath, persist: persistVault})
+	}
+	if len(*ppkOut) > 0 {
+		targets = append(targets, outputTarget{name: "ppk " + *ppkOut, persist: ppkPersister(*ppkOut, signer)})
+	}
+	targets, err = addOutputTargets(targets, config.Base.Outputs, keyLocation)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if sshCert == nil || x509Cert == nil {
+	persist := multiTargetPersister(targets)
+	if len(*printPubKey) > 0 {
+		encodedKey, err := encodePublicKey(signer.Public(), *printPubKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(encodedKey)
+	}
+	signers := []crypto.Signer{signer}
+	if *alsoEd25519 {
+		ed25519Signer, pemKey, err := genEd25519Key(rand.Reader)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ed25519Key = &newKey{path: ed25519KeyPath, signer: ed25519Signer, pem: pemKey}
+		signers = append(signers, ed25519Signer)
+	}
+	if *resume {
+		if !*reuseKey && !*useAgentKey {
+			log.Printf("WARNING: --resume only reuses certs with --reuse-key or --use-agent-key")
+		}
+		resumeCerts = loadResumeState(resumeStatePath(privateKeyPath))
+	}
+	var sshCert, x509Cert []byte
+	var materials []certMaterial
+	err = retryWithBackoff(*retries, backoff, func() error {
+		var err error
+		materials, err = getCertsForKeysFromEndpoints(signers, userName,
+			password, endpoints, rootCAs, false)
+		return err
+	})
+	if materials != nil {
+		sshCert, x509Cert = materials[0].SSHCert, materials[0].X509Cert
+	}
+	if _, ok := err.(*maintenanceError); ok {
+		recordRunMetrics(false, nil, nil)
+		log.Printf("keymaster is under maintenance, try again later: %s", err)
+		os.Exit(exitCodeMaintenance)
+	}
+	partialErr, isPartial := err.(*partialCertsError)
+	if err != nil && !isPartial {
+		if *cleanupOnFailure && generatedKey {
+			removeKeyPair(privateKeyPath)
+		}
+		recordRunMetrics(false, nil, nil)
+		if *useKeyring {
+			log.Printf("if the stored password is stale, remove it from the keyring service '%s'", *keyringService)
+		}
+		log.Fatal(err)
+	}
+	if (sshCert == nil || x509Cert == nil) && !isPartial {
 		err := errors.New("Could not get cert from any url")
 		log.Fatal(err)
 	}
+	// Checked before anything is stored, a refused cert leaving the
+	// previous files in place.
+	if policy != nil {
+		for _, material := range materials {
+			if err := policy.check(material); err != nil {
+				if generatedKey {
+					removeKeyPair(privateKeyPath)
+				}
+				log.Fatal(err)
+			}
+		}
+	}
+	rememberPassword(userName, password.password)
 	if *debug {
 		log.Printf("Got Certs from server")
 		// now we write the cert file...
 	}
-	sshCertPath := privateKeyPath + "-cert.pub"
-	err = ioutil.WriteFile(sshCertPath, sshCert, 0644)
-	if err != nil {
-		err := errors.New("Could not write ssh cert")
-		log.Fatal(err)
+	if sshCert != nil {
+		if err := logSSHCertRestrictions(sshCert); err != nil {
+			log.Fatal(err)
+		}
 	}
-	x509CertPath := privateKeyPath + "-x509Cert.pem"
-	err = ioutil.WriteFile(x509CertPath, x509Cert, 0644)
+	if *certDiff {
+		logSSHCertDiff(previousSSHCert, sshCert)
+	}
+	if len(*fifoOut) < 1 && !*memoryOnly {
+		instructedFiles := instructedCertPaths([]string{privateKeyPath, ed25519KeyPath}, materials)
+		proceed, err := checkOnExisting(*onExisting, instructedFiles)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !proceed {
+			return
+		}
+		if err := guard.add(instructedFiles); err != nil {
+			log.Fatal(err)
+		}
+		existingFiles = append(existingFiles, existingPaths(instructedFiles)...)
+	}
+	err = guard.commit(func() error {
+		backups, err := backupExisting(*onExisting, existingFiles)
+		if err != nil {
+			return err
+		}
+		err = writeNewKeysAndCerts(persist, materials,
+			newKey{path: privateKeyPath, signer: signer, pem: newKeyPEM, pubOnly: *useAgentKey},
+			ed25519Key)
+		if err != nil {
+			restoreBackups(backups)
+		}
+		return err
+	})
 	if err != nil {
-		err := errors.New("Could not write ssh cert")
 		log.Fatal(err)
 	}
+	addInstructedCertToAgent(signer, materials[0])
+	if *resume {
+		var pubs []ssh.PublicKey
+		for _, signer := range signers {
+			pub, err := ssh.NewPublicKey(signer.Public())
+			if err != nil {
+				log.Fatal(err)
+			}
+			pubs = append(pubs, pub)
+		}
+		err := updateResumeState(resumeStatePath(privateKeyPath), pubs, materials, isPartial)
+		if err != nil {
+			log.Printf("cannot update the resume state: %s", err)
+		}
+	}
+	if len(*receiptOut) > 0 {
+		keyPaths := []string{privateKeyPath, ed25519KeyPath}
+		if len(*fifoOut) > 0 || *memoryOnly {
+			keyPaths[0] = ""
+		}
+		result, err := newReceipt(userName, materials, keyPaths, isPartial, time.Now())
+		if err == nil {
+			err = writeReceipt(*receiptOut, result)
+		}
+		if err != nil {
+			log.Printf("cannot write the receipt: %s", err)
+		}
+	}
 
+	recordRunMetrics(!isPartial, sshCert, x509Cert)
+	if len(*verifyHost) > 0 {
+		knownHostsPath := filepath.Join(homeDir, ".ssh", "known_hosts")
+		if err := verifyHostLogin(*verifyHost, signer, sshCert, knownHostsPath); err != nil {
+			log.Printf("verification failed: %s", err)
+			os.Exit(exitCodeVerifyHostFailed)
+		}
+		log.Printf("verified the ssh cert is accepted by %s", *verifyHost)
+	}
+	if isPartial {
+		log.Printf("Partial success: %s", partialErr)
+		os.Exit(exitCodePartialSuccess)
+	}
 	log.Printf("Success")
 
 }
@@ -1,18 +1,22 @@
 package main
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"github.com/Symantec/keymaster/lib/certgen"
 	"github.com/Symantec/keymaster/lib/webapi/v0/proto"
+	"golang.org/x/crypto/ssh"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/user"
+	"strings"
 	"testing"
 )
 
@@ -126,7 +130,7 @@ const localHttpsTarget = "https://localhost:22443/"
 var testAllowedCertBackends = []string{proto.AuthTypePassword, proto.AuthTypeU2F}
 
 func handler(w http.ResponseWriter, r *http.Request) {
-	authCookie := http.Cookie{Name: "somename", Value: "somevalue"}
+	authCookie := http.Cookie{Name: "somename", Value: "somevalue", Path: "/"}
 	http.SetCookie(w, &authCookie)
 	switch r.URL.Path {
 	case proto.LoginPath:
@@ -134,6 +138,8 @@ func handler(w http.ResponseWriter, r *http.Request) {
 			CertAuthBackend: testAllowedCertBackends}
 		w.WriteHeader(200)
 		json.NewEncoder(w).Encode(loginResponse)
+	case proto.VersionPath:
+		json.NewEncoder(w).Encode(proto.VersionResponse{Version: "0.3.2"})
 
 	default:
 		fmt.Fprintf(w, "Hi there, I love %s!", r.URL.Path[1:])
@@ -160,7 +166,7 @@ func TestGenKeyPairSuccess(t *testing.T) {
 
 	defer os.Remove(tmpfile.Name()) // clean up
 
-	_, _, err = genKeyPair(tmpfile.Name())
+	_, _, err = genKeyPair(tmpfile.Name(), rand.Reader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -176,7 +182,7 @@ func TestGenKeyPairSuccess(t *testing.T) {
 }
 
 func TestGenKeyPairFailNoPerms(t *testing.T) {
-	_, _, err := genKeyPair("/proc/something")
+	_, _, err := genKeyPair("/proc/something", rand.Reader)
 	if err == nil {
 		t.Logf("Should have failed")
 		t.Fatal(err)
@@ -271,6 +277,19 @@ func TestLoadVerifyConfigFileFailNoSuchFile(t *testing.T) {
 
 }
 
+func TestSplitURLList(t *testing.T) {
+	urls := splitURLList(" https://a.example.com/, https://b.example.com/ ,,  ")
+	if len(urls) != 2 {
+		t.Fatalf("expected 2 urls, got %d: %v", len(urls), urls)
+	}
+	if urls[0] != "https://a.example.com/" || urls[1] != "https://b.example.com/" {
+		t.Fatalf("urls not trimmed: %q", urls)
+	}
+	if len(splitURLList(" , ")) != 0 {
+		t.Fatal("should have found no urls")
+	}
+}
+
 func TestGetCertFromTargetUrlsSuccessOneURL(t *testing.T) {
 	certPool := x509.NewCertPool()
 	ok := certPool.AppendCertsFromPEM([]byte(rootCAPem))
@@ -288,6 +307,290 @@ func TestGetCertFromTargetUrlsSuccessOneURL(t *testing.T) {
 	}
 }
 
+func TestGetCertFromTargetUrlsFakeServerSuccess(t *testing.T) {
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshCert, x509Cert, err := getCertFromTargetUrls(privateKey, "username", []byte("password"),
+		[]string{fake.URL}, fake.RootCAs(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(sshCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		t.Fatal("ssh response is not a certificate")
+	}
+	if len(cert.ValidPrincipals) != 1 || cert.ValidPrincipals[0] != "username" {
+		t.Fatalf("unexpected principals %v", cert.ValidPrincipals)
+	}
+	block, _ := pem.Decode(x509Cert)
+	if block == nil {
+		t.Fatal("x509 response is not pem")
+	}
+	parsedCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsedCert.Subject.CommonName != "username" {
+		t.Fatalf("unexpected x509 subject %s", parsedCert.Subject.CommonName)
+	}
+}
+
+func TestGetCertFromTargetUrlsFakeServerSendsSourceAddress(t *testing.T) {
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*sourceAddress = "10.0.0.0/8"
+	defer func() { *sourceAddress = "" }()
+	_, _, err = getCertFromTargetUrls(privateKey, "username", []byte("password"),
+		[]string{fake.URL}, fake.RootCAs(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, r := range fake.Requests {
+		if r.Form.Get("type") == "ssh" && r.Form.Get("source_address") == "10.0.0.0/8" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("source_address was not sent with the ssh certgen request")
+	}
+}
+
+func TestGetCertFromTargetUrlsFakeServerSendsKeyID(t *testing.T) {
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*sshKeyID = "ticket-1234"
+	defer func() { *sshKeyID = "" }()
+	_, _, err = getCertFromTargetUrls(privateKey, "username", []byte("password"),
+		[]string{fake.URL}, fake.RootCAs(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range fake.Requests {
+		if r.Form.Get("type") == "ssh" && r.Form.Get("key_id") == "ticket-1234" {
+			return
+		}
+	}
+	t.Fatal("key_id was not sent with the ssh certgen request")
+}
+
+func TestGetCertFromTargetUrlsFakeServerIncludesHostname(t *testing.T) {
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	*includeHostname = true
+	defer func() { *includeHostname = false }()
+	_, _, err = getCertFromTargetUrls(privateKey, "username", []byte("password"),
+		[]string{fake.URL}, fake.RootCAs(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certRequests := 0
+	for _, r := range fake.Requests {
+		if strings.HasPrefix(r.URL.Path, "/certgen/") {
+			certRequests++
+			if r.Form.Get("client_hostname") != hostname {
+				t.Errorf("hostname not sent with the %s certgen request", r.Form.Get("type"))
+			}
+		}
+	}
+	if certRequests != 2 {
+		t.Fatalf("expected 2 certgen requests, got %d", certRequests)
+	}
+}
+
+func TestGetCertFromTargetUrlsFakeServerPartialSuccess(t *testing.T) {
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	fake.FailCertType = "x509"
+	privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = getCertFromTargetUrls(privateKey, "username", []byte("password"),
+		[]string{fake.URL}, fake.RootCAs(), false)
+	if err == nil {
+		t.Fatal("Should have failed without allow-partial")
+	}
+	*allowPartial = true
+	defer func() { *allowPartial = false }()
+	sshCert, x509Cert, err := getCertFromTargetUrls(privateKey, "username", []byte("password"),
+		[]string{fake.URL}, fake.RootCAs(), false)
+	partialErr, ok := err.(*partialCertsError)
+	if !ok {
+		t.Fatalf("expected a partial error, got %v", err)
+	}
+	if _, ok := partialErr.failures["x509"]; !ok {
+		t.Fatal("x509 should be reported as failed")
+	}
+	if sshCert == nil || x509Cert != nil {
+		t.Fatal("only the ssh cert should have been returned")
+	}
+}
+
+func TestGetCertsFromServerReusesConnection(t *testing.T) {
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := newHTTPClient(&tls.Config{RootCAs: fake.RootCAs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, tracker := withConnTracker(client)
+	_, _, err = getCertsFromServer(privateKey, "username", []byte("password"), fake.URL, client, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracker.requests < 4 {
+		t.Fatalf("expected at least 4 traced requests, got %d", tracker.requests)
+	}
+	if count := tracker.connectionCount(); count != 1 {
+		t.Fatalf("expected all requests to reuse one connection, got %d", count)
+	}
+}
+
+func TestGetCertsForKeysFromEndpointsRSAAndEd25519(t *testing.T) {
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Key, _, err := genEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signers := []crypto.Signer{rsaKey, ed25519Key}
+	materials, err := getCertsForKeysFromEndpoints(signers, "username", knownPassword([]byte("password")),
+		[]endpointConfig{{URL: fake.URL}}, fake.RootCAs(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(materials) != len(signers) {
+		t.Fatalf("expected %d materials, got %d", len(signers), len(materials))
+	}
+	for i, material := range materials {
+		sshPub, err := ssh.NewPublicKey(signers[i].Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey(material.SSHCert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, ok := pubKey.(*ssh.Certificate)
+		if !ok {
+			t.Fatalf("got a %T instead of an ssh cert", pubKey)
+		}
+		if cert.Key.Type() != sshPub.Type() {
+			t.Fatalf("cert %d is for a %s key instead of %s", i, cert.Key.Type(), sshPub.Type())
+		}
+		if material.X509Cert == nil {
+			t.Fatalf("missing x509 cert %d", i)
+		}
+	}
+	logins := 0
+	for _, path := range fake.requestPaths() {
+		if path == proto.LoginPath {
+			logins++
+		}
+	}
+	if logins != 1 {
+		t.Fatalf("expected a single login, got %d", logins)
+	}
+}
+
+func TestGetCertFromTargetUrlsFakeServerFailBadPassword(t *testing.T) {
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = getCertFromTargetUrls(privateKey, "username", []byte("wrong"),
+		[]string{fake.URL}, fake.RootCAs(), false)
+	if err == nil {
+		t.Fatal("Should have failed with a bad password")
+	}
+}
+
+func TestGetCertFromTargetUrlsFakeServerFailover(t *testing.T) {
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	down := newFakeKeymaster(t)
+	down.Close()
+	privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = getCertFromTargetUrls(privateKey, "username", []byte("password"),
+		[]string{down.URL, fake.URL}, fake.RootCAs(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetCertFromEndpointsTLSOverrides(t *testing.T) {
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile, err := createTempFileWithStringContent("test_EndpointCA",
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: fake.Certificate().Raw})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	caFile.Close()
+	// The fake server is only trusted through the endpoint override
+	endpoints := []endpointConfig{
+		{URL: fake.URL},
+		{URL: fake.URL, CAFile: caFile.Name(), ServerName: "example.com"},
+	}
+	sshCert, x509Cert, err := getCertFromEndpoints(privateKey, "username", []byte("password"),
+		endpoints, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sshCert == nil || x509Cert == nil {
+		t.Fatal("missing certs")
+	}
+	endpoints[1].ServerName = "keymaster.invalid"
+	_, _, err = getCertFromEndpoints(privateKey, "username", []byte("password"),
+		endpoints, nil, false)
+	if err == nil {
+		t.Fatal("should have failed verifying the overridden server name")
+	}
+}
+
 func TestGetCertFromTargetUrlsFailUntrustedCA(t *testing.T) {
 	privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
 	if err != nil {
@@ -328,11 +631,118 @@ func TestGetParseURLEnvVariable(t *testing.T) {
 
 }
 
+func TestValidateUserName(t *testing.T) {
+	if err := validateUserName("username"); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateUserName(strings.Repeat("a", maxUserNameLength)); err != nil {
+		t.Fatal(err)
+	}
+	// Each of these characters takes 6 once escaped
+	if err := validateUserName(strings.Repeat("é", maxUserNameLength/4)); err == nil {
+		t.Fatal("should have failed on a username too long once escaped")
+	}
+	if err := validateUserName(""); err == nil {
+		t.Fatal("should have failed on an empty username")
+	}
+}
+
+func TestReadPasswordLine(t *testing.T) {
+	for _, input := range []string{"secret\n", "secret\r\nignored\n", "secret"} {
+		password, err := readPasswordLine(strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(password) != "secret" {
+			t.Fatalf("unexpected password '%s' for input %q", password, input)
+		}
+	}
+	if _, err := readPasswordLine(strings.NewReader("\n")); err == nil {
+		t.Fatal("should have failed on an empty password")
+	}
+}
+
+func TestBuildMultipartKeyRequest(t *testing.T) {
+	req, err := buildMultipartKeyRequest("POST", "https://localhost/certgen/username", nil,
+		"pubkeyfile", "keymaster.pub", strings.NewReader(testUserPublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = req.ParseMultipartForm(1e6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, header, err := req.FormFile("pubkeyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if header.Filename != "keymaster.pub" {
+		t.Fatalf("unexpected filename %s", header.Filename)
+	}
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != testUserPublicKey {
+		t.Fatal("uploaded content does not match")
+	}
+	if req.ContentLength < int64(len(testUserPublicKey)) {
+		t.Fatalf("request should have a content length, got %d", req.ContentLength)
+	}
+}
+
+func TestBuildMultipartKeyRequestFixedBoundary(t *testing.T) {
+	*multipartBoundary = "keymasterBoundary1234"
+	defer func() { *multipartBoundary = "" }()
+	req, err := buildMultipartKeyRequest("POST", "https://localhost/certgen/username", nil,
+		"pubkeyfile", "keymaster.pub", strings.NewReader(testUserPublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get("Content-Type") != "multipart/form-data; boundary=keymasterBoundary1234" {
+		t.Fatalf("unexpected Content-Type %s", req.Header.Get("Content-Type"))
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.ContentLength != int64(len(body)) {
+		t.Fatalf("Content-Length %d does not match the body length %d", req.ContentLength, len(body))
+	}
+	*multipartBoundary = "bad boundary "
+	if _, err := buildMultipartKeyRequest("POST", "https://localhost/certgen/username", nil,
+		"pubkeyfile", "keymaster.pub", strings.NewReader(testUserPublicKey)); err == nil {
+		t.Fatal("should have failed with an invalid boundary")
+	}
+}
+
+func TestCheckCertContentType(t *testing.T) {
+	for _, contentType := range []string{"text/plain; charset=utf-8", "application/x-pem-file", ""} {
+		if err := checkCertContentType(contentType, []byte("cert")); err != nil {
+			t.Errorf("'%s' should be accepted: %s", contentType, err)
+		}
+	}
+	body := []byte("<html><body>" + strings.Repeat("maintenance ", 50) + "</body></html>")
+	err := checkCertContentType("text/html; charset=utf-8", body)
+	if err == nil {
+		t.Fatal("text/html should be rejected")
+	}
+	if !strings.Contains(err.Error(), "<html><body>maintenance") {
+		t.Fatalf("body preview missing from '%s'", err)
+	}
+	if strings.Contains(err.Error(), "</html>") {
+		t.Fatalf("body preview should be truncated: '%s'", err)
+	}
+}
+
 // ------------WARN-------- Next name copied from https://github.com/howeyc/gopass/blob/master/pass_test.go for using
 //  gopass checks
 func TestPipe(t *testing.T) {
 	_, err := pipeToStdin("password\n")
-	_, password, err := getUserInfoAndCreds()
+	_, password, err := getUserInfoAndCreds(func(userName string) string {
+		return "Password for " + userName + ": "
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
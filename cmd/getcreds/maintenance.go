@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Exit code used when every server is under maintenance, after the ones
+// of --validate-only.
+const exitCodeMaintenance = 7
+
+// Marker the server puts in the body of its maintenance responses.
+const maintenanceMarker = "maintenance"
+
+// maintenanceError is returned when a server answers that it is under
+// maintenance. It is not a hard failure: the same request is expected to
+// work once the maintenance window is over.
+type maintenanceError struct {
+	server     string
+	retryAfter time.Duration
+}
+
+func (e *maintenanceError) Error() string {
+	if e.retryAfter > 0 {
+		return fmt.Sprintf("server '%s' is under maintenance, retry after %s", e.server, e.retryAfter)
+	}
+	return fmt.Sprintf("server '%s' is under maintenance", e.server)
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date. Invalid or past values give zero.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	date, err := http.ParseTime(value)
+	if err != nil || date.Before(now) {
+		return 0
+	}
+	return date.Sub(now).Truncate(time.Second)
+}
+
+// checkMaintenance classifies a failed response whose body, read with
+// readErrorBody, is body, returning a maintenanceError for a 503 with a
+// Retry-After header or the maintenance marker in its body, and nil for any
+// other failure.
+func checkMaintenance(resp *http.Response, body []byte) error {
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		return nil
+	}
+	retryAfter := resp.Header.Get("Retry-After")
+	if len(retryAfter) < 1 &&
+		!bytes.Contains(bytes.ToLower(body), []byte(maintenanceMarker)) {
+		return nil
+	}
+	return &maintenanceError{
+		server:     resp.Request.URL.Host,
+		retryAfter: parseRetryAfter(retryAfter, time.Now()),
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := map[string]time.Duration{
+		"120":                           2 * time.Minute,
+		"-5":                            0,
+		"":                              0,
+		"soon":                          0,
+		"Thu, 01 Jun 2017 12:30:00 GMT": 30 * time.Minute,
+		"Thu, 01 Jun 2017 11:30:00 GMT": 0,
+	}
+	for value, expected := range tests {
+		if got := parseRetryAfter(value, now); got != expected {
+			t.Fatalf("'%s': expected %s got %s", value, expected, got)
+		}
+	}
+}
+
+func newMaintenanceServer(retryAfter, body string) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if len(retryAfter) > 0 {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			http.Error(w, body, http.StatusServiceUnavailable)
+		}))
+}
+
+func TestCheckMaintenance(t *testing.T) {
+	tests := []struct {
+		retryAfter  string
+		body        string
+		maintenance bool
+	}{
+		{"", "Server under scheduled Maintenance", true},
+		{"60", "", true},
+		{"", "overloaded", false},
+	}
+	for _, test := range tests {
+		server := newMaintenanceServer(test.retryAfter, test.body)
+		resp, err := server.Client().Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkMaintenance(resp, readErrorBody(resp))
+		resp.Body.Close()
+		server.Close()
+		if _, ok := err.(*maintenanceError); ok != test.maintenance {
+			t.Fatalf("%+v: got %v", test, err)
+		}
+	}
+}
+
+func TestGetCertFromTargetUrlsMaintenance(t *testing.T) {
+	maintenance := newMaintenanceServer("", "down for maintenance")
+	defer maintenance.Close()
+	privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCAs := maintenance.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	_, _, err = getCertFromTargetUrls(privateKey, "username", []byte("password"),
+		[]string{maintenance.URL}, rootCAs, false)
+	if _, ok := err.(*maintenanceError); !ok {
+		t.Fatalf("expected a maintenance error, got %v", err)
+	}
+
+	// Another server failing for other reasons makes it a hard failure
+	down := newFakeKeymaster(t)
+	down.Close()
+	_, _, err = getCertFromTargetUrls(privateKey, "username", []byte("password"),
+		[]string{maintenance.URL, down.URL}, rootCAs, false)
+	if _, ok := err.(*maintenanceError); ok || err == nil {
+		t.Fatalf("expected a hard failure, got %v", err)
+	}
+}
+
+func TestRetryWithBackoffHonorsRetryAfter(t *testing.T) {
+	noDelay := func(attempt int) time.Duration { return 0 }
+	retryAfter := 50 * time.Millisecond
+	calls := 0
+	start := time.Now()
+	err := retryWithBackoff(1, noDelay, func() error {
+		calls++
+		if calls < 2 {
+			return &maintenanceError{server: "keymaster", retryAfter: retryAfter}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < retryAfter {
+		t.Fatalf("retried after %s, before the requested %s", elapsed, retryAfter)
+	}
+}
+
+func TestCapRetryAfter(t *testing.T) {
+	if got := capRetryAfter(time.Hour); got != *backoffCap {
+		t.Fatalf("expected the --backoff-cap %s got %s", *backoffCap, got)
+	}
+	*backoffCap = 0
+	defer func() { *backoffCap = 30 * time.Second }()
+	if got := capRetryAfter(time.Hour); got != maxRetryDelay {
+		t.Fatalf("expected %s got %s", maxRetryDelay, got)
+	}
+	if got := capRetryAfter(time.Second); got != time.Second {
+		t.Fatalf("expected 1s got %s", got)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	metricLastSuccess = "keymaster_client_last_success_timestamp_seconds"
+	metricSSHExpiry   = "keymaster_client_ssh_cert_expiry_timestamp_seconds"
+	metricX509Expiry  = "keymaster_client_x509_cert_expiry_timestamp_seconds"
+	metricSuccesses   = "keymaster_client_runs_success_total"
+	metricFailures    = "keymaster_client_runs_failure_total"
+)
+
+var metricHelp = map[string]string{
+	metricLastSuccess: "gauge Time of the last successful cert refresh.",
+	metricSSHExpiry:   "gauge Expiration time of the last issued ssh cert.",
+	metricX509Expiry:  "gauge Expiration time of the last issued x509 cert.",
+	metricSuccesses:   "counter Number of successful runs.",
+	metricFailures:    "counter Number of failed runs.",
+}
+
+var metricOrder = []string{metricLastSuccess, metricSSHExpiry, metricX509Expiry,
+	metricSuccesses, metricFailures}
+
+// readMetricsFile loads the values of a previous run so that counters keep
+// increasing across runs. A missing or unparsable file starts from zero.
+func readMetricsFile(path string) map[string]float64 {
+	values := make(map[string]float64)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return values
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if _, ok := metricHelp[fields[0]]; !ok {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		values[fields[0]] = value
+	}
+	return values
+}
+
+// writeMetricsFile writes the values in the node_exporter textfile
+// collector format. The file is renamed into place so the collector never
+// reads a partial file.
+func writeMetricsFile(path string, values map[string]float64) error {
+	var buf bytes.Buffer
+	for _, name := range metricOrder {
+		value, ok := values[name]
+		if !ok {
+			continue
+		}
+		help := strings.SplitN(metricHelp[name], " ", 2)
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, help[1], name, help[0])
+		fmt.Fprintf(&buf, "%s %s\n", name, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	return writeFileAtomic(path, buf.Bytes(), 0644, ".keymaster-metrics-")
+}
+
+func getX509CertExpiry(pemCert []byte) (time.Time, error) {
+	block, _ := pem.Decode(pemCert)
+	if block == nil {
+		return time.Time{}, errors.New("cannot decode x509 cert")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+func updateRunMetrics(values map[string]float64, success bool, sshCert []byte, x509Cert []byte, now time.Time) {
+	if success {
+		values[metricSuccesses]++
+		values[metricLastSuccess] = float64(now.Unix())
+	} else {
+		values[metricFailures]++
+	}
+	if sshCert != nil {
+		if cert, err := parseSSHCert(sshCert); err == nil {
+			values[metricSSHExpiry] = float64(cert.ValidBefore)
+		}
+	}
+	if x509Cert != nil {
+		if notAfter, err := getX509CertExpiry(x509Cert); err == nil {
+			values[metricX509Expiry] = float64(notAfter.Unix())
+		}
+	}
+}
+
+// recordRunMetrics updates the --metrics-file, if any, with the outcome of
+// this run. Failing to write metrics never fails the run.
+func recordRunMetrics(success bool, sshCert []byte, x509Cert []byte) {
+	if len(*metricsFilename) < 1 {
+		return
+	}
+	values := readMetricsFile(*metricsFilename)
+	updateRunMetrics(values, success, sshCert, x509Cert, time.Now())
+	if err := writeMetricsFile(*metricsFilename, values); err != nil {
+		log.Printf("cannot write metrics file: %s", err)
+	}
+}
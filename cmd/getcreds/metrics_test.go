@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsFileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_metrics_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keymaster.prom")
+
+	now := time.Unix(1500000000, 0)
+	values := readMetricsFile(path)
+	updateRunMetrics(values, true, nil, nil, now)
+	if err := writeMetricsFile(path, values); err != nil {
+		t.Fatal(err)
+	}
+	values = readMetricsFile(path)
+	updateRunMetrics(values, false, nil, nil, now.Add(time.Hour))
+	if err := writeMetricsFile(path, values); err != nil {
+		t.Fatal(err)
+	}
+
+	values = readMetricsFile(path)
+	if values[metricSuccesses] != 1 || values[metricFailures] != 1 {
+		t.Fatalf("unexpected counters %v", values)
+	}
+	if values[metricLastSuccess] != 1500000000 {
+		t.Fatalf("failure should not update last success: %v", values)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "# TYPE "+metricFailures+" counter\n") {
+		t.Fatalf("missing type annotation:\n%s", content)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Exit code of --once runs skipped as another run is getting certs.
+const exitCodeAlreadyRunning = 9
+
+// onceLockPath returns the lock held during a whole --once run. It is
+// separate from the lock on the key files as it is taken before prompting
+// for the password, so that a skipped run never contacts the server.
+func onceLockPath() (string, error) {
+	privateKeyPath, err := getDefaultPrivateKeyPath()
+	if err != nil {
+		return "", err
+	}
+	if len(*forUser) > 0 {
+		privateKeyPath = keyFilePath(filepath.Dir(privateKeyPath), delegatedKeyPrefix(*forUser))
+	}
+	return privateKeyPath + ".once", nil
+}
+
+// acquireOnceLock takes the lock at path without waiting, returning
+// errLockHeld when another run holds it. The returned function releases
+// the lock.
+func acquireOnceLock(path string) (func(), error) {
+	lockFile, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := tryLockFile(lockFile); err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(lockFile)
+		lockFile.Close()
+	}, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAcquireOnceLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster-once")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lockPath := filepath.Join(dir, "keymaster.once")
+	release, err := acquireOnceLock(lockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acquireOnceLock(lockPath); err != errLockHeld {
+		t.Fatalf("expected the lock to be held, got %v", err)
+	}
+	release()
+	release, err = acquireOnceLock(lockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
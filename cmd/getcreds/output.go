@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+)
+
+// encodePublicKey renders the public key in one of the formats accepted by
+// out of band key registration systems.
+func encodePublicKey(pub crypto.PublicKey, format string) (string, error) {
+	if format == "authorized_keys" {
+		sshPub, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+		return string(ssh.MarshalAuthorizedKey(sshPub)), nil
+	}
+	derKey, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	switch format {
+	case "pem":
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: derKey})), nil
+	case "base64":
+		return base64.StdEncoding.EncodeToString(derKey) + "\n", nil
+	case "hex":
+		return hex.EncodeToString(derKey) + "\n", nil
+	}
+	return "", fmt.Errorf("unknown public key format '%s'", format)
+}
+
+// File extensions of the x509 cert for each --x509-format.
+var x509FormatExtensions = map[string]string{
+	"pem":    ".pem",
+	"der":    ".der",
+	"base64": ".b64",
+}
+
+func validateX509Format(format string) error {
+	if _, ok := x509FormatExtensions[format]; !ok {
+		return fmt.Errorf("unknown x509 format '%s', use pem, der or base64", format)
+	}
+	return nil
+}
+
+// x509CertPath is where the x509 cert is written for the --x509-format.
+func x509CertPath(privateKeyPath string) string {
+	return privateKeyPath + "-x509Cert" + x509FormatExtensions[*x509Format]
+}
+
+// encodeX509Cert re-encodes the PEM cert returned by the server in one of
+// the --x509-format formats.
+func encodeX509Cert(pemCert []byte, format string) ([]byte, error) {
+	if format == "pem" {
+		return pemCert, nil
+	}
+	block, _ := pem.Decode(pemCert)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("x509 cert from the server is not PEM encoded")
+	}
+	switch format {
+	case "der":
+		return block.Bytes, nil
+	case "base64":
+		return []byte(base64.StdEncoding.EncodeToString(block.Bytes) + "\n"), nil
+	}
+	return nil, validateX509Format(format)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"golang.org/x/crypto/ssh"
+	"strings"
+	"testing"
+)
+
+func TestEncodePublicKey(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derKey, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizedKey, err := encodePublicKey(&privateKey.PublicKey, "authorized_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey)); err != nil {
+		t.Fatal(err)
+	}
+	pemKey, err := encodePublicKey(&privateKey.PublicKey, "pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil || string(block.Bytes) != string(derKey) {
+		t.Fatal("pem output does not match the der key")
+	}
+	b64Key, err := encodePublicKey(&privateKey.PublicKey, "base64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(b64Key) != base64.StdEncoding.EncodeToString(derKey) {
+		t.Fatal("base64 output does not match the der key")
+	}
+	hexKey, err := encodePublicKey(&privateKey.PublicKey, "hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(hexKey) != hex.EncodeToString(derKey) {
+		t.Fatal("hex output does not match the der key")
+	}
+	if _, err := encodePublicKey(&privateKey.PublicKey, "xml"); err == nil {
+		t.Fatal("Should have failed on unknown format")
+	}
+}
+
+func TestEncodeX509Cert(t *testing.T) {
+	der := []byte("not really a cert")
+	pemCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	encoded, err := encodeX509Cert(pemCert, "pem")
+	if err != nil || string(encoded) != string(pemCert) {
+		t.Fatalf("pem should be written unchanged, got %s %v", encoded, err)
+	}
+	encoded, err = encodeX509Cert(pemCert, "der")
+	if err != nil || string(encoded) != string(der) {
+		t.Fatalf("unexpected der %v %v", encoded, err)
+	}
+	encoded, err = encodeX509Cert(pemCert, "base64")
+	if err != nil || string(encoded) != base64.StdEncoding.EncodeToString(der)+"\n" {
+		t.Fatalf("unexpected base64 %s %v", encoded, err)
+	}
+	if _, err := encodeX509Cert([]byte("garbage"), "der"); err == nil {
+		t.Fatal("should have failed on a non PEM cert")
+	}
+	if err := validateX509Format("p12"); err == nil {
+		t.Fatal("should have failed on an unknown format")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// outputConfig is an entry of the outputs config, an extra destination
+// for the key and certs of every run:
+//
+//	outputs:
+//	  - type: files
+//	  - type: agent
+//	  - type: vault
+//	    path: secret/data/keymaster
+//	  - type: fifo
+//	    path: /run/user/1000/keymaster
+type outputConfig struct {
+	Type      string `yaml:"type"`
+	Path      string `yaml:"path"`
+	KVVersion int    `yaml:"kv_version"`
+}
+
+func validateOutputs(outputs []outputConfig) error {
+	for _, output := range outputs {
+		switch output.Type {
+		case "files", "agent":
+		case "vault", "fifo":
+			if len(output.Path) < 1 {
+				return fmt.Errorf("%s output without path", output.Type)
+			}
+		default:
+			return fmt.Errorf("unknown output type '%s', use files, agent, vault or fifo", output.Type)
+		}
+	}
+	return nil
+}
+
+// outputKey is where the private key of the run is, which decides the
+// outputs that can receive it.
+type outputKey struct {
+	signer crypto.Signer
+	// path of the private key file, empty when it is not on disk
+	path string
+	// PEM private key kept in memory, nil when on disk or in the agent
+	pem []byte
+}
+
+// outputTargetName is used to report the outcome of output and to skip
+// the outputs already set by the command line.
+func outputTargetName(output outputConfig) string {
+	switch output.Type {
+	case "files":
+		return "files"
+	case "agent":
+		return "ssh-agent"
+	}
+	return output.Type + " " + output.Path
+}
+
+func newOutputTarget(output outputConfig, key outputKey) (outputTarget, error) {
+	target := outputTarget{name: outputTargetName(output)}
+	switch output.Type {
+	case "files":
+		if len(key.path) < 1 {
+			return target, errors.New("files output needs the private key on disk")
+		}
+		target.persist = filePersister(key.path)
+	case "agent":
+		if _, ok := key.signer.(*agentSigner); ok {
+			return target, errors.New("agent output cannot be used with a key held by the agent")
+		}
+		target.persist = agentPersister(key.signer)
+	case "vault":
+		kvVersion := output.KVVersion
+		if kvVersion == 0 {
+			kvVersion = 2
+		}
+		persist, err := vaultPersister(output.Path, kvVersion, key.path)
+		if err != nil {
+			return target, err
+		}
+		target.persist = persist
+	case "fifo":
+		pemKey := key.pem
+		if pemKey == nil && len(key.path) > 0 {
+			var err error
+			pemKey, err = ioutil.ReadFile(key.path)
+			if err != nil {
+				return target, err
+			}
+		}
+		target.persist = fifoPersister(output.Path, pemKey)
+	default:
+		return target, fmt.Errorf("unknown output type '%s'", output.Type)
+	}
+	return target, nil
+}
+
+// addOutputTargets appends the configured outputs to targets, skipping the
+// ones already there.
+func addOutputTargets(targets []outputTarget, outputs []outputConfig, key outputKey) ([]outputTarget, error) {
+	names := make(map[string]bool)
+	for _, target := range targets {
+		names[target.name] = true
+	}
+	for _, output := range outputs {
+		if names[outputTargetName(output)] {
+			continue
+		}
+		target, err := newOutputTarget(output, key)
+		if err != nil {
+			return nil, fmt.Errorf("output %s: %s", outputTargetName(output), err)
+		}
+		names[target.name] = true
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+)
+
+func TestValidateOutputs(t *testing.T) {
+	valid := []outputConfig{{Type: "files"}, {Type: "agent"}, {Type: "vault", Path: "secret/data/keymaster"}}
+	if err := validateOutputs(valid); err != nil {
+		t.Fatal(err)
+	}
+	for _, output := range []outputConfig{{Type: "socket"}, {Type: "fifo"}} {
+		if err := validateOutputs([]outputConfig{output}); err == nil {
+			t.Fatalf("%v should have been rejected", output)
+		}
+	}
+}
+
+func TestAddOutputTargets(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := outputKey{signer: privateKey, path: "/tmp/keymaster"}
+	targets := []outputTarget{{name: "files", persist: filePersister(key.path)}}
+	outputs := []outputConfig{{Type: "files"}, {Type: "agent"}, {Type: "agent"}}
+	targets, err = addOutputTargets(targets, outputs, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 || targets[1].name != "ssh-agent" {
+		t.Fatalf("expected files and ssh-agent targets, got %v", targets)
+	}
+
+	inAgent := outputKey{signer: &agentSigner{publicKey: privateKey.Public()}}
+	if _, err := addOutputTargets(nil, []outputConfig{{Type: "agent"}}, inAgent); err == nil {
+		t.Fatal("an agent held key cannot be added to the agent")
+	}
+	if _, err := addOutputTargets(nil, []outputConfig{{Type: "files"}}, inAgent); err == nil {
+		t.Fatal("files output needs the key on disk")
+	}
+}
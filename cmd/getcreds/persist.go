@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// certMaterial is what a run obtained from keymaster. Either cert may be
+// nil on a partial success.
+type certMaterial struct {
+	SSHCert  []byte
+	X509Cert []byte
+	// How the server asked the certs to be stored.
+	SSHInstructions  writeInstructions
+	X509Instructions writeInstructions
+	// Endpoint is the url of the server that issued the certs.
+	Endpoint string
+	// Negotiated with Endpoint, for audits.
+	TLSVersion     string
+	TLSCipherSuite string
+}
+
+// persistFunc stores the cert material once it has been obtained, so that
+// the command can write it to other storage (memory, a vault, ...) than
+// the files. It is internal to the command: the fetching is not part of
+// lib/client, so programs embedding the client cannot supply one.
+type persistFunc func(material certMaterial) error
+
+// filePersister is the default persistFunc, writing the certs next to the
+// private key where ssh and the other tools expect them.
+func filePersister(privateKeyPath string) persistFunc {
+	return func(material certMaterial) error {
+		if material.SSHCert != nil {
+			err := material.SSHInstructions.writeCert(privateKeyPath, privateKeyPath+"-cert.pub",
+				material.SSHCert, isSSHCertFile)
+			if err != nil {
+				return fmt.Errorf("Could not write ssh cert: %s", err)
+			}
+		}
+		if material.X509Cert != nil {
+			x509Cert, err := encodeX509Cert(material.X509Cert, *x509Format)
+			if err != nil {
+				return err
+			}
+			err = material.X509Instructions.writeCert(privateKeyPath, x509CertPath(privateKeyPath),
+				x509Cert, isX509CertFile)
+			if err != nil {
+				return fmt.Errorf("Could not write x509 cert: %s", err)
+			}
+		}
+		return nil
+	}
+}
+
+// outputTarget is a named destination for the cert material, the name
+// being used to report its outcome.
+type outputTarget struct {
+	name    string
+	persist persistFunc
+}
+
+// multiTargetPersister stores the material with the first target, whose
+// failure is returned so that the previous files are restored, then with
+// the other targets on a best-effort basis: the files are already in place
+// when one of them fails, its failure is only logged.
+func multiTargetPersister(targets []outputTarget) persistFunc {
+	return func(material certMaterial) error {
+		for i, target := range targets {
+			if err := target.persist(material); err != nil {
+				if i == 0 {
+					return fmt.Errorf("writing to %s failed: %s", target.name, err)
+				}
+				log.Printf("WARNING: writing to %s failed: %s", target.name, err)
+				continue
+			}
+			if len(targets) > 1 || *debug {
+				log.Printf("wrote to %s", target.name)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilePersisterWritesObtainedCerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster-persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	privateKeyPath := filepath.Join(dir, "keymaster")
+	persist := filePersister(privateKeyPath)
+	if err := persist(certMaterial{SSHCert: []byte("ssh cert")}); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(privateKeyPath + "-cert.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "ssh cert" {
+		t.Fatalf("unexpected ssh cert content '%s'", content)
+	}
+	if _, err := os.Stat(privateKeyPath + "-x509Cert.pem"); !os.IsNotExist(err) {
+		t.Fatal("missing x509 cert should not be written")
+	}
+}
+
+func TestFilePersisterX509Format(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster-persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*x509Format = "der"
+	defer func() { *x509Format = "pem" }()
+	privateKeyPath := filepath.Join(dir, "keymaster")
+	pemCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("der cert")})
+	if err := filePersister(privateKeyPath)(certMaterial{X509Cert: pemCert}); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(privateKeyPath + "-x509Cert.der")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "der cert" {
+		t.Fatalf("unexpected x509 cert content '%s'", content)
+	}
+}
+
+func TestMultiTargetPersister(t *testing.T) {
+	var written []string
+	target := func(name string, err error) outputTarget {
+		return outputTarget{name: name, persist: func(material certMaterial) error {
+			written = append(written, name)
+			return err
+		}}
+	}
+	persist := multiTargetPersister([]outputTarget{
+		target("files", errors.New("read-only file system")),
+		target("vault", nil),
+	})
+	err := persist(certMaterial{SSHCert: []byte("cert")})
+	if err == nil || !strings.Contains(err.Error(), "files failed: read-only file system") {
+		t.Fatalf("expected the files target failure, got %v", err)
+	}
+	if len(written) != 1 {
+		t.Fatalf("nothing should be written after the files failed, wrote %v", written)
+	}
+
+	written = nil
+	persist = multiTargetPersister([]outputTarget{
+		target("files", nil),
+		target("vault", errors.New("unreachable")),
+		target("ppk", nil),
+	})
+	if err := persist(certMaterial{SSHCert: []byte("cert")}); err != nil {
+		t.Fatalf("a failed extra output should not fail the files: %s", err)
+	}
+	if len(written) != 3 {
+		t.Fatalf("a failure should not stop the other targets, wrote %v", written)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// certPolicy is the --policy-file, client side rules the issued certs must
+// follow before they are written or used, for example:
+//
+//	max_validity: 24h
+//	required_principals: [alice]
+//	forbidden_extensions: [permit-agent-forwarding]
+type certPolicy struct {
+	MaxValidity         time.Duration `yaml:"max_validity"`
+	RequiredPrincipals  []string      `yaml:"required_principals"`
+	ForbiddenExtensions []string      `yaml:"forbidden_extensions"`
+}
+
+func loadCertPolicy(path string) (*certPolicy, error) {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy certPolicy
+	if err := yaml.UnmarshalStrict(source, &policy); err != nil {
+		return nil, fmt.Errorf("cannot parse policy file %s: %s", path, err)
+	}
+	if policy.MaxValidity < 0 {
+		return nil, errors.New("max_validity cannot be negative")
+	}
+	return &policy, nil
+}
+
+// checkSSHCert returns the policy violations of the ssh cert.
+func (policy *certPolicy) checkSSHCert(certBytes []byte) ([]string, error) {
+	cert, err := parseSSHCert(certBytes)
+	if err != nil {
+		return nil, err
+	}
+	var violations []string
+	if policy.MaxValidity > 0 {
+		if cert.ValidBefore == ssh.CertTimeInfinity {
+			violations = append(violations, "ssh cert never expires")
+		} else {
+			validity := time.Duration(cert.ValidBefore-cert.ValidAfter) * time.Second
+			if validity > policy.MaxValidity {
+				violations = append(violations, fmt.Sprintf("ssh cert is valid for %s, more than %s",
+					validity, policy.MaxValidity))
+			}
+		}
+	}
+	principals := make(map[string]bool)
+	for _, principal := range cert.ValidPrincipals {
+		principals[principal] = true
+	}
+	for _, required := range policy.RequiredPrincipals {
+		if !principals[required] {
+			violations = append(violations, fmt.Sprintf("ssh cert is missing principal '%s'", required))
+		}
+	}
+	for _, forbidden := range policy.ForbiddenExtensions {
+		if _, ok := cert.Permissions.Extensions[forbidden]; ok {
+			violations = append(violations, fmt.Sprintf("ssh cert has forbidden extension '%s'", forbidden))
+		}
+	}
+	return violations, nil
+}
+
+// checkX509Cert returns the policy violations of the x509 cert, only the
+// validity applies as the other rules are ssh specific.
+func (policy *certPolicy) checkX509Cert(pemCert []byte) ([]string, error) {
+	block, _ := pem.Decode(pemCert)
+	if block == nil {
+		return nil, errors.New("cannot decode x509 cert")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	var violations []string
+	validity := cert.NotAfter.Sub(cert.NotBefore)
+	if policy.MaxValidity > 0 && validity > policy.MaxValidity {
+		violations = append(violations, fmt.Sprintf("x509 cert is valid for %s, more than %s",
+			validity, policy.MaxValidity))
+	}
+	return violations, nil
+}
+
+// check returns an error listing every policy violation of material.
+func (policy *certPolicy) check(material certMaterial) error {
+	var violations []string
+	if material.SSHCert != nil {
+		sshViolations, err := policy.checkSSHCert(material.SSHCert)
+		if err != nil {
+			return err
+		}
+		violations = append(violations, sshViolations...)
+	}
+	if material.X509Cert != nil {
+		x509Violations, err := policy.checkX509Cert(material.X509Cert)
+		if err != nil {
+			return err
+		}
+		violations = append(violations, x509Violations...)
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("issued certs violate the policy: %s", strings.Join(violations, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func genPolicyTestSSHCert(t *testing.T, validity time.Duration, principals []string, extensions map[string]string) []byte {
+	caKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caSigner, err := ssh.NewSignerFromSigner(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             caSigner.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Unix()),
+		ValidBefore:     uint64(now.Add(validity).Unix()),
+		Permissions:     ssh.Permissions{Extensions: extensions},
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatal(err)
+	}
+	return ssh.MarshalAuthorizedKey(cert)
+}
+
+func TestLoadCertPolicy(t *testing.T) {
+	tmpfile, err := createTempFileWithStringContent("test_policy",
+		"max_validity: 24h\nrequired_principals: [username]\nforbidden_extensions: [permit-agent-forwarding]\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+	policy, err := loadCertPolicy(tmpfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.MaxValidity != 24*time.Hour || len(policy.RequiredPrincipals) != 1 ||
+		len(policy.ForbiddenExtensions) != 1 {
+		t.Fatalf("unexpected policy %+v", policy)
+	}
+
+	invalidFile, err := createTempFileWithStringContent("test_policy", "max_validty: 24h\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(invalidFile.Name())
+	invalidFile.Close()
+	if _, err := loadCertPolicy(invalidFile.Name()); err == nil {
+		t.Fatal("unknown policy rules should be rejected")
+	}
+}
+
+func TestCertPolicyCheck(t *testing.T) {
+	policy := &certPolicy{
+		MaxValidity:         24 * time.Hour,
+		RequiredPrincipals:  []string{"username"},
+		ForbiddenExtensions: []string{"permit-agent-forwarding"},
+	}
+	valid := genPolicyTestSSHCert(t, time.Hour, []string{"username"},
+		map[string]string{"permit-pty": ""})
+	if err := policy.check(certMaterial{SSHCert: valid}); err != nil {
+		t.Fatal(err)
+	}
+	invalid := genPolicyTestSSHCert(t, 48*time.Hour, []string{"other"},
+		map[string]string{"permit-agent-forwarding": ""})
+	err := policy.check(certMaterial{SSHCert: invalid})
+	if err == nil {
+		t.Fatal("the cert should violate the policy")
+	}
+	for _, expected := range []string{"valid for 48h0m0s", "principal 'username'", "'permit-agent-forwarding'"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected '%s' in '%s'", expected, err)
+		}
+	}
+}
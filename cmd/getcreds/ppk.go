@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"math/big"
+	"strings"
+)
+
+const ppkLineLength = 64
+
+// ppkPrivateBlob encodes the private part of a PuTTY key, only RSA and
+// ECDSA keys being supported.
+func ppkPrivateBlob(privateKey crypto.Signer) ([]byte, error) {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		if len(key.Primes) != 2 {
+			return nil, errors.New("multi-prime RSA keys cannot be exported to PuTTY")
+		}
+		key.Precompute()
+		return ssh.Marshal(struct {
+			D, P, Q, Iqmp *big.Int
+		}{key.D, key.Primes[0], key.Primes[1], key.Precomputed.Qinv}), nil
+	case *ecdsa.PrivateKey:
+		return ssh.Marshal(struct{ D *big.Int }{key.D}), nil
+	}
+	return nil, fmt.Errorf("%T keys cannot be exported to PuTTY", privateKey)
+}
+
+// encodePPK encodes the key with its ssh cert as an unencrypted version 3
+// PuTTY key file, which PuTTY 0.78 and later load with the cert.
+func encodePPK(privateKey crypto.Signer, cert *ssh.Certificate) ([]byte, error) {
+	privateBlob, err := ppkPrivateBlob(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	algorithm := cert.Type()
+	publicBlob := cert.Marshal()
+	comment := cert.KeyId
+	// Unencrypted files are authenticated with an empty MAC key
+	mac := hmac.New(sha256.New, nil)
+	mac.Write(ssh.Marshal(struct {
+		Algorithm, Encryption, Comment string
+		Public, Private                []byte
+	}{algorithm, "none", comment, publicBlob, privateBlob}))
+	var ppk strings.Builder
+	fmt.Fprintf(&ppk, "PuTTY-User-Key-File-3: %s\n", algorithm)
+	fmt.Fprintf(&ppk, "Encryption: none\n")
+	fmt.Fprintf(&ppk, "Comment: %s\n", comment)
+	writePPKLines(&ppk, "Public-Lines", publicBlob)
+	writePPKLines(&ppk, "Private-Lines", privateBlob)
+	fmt.Fprintf(&ppk, "Private-MAC: %s\n", hex.EncodeToString(mac.Sum(nil)))
+	return []byte(ppk.String()), nil
+}
+
+func writePPKLines(ppk *strings.Builder, header string, blob []byte) {
+	encoded := base64.StdEncoding.EncodeToString(blob)
+	var lines []string
+	for len(encoded) > ppkLineLength {
+		lines = append(lines, encoded[:ppkLineLength])
+		encoded = encoded[ppkLineLength:]
+	}
+	lines = append(lines, encoded)
+	fmt.Fprintf(ppk, "%s: %d\n", header, len(lines))
+	for _, line := range lines {
+		ppk.WriteString(line + "\n")
+	}
+}
+
+// ppkPersister implements --ppk-out, writing the key and ssh cert as a
+// PuTTY key file for Windows users. Pageant loads it as any other key.
+func ppkPersister(path string, privateKey crypto.Signer) persistFunc {
+	return func(material certMaterial) error {
+		if material.SSHCert == nil {
+			return errors.New("no ssh cert to write")
+		}
+		cert, err := parseSSHCert(material.SSHCert)
+		if err != nil {
+			return err
+		}
+		ppk, err := encodePPK(privateKey, cert)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(path, ppk, 0600)
+	}
+}
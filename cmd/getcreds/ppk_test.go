@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"strings"
+	"testing"
+)
+
+func TestEncodePPK(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(privateKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	caSigner, err := ssh.NewSignerFromSigner(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{Key: pub, KeyId: "username", CertType: ssh.UserCert,
+		ValidBefore: ssh.CertTimeInfinity}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatal(err)
+	}
+	ppk, err := encodePPK(privateKey, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(ppk)), "\n")
+	if lines[0] != "PuTTY-User-Key-File-3: ecdsa-sha2-nistp256-cert-v01@openssh.com" {
+		t.Fatalf("unexpected header '%s'", lines[0])
+	}
+	publicBlob, err := base64.StdEncoding.DecodeString(strings.Join(lines[4:4+ppkPublicLines(t, lines[3])], ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(publicBlob) != string(cert.Marshal()) {
+		t.Fatal("public lines should hold the ssh cert")
+	}
+	privateBlob, _ := ppkPrivateBlob(privateKey)
+	mac := hmac.New(sha256.New, nil)
+	mac.Write(ssh.Marshal(struct {
+		Algorithm, Encryption, Comment string
+		Public, Private                []byte
+	}{cert.Type(), "none", cert.KeyId, publicBlob, privateBlob}))
+	if lines[len(lines)-1] != "Private-MAC: "+hex.EncodeToString(mac.Sum(nil)) {
+		t.Fatalf("unexpected mac line '%s'", lines[len(lines)-1])
+	}
+
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encodePPK(ed25519Key, cert); err == nil {
+		t.Fatal("should have refused an Ed25519 key")
+	}
+}
+
+func ppkPublicLines(t *testing.T, header string) int {
+	var count int
+	if _, err := fmt.Sscanf(header, "Public-Lines: %d", &count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Symantec/keymaster/lib/webapi/v0/proto"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Servers older than this do not implement the client facing api we use.
+const minServerVersion = "0.3.0"
+
+func getVersionResponse(client *http.Client, baseUrl string) (proto.VersionResponse, error) {
+	var versionResponse proto.VersionResponse
+	resp, err := client.Get(baseUrl + proto.VersionPath)
+	if err != nil {
+		return versionResponse, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return versionResponse, fmt.Errorf("got error from version call %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&versionResponse)
+	if err != nil {
+		return versionResponse, err
+	}
+	// drain the body so that the connection can be reused for the login
+	io.Copy(ioutil.Discard, resp.Body)
+	return versionResponse, nil
+}
+
+func getServerVersion(client *http.Client, baseUrl string) (string, error) {
+	versionResponse, err := getVersionResponse(client, baseUrl)
+	return versionResponse.Version, err
+}
+
+// parseVersion parses a dotted numeric version such as "0.3.2".
+func parseVersion(version string) ([]int, error) {
+	var parts []int
+	for _, field := range strings.Split(strings.TrimPrefix(version, "v"), ".") {
+		value, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version '%s'", version)
+		}
+		parts = append(parts, value)
+	}
+	return parts, nil
+}
+
+// compareVersions returns -1, 0 or 1 depending on a being older, equal or
+// newer than b.
+func compareVersions(a, b string) (int, error) {
+	aParts, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	bParts, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aValue, bValue int
+		if i < len(aParts) {
+			aValue = aParts[i]
+		}
+		if i < len(bParts) {
+			bValue = bParts[i]
+		}
+		if aValue < bValue {
+			return -1, nil
+		}
+		if aValue > bValue {
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// checkServerVersion queries the server version and warns when it is known
+// to be incompatible with this client. Older servers do not expose their
+// version, so failures are only reported when debugging.
+func checkServerVersion(client *http.Client, baseUrl string) {
+	serverVersion, err := getServerVersion(client, baseUrl)
+	if err != nil {
+		if *debug {
+			log.Printf("cannot get server version: %s", err)
+		}
+		return
+	}
+	log.Printf("server '%s' version %s", baseUrl, serverVersion)
+	if older, err := compareVersions(serverVersion, minServerVersion); err == nil && older < 0 {
+		log.Printf("WARNING: server version %s is older than the minimum supported %s",
+			serverVersion, minServerVersion)
+	}
+	serverParts, err := parseVersion(serverVersion)
+	if err != nil {
+		return
+	}
+	clientParts, err := parseVersion(Version)
+	if err != nil {
+		return
+	}
+	if serverParts[0] != clientParts[0] {
+		log.Printf("WARNING: client version %s and server version %s have different major versions",
+			Version, serverVersion)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"0.3.2", "0.3.2", 0},
+		{"0.3", "0.3.0", 0},
+		{"0.2.9", "0.3.0", -1},
+		{"v1.0.0", "0.9.12", 1},
+		{"0.10.0", "0.9.0", 1},
+	}
+	for _, test := range tests {
+		result, err := compareVersions(test.a, test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != test.expected {
+			t.Fatalf("compare(%s, %s): expected %d got %d", test.a, test.b, test.expected, result)
+		}
+	}
+}
+
+func TestCompareVersionsFailNotAVersion(t *testing.T) {
+	_, err := compareVersions("No version provided", "0.3.0")
+	if err == nil {
+		t.Fatal("Should have failed to parse version")
+	}
+}
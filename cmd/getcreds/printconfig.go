@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"gopkg.in/yaml.v2"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const redactedValue = "REDACTED"
+
+// Environment variables that change how the client behaves.
+var configEnvVariables = []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "SSH_AUTH_SOCK",
+	"VAULT_ADDR", "VAULT_TOKEN", "VAULT_CACERT"}
+
+// Where an effective config value came from.
+const (
+	sourceDefault     = "default"
+	sourceConfigFile  = "config file"
+	sourceEnvironment = "environment"
+	sourceFlag        = "flag"
+	sourceSRVRecord   = "srv record"
+)
+
+// configValue is an effective value annotated with its source, so that
+// the layer to fix is obvious when a value is unexpected.
+type configValue struct {
+	Value  string `yaml:"value"`
+	Source string `yaml:"source"`
+}
+
+type effectiveEndpoint struct {
+	endpointConfig `yaml:",inline"`
+	Source         string `yaml:"source"`
+}
+
+type effectiveConfig struct {
+	ConfigFile  string                 `yaml:"config_file"`
+	Endpoints   []effectiveEndpoint    `yaml:"endpoints"`
+	Settings    map[string]configValue `yaml:"settings"`
+	Flags       map[string]configValue `yaml:"flags"`
+	Environment map[string]configValue `yaml:"environment,omitempty"`
+}
+
+// configFileValue annotates a config file setting, using defaultValue when
+// it is not set.
+func configFileValue(value string, defaultValue string) configValue {
+	if len(value) < 1 {
+		return configValue{Value: defaultValue, Source: sourceDefault}
+	}
+	return configValue{Value: value, Source: sourceConfigFile}
+}
+
+// setFlagNames returns the flags given on the command line, the others
+// having their default value.
+func setFlagNames() map[string]bool {
+	names := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		names[f.Name] = true
+	})
+	return names
+}
+
+// redactURL hides the password of urls carrying credentials.
+func redactURL(value string) string {
+	parsedURL, err := url.Parse(value)
+	if err != nil || parsedURL.User == nil {
+		return value
+	}
+	if _, hasPassword := parsedURL.User.Password(); hasPassword {
+		parsedURL.User = url.UserPassword(parsedURL.User.Username(), redactedValue)
+	}
+	return parsedURL.String()
+}
+
+func isSecretName(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range []string{"password", "secret", "token"} {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// printEffectiveConfig implements --print-config, writing the config the
+// client will use after merging the config file, the environment and the
+// flags, with the source of each value and the secrets redacted.
+func printEffectiveConfig(out io.Writer, configPath string, config AppConfigFile, endpoints []endpointConfig) error {
+	effective := effectiveConfig{
+		ConfigFile: configPath,
+		Settings: map[string]configValue{
+			"login_method":            configFileValue(config.Base.LoginMethod, "POST"),
+			"certgen_method":          configFileValue(config.Base.CertgenMethod, "POST"),
+			"srv_record":              configFileValue(config.Base.SRVRecord, ""),
+			"randomize_equal_weights": {Value: "false", Source: sourceDefault},
+		},
+		Flags:       make(map[string]configValue),
+		Environment: make(map[string]configValue),
+	}
+	if config.Base.RandomizeEqualWeights {
+		effective.Settings["randomize_equal_weights"] = configValue{Value: "true", Source: sourceConfigFile}
+	}
+	configured := make(map[string]bool)
+	for _, endpoint := range getEndpoints(config) {
+		configured[endpoint.URL] = true
+	}
+	for _, endpoint := range endpoints {
+		source := sourceConfigFile
+		if !configured[endpoint.URL] {
+			source = sourceSRVRecord + " " + config.Base.SRVRecord
+		}
+		endpoint.URL = redactURL(endpoint.URL)
+		effective.Endpoints = append(effective.Endpoints, effectiveEndpoint{endpoint, source})
+	}
+	setFlags := setFlagNames()
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if isSecretName(f.Name) && len(value) > 0 {
+			value = redactedValue
+		}
+		source := sourceDefault
+		if setFlags[f.Name] {
+			source = sourceFlag
+		}
+		effective.Flags[f.Name] = configValue{Value: redactURL(value), Source: source}
+	})
+	for _, name := range configEnvVariables {
+		if value := os.Getenv(name); len(value) > 0 {
+			if isSecretName(name) {
+				value = redactedValue
+			}
+			effective.Environment[name] = configValue{Value: redactURL(value), Source: sourceEnvironment}
+		}
+	}
+	output, err := yaml.Marshal(effective)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(output)
+	return err
+}
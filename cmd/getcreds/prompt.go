@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Longest server provided prompt displayed, the rest is dropped.
+const maxPromptLength = 100
+
+// Longest wait for the prompt hint, the default prompt being shown when
+// the server is slower so that the prompt never lags.
+const promptHintTimeout = 500 * time.Millisecond
+
+// sanitizePrompt keeps server provided prompts from moving the cursor or
+// changing the terminal, and ends them with a space before the input.
+func sanitizePrompt(prompt string) string {
+	var text []rune
+	for _, r := range strings.TrimSpace(prompt) {
+		if !unicode.IsPrint(r) {
+			continue
+		}
+		if len(text) >= maxPromptLength {
+			break
+		}
+		text = append(text, r)
+	}
+	if len(text) < 1 {
+		return ""
+	}
+	return string(text) + " "
+}
+
+// passwordPrompt returns --prompt, or the prompt hinted by the first
+// endpoint such as "Enter your PIN+OTP:", or the default prompt.
+func passwordPrompt(userName string, endpoints []endpointConfig, rootCAs *x509.CertPool) string {
+	if len(*promptText) > 0 {
+		return *promptText
+	}
+	if len(endpoints) > 0 {
+		prompt, err := getServerPrompt(endpoints[0], rootCAs)
+		if err != nil && *debug {
+			log.Printf("cannot get the prompt hint from %s: %s", endpoints[0].URL, err)
+		}
+		if prompt = sanitizePrompt(prompt); len(prompt) > 0 {
+			return prompt
+		}
+	}
+	return fmt.Sprintf("Password for %s: ", userName)
+}
+
+func getServerPrompt(endpoint endpointConfig, rootCAs *x509.CertPool) (string, error) {
+	client, err := newEndpointHTTPClient(endpoint, rootCAs)
+	if err != nil {
+		return "", err
+	}
+	client.Timeout = promptHintTimeout
+	versionResponse, err := getVersionResponse(client, endpoint.URL)
+	return versionResponse.PasswordPrompt, err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSanitizePrompt(t *testing.T) {
+	tests := map[string]string{
+		"Enter your PIN+OTP:": "Enter your PIN+OTP: ",
+		"  Passphrase:\n":     "Passphrase: ",
+		"PIN\x1b[2J:":         "PIN[2J: ",
+		"":                    "",
+		"\x07":                "",
+	}
+	for prompt, expected := range tests {
+		if sanitized := sanitizePrompt(prompt); sanitized != expected {
+			t.Fatalf("expected %q for %q, got %q", expected, prompt, sanitized)
+		}
+	}
+}
+
+func TestPasswordPrompt(t *testing.T) {
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	endpoints := []endpointConfig{{URL: fake.URL}}
+	if prompt := passwordPrompt("username", endpoints, fake.RootCAs()); prompt != "Password for username: " {
+		t.Fatalf("expected the default prompt, got %q", prompt)
+	}
+	fake.PasswordPrompt = "Enter your PIN+OTP:"
+	if prompt := passwordPrompt("username", endpoints, fake.RootCAs()); prompt != "Enter your PIN+OTP: " {
+		t.Fatalf("expected the server hint, got %q", prompt)
+	}
+	*promptText = "Passphrase: "
+	defer func() { *promptText = "" }()
+	if prompt := passwordPrompt("username", endpoints, fake.RootCAs()); prompt != "Passphrase: " {
+		t.Fatalf("expected the --prompt text, got %q", prompt)
+	}
+}
+
+func TestPasswordPromptSlowServer(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(slow.Certificate())
+	start := time.Now()
+	prompt := passwordPrompt("username", []endpointConfig{{URL: slow.URL}}, rootCAs)
+	if prompt != "Password for username: " {
+		t.Fatalf("expected the default prompt, got %q", prompt)
+	}
+	if elapsed := time.Since(start); elapsed > 2*promptHintTimeout {
+		t.Fatalf("the prompt waited %s for the server", elapsed)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/Symantec/keymaster/lib/webapi/v0/proto"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// provisionUsersCommand implements the provision-users command, letting a
+// delegation admin log in once and get certs for a list of users, each
+// with a new key written to its own directory of the output directory.
+func provisionUsersCommand(args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: provision-users <output dir> <user>...")
+	}
+	outputDir, users := args[0], args[1:]
+	if err := validateOnExisting(*onExisting); err != nil {
+		return err
+	}
+	for _, target := range users {
+		if err := validateForUser(target); err != nil {
+			return err
+		}
+	}
+	config, err := loadVerifyConfigFile(*configFilename)
+	if err != nil {
+		return err
+	}
+	setRequestMethods(config)
+	setUserPreferences(config)
+	rootCAs, err := caFileRootCAs()
+	if err != nil {
+		return err
+	}
+	endpoints, err := resolveOrderedEndpoints(config)
+	if err != nil {
+		return err
+	}
+	usr, password, err := getRunUserAndCreds(endpoints, rootCAs)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := newTLSConfig(rootCAs)
+	if err != nil {
+		return err
+	}
+	defaultClient, err := newHTTPClient(tlsConfig)
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range endpoints {
+		client, err := endpointClient(endpoint, defaultClient, rootCAs)
+		if err != nil {
+			log.Printf("cannot setup TLS for '%s': %s", endpoint.URL, err)
+			continue
+		}
+		if err := loginOrRefresh(client, usr.Username, password, endpoint.URL, false); err != nil {
+			log.Printf("cannot login to '%s': %s", endpoint.URL, err)
+			continue
+		}
+		rememberPassword(usr.Username, password.password)
+		return provisionUsers(client, endpoint.URL, usr.Username, outputDir, users)
+	}
+	return errors.New("cannot login to any url")
+}
+
+// provisionUsers gets the certs of every user with the session of
+// adminUser, carrying on after a failed user so that one bad entry does
+// not stop the batch.
+func provisionUsers(client *http.Client, baseUrl string, adminUser string, outputDir string, users []string) error {
+	var failed []string
+	for _, target := range users {
+		userDir := filepath.Join(outputDir, target)
+		written, err := provisionUser(client, baseUrl, adminUser, userDir, target)
+		if err != nil {
+			log.Printf("cannot provision %s: %s", target, err)
+			failed = append(failed, target)
+			continue
+		}
+		if !written {
+			continue
+		}
+		log.Printf("provisioned %s in %s", target, userDir)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to provision %d of %d users: %s", len(failed), len(users),
+			strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// provisionUser writes a new key and its certs to userDir, honoring
+// --on-existing for the files of a previous run: the certs are obtained
+// before anything is replaced, and the previous files restored when the
+// new ones cannot be written. It returns false when the user is skipped.
+func provisionUser(client *http.Client, baseUrl string, adminUser string, userDir string, target string) (bool, error) {
+	if err := os.MkdirAll(userDir, 0700); err != nil {
+		return false, err
+	}
+	privateKeyPath := keyFilePath(userDir, FilePrefix)
+	existing := existingPaths([]string{privateKeyPath, publicKeyPath(privateKeyPath),
+		privateKeyPath + "-cert.pub", x509CertPath(privateKeyPath)})
+	proceed, err := checkOnExisting(*onExisting, existing)
+	if !proceed {
+		return false, err
+	}
+	signer, pemKey, err := newKeyPair(rand.Reader)
+	if err != nil {
+		return false, err
+	}
+	params := url.Values{}
+	params.Set(proto.DelegatedByParam, adminUser)
+	failures := make(map[string]error)
+	material, err := getCertsForKey(client, signer.Public(), target, baseUrl, params, false, failures)
+	if err == nil && len(failures) > 0 {
+		err = &partialCertsError{failures: failures}
+	}
+	if err != nil {
+		return false, err
+	}
+	backups, err := backupExisting(*onExisting, existing)
+	if err != nil {
+		return false, err
+	}
+	_, _, err = writeKeyPair(privateKeyPath, signer, pemKey)
+	if err == nil {
+		err = filePersister(privateKeyPath)(material)
+	}
+	if err != nil {
+		if len(existing) < 1 {
+			removeKeyPair(privateKeyPath)
+		}
+		restoreBackups(backups)
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProvisionUsers(t *testing.T) {
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	fake.DelegationAdmins = []string{"username"}
+	dir, err := ioutil.TempDir("", "keymaster-provision")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client, err := newHTTPClient(&tls.Config{RootCAs: fake.RootCAs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loginOrRefresh(client, "username", knownPassword([]byte("password")), fake.URL, false); err != nil {
+		t.Fatal(err)
+	}
+	users := []string{"alice", "bob"}
+	if err := provisionUsers(client, fake.URL, "username", dir, users); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range users {
+		privateKeyPath := keyFilePath(filepath.Join(dir, target), FilePrefix)
+		sshCert, err := ioutil.ReadFile(privateKeyPath + "-cert.pub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := parseSSHCert(sshCert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cert.ValidPrincipals) != 1 || cert.ValidPrincipals[0] != target {
+			t.Fatalf("expected a cert for %s, got %v", target, cert.ValidPrincipals)
+		}
+		if _, err := os.Stat(privateKeyPath); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	alicePath := keyFilePath(filepath.Join(dir, "alice"), FilePrefix)
+	previousKey, err := ioutil.ReadFile(alicePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { *onExisting = onExistingBackup }()
+	*onExisting = onExistingSkip
+	if err := provisionUsers(client, fake.URL, "username", dir, []string{"alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := ioutil.ReadFile(alicePath); err != nil || string(key) != string(previousKey) {
+		t.Fatal("the key of a skipped user should have been kept")
+	}
+	if _, err := os.Stat(alicePath + backupSuffix); !os.IsNotExist(err) {
+		t.Fatal("nothing should be backed up when skipping")
+	}
+	*onExisting = onExistingFail
+	if err := provisionUsers(client, fake.URL, "username", dir, []string{"alice"}); err == nil {
+		t.Fatal("should have failed on the existing files")
+	}
+	*onExisting = onExistingBackup
+	if err := provisionUsers(client, fake.URL, "username", dir, []string{"alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if backup, err := ioutil.ReadFile(alicePath + backupSuffix); err != nil || string(backup) != string(previousKey) {
+		t.Fatal("the previous key should have been backed up")
+	}
+	if _, err := os.Stat(alicePath + "-cert.pub" + backupSuffix); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.DelegationAdmins = nil
+	if err := provisionUsers(client, fake.URL, "username", dir, []string{"carol"}); err == nil {
+		t.Fatal("should have failed without the delegation")
+	}
+	if _, err := os.Stat(keyFilePath(filepath.Join(dir, "carol"), FilePrefix)); !os.IsNotExist(err) {
+		t.Fatal("the key of a failed user should have been removed")
+	}
+}
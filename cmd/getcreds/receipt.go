@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"strconv"
+	"time"
+)
+
+// receipt is the --receipt-out file, the facts of the latest issuance for
+// other tools to read without parsing the certs. It is replaced on every
+// run, unlike an append only log.
+type receipt struct {
+	IssuedAt time.Time     `json:"issued_at"`
+	UserName string        `json:"user_name"`
+	Endpoint string        `json:"endpoint"`
+	Partial  bool          `json:"partial,omitempty"`
+	Certs    []certReceipt `json:"certs"`
+	// TLS negotiated with the endpoint, to audit the client connections.
+	TLSVersion     string `json:"tls_version,omitempty"`
+	TLSCipherSuite string `json:"tls_cipher_suite,omitempty"`
+}
+
+type certReceipt struct {
+	Type string `json:"type"`
+	// Empty when the cert was not written to a file
+	Path string `json:"path,omitempty"`
+	// SHA256 of the encoded cert
+	Fingerprint string    `json:"fingerprint"`
+	Serial      string    `json:"serial"`
+	KeyID       string    `json:"key_id,omitempty"`
+	ValidAfter  time.Time `json:"valid_after"`
+	ValidBefore time.Time `json:"valid_before"`
+}
+
+func sshCertReceipt(certBytes []byte, path string) (certReceipt, error) {
+	cert, err := parseSSHCert(certBytes)
+	if err != nil {
+		return certReceipt{}, err
+	}
+	fingerprint := sha256.Sum256(cert.Marshal())
+	validBefore := time.Unix(1<<62, 0).UTC()
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		validBefore = time.Unix(int64(cert.ValidBefore), 0).UTC()
+	}
+	return certReceipt{
+		Type:        "ssh",
+		Path:        path,
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+		Serial:      strconv.FormatUint(cert.Serial, 10),
+		KeyID:       cert.KeyId,
+		ValidAfter:  time.Unix(int64(cert.ValidAfter), 0).UTC(),
+		ValidBefore: validBefore,
+	}, nil
+}
+
+func x509CertReceipt(pemCert []byte, path string) (certReceipt, error) {
+	block, _ := pem.Decode(pemCert)
+	if block == nil {
+		return certReceipt{}, errors.New("cannot decode x509 cert")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return certReceipt{}, err
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	return certReceipt{
+		Type:        "x509",
+		Path:        path,
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+		Serial:      cert.SerialNumber.String(),
+		ValidAfter:  cert.NotBefore.UTC(),
+		ValidBefore: cert.NotAfter.UTC(),
+	}, nil
+}
+
+// newReceipt describes materials, keyPaths holding the private key path
+// of each material or an empty string when not written to files.
+func newReceipt(userName string, materials []certMaterial, keyPaths []string, partial bool, now time.Time) (*receipt, error) {
+	result := &receipt{IssuedAt: now.UTC(), UserName: userName, Partial: partial}
+	for i, material := range materials {
+		if len(material.Endpoint) > 0 {
+			result.Endpoint = material.Endpoint
+			result.TLSVersion = material.TLSVersion
+			result.TLSCipherSuite = material.TLSCipherSuite
+		}
+		var sshPath, x509Path string
+		if len(keyPaths[i]) > 0 {
+			sshPath = material.SSHInstructions.certPath(keyPaths[i], keyPaths[i]+"-cert.pub")
+			x509Path = material.X509Instructions.certPath(keyPaths[i], x509CertPath(keyPaths[i]))
+		}
+		if material.SSHCert != nil {
+			certReceipt, err := sshCertReceipt(material.SSHCert, sshPath)
+			if err != nil {
+				return nil, err
+			}
+			result.Certs = append(result.Certs, certReceipt)
+		}
+		if material.X509Cert != nil {
+			certReceipt, err := x509CertReceipt(material.X509Cert, x509Path)
+			if err != nil {
+				return nil, err
+			}
+			result.Certs = append(result.Certs, certReceipt)
+		}
+	}
+	return result, nil
+}
+
+// writeReceipt replaces the receipt at path atomically so that readers
+// never see a partial file.
+func writeReceipt(path string, result *receipt) error {
+	content, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(content, '\n'), 0644, ".keymaster-receipt-")
+}
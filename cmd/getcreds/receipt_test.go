@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteReceipt(t *testing.T) {
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshCert, x509Cert, err := getCertFromTargetUrls(privateKey, "username", []byte("password"),
+		[]string{fake.URL}, fake.RootCAs(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "keymaster-receipt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	privateKeyPath := filepath.Join(dir, "keymaster")
+	materials := []certMaterial{{SSHCert: sshCert, X509Cert: x509Cert, Endpoint: fake.URL}}
+	now := time.Now()
+	result, err := newReceipt("username", materials, []string{privateKeyPath}, false, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiptPath := filepath.Join(dir, "receipt.json")
+	if err := writeReceipt(receiptPath, result); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(receiptPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written receipt
+	if err := json.Unmarshal(content, &written); err != nil {
+		t.Fatal(err)
+	}
+	if written.Endpoint != fake.URL || written.UserName != "username" || len(written.Certs) != 2 {
+		t.Fatalf("unexpected receipt %s", content)
+	}
+	sshReceipt, x509Receipt := written.Certs[0], written.Certs[1]
+	if sshReceipt.Type != "ssh" || sshReceipt.Path != privateKeyPath+"-cert.pub" ||
+		len(sshReceipt.Fingerprint) != 64 || !sshReceipt.ValidBefore.After(now) {
+		t.Fatalf("unexpected ssh cert receipt %+v", sshReceipt)
+	}
+	if x509Receipt.Type != "x509" || x509Receipt.Path != x509CertPath(privateKeyPath) ||
+		len(x509Receipt.Serial) < 1 || !x509Receipt.ValidBefore.After(now) {
+		t.Fatalf("unexpected x509 cert receipt %+v", x509Receipt)
+	}
+}
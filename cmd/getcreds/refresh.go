@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Symantec/keymaster/lib/webapi/v0/proto"
+	"github.com/zalando/go-keyring"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// refreshToken is a server issued token exchanged for a new session
+// without the password and 2FA. It is kept in the OS keyring, which
+// stores it encrypted, under one entry per server.
+type refreshToken struct {
+	UserName string    `json:"user_name"`
+	Token    string    `json:"token"`
+	Expires  time.Time `json:"expires"`
+}
+
+var errNoRefreshToken = errors.New("no valid refresh token")
+
+func refreshTokenAccount(baseUrl string) string {
+	return "refresh-token " + baseUrl
+}
+
+// loadRefreshToken returns the token stored for userName on baseUrl, nil
+// when there is none or it expired.
+func loadRefreshToken(userName string, baseUrl string, now time.Time) *refreshToken {
+	content, err := keyring.Get(*keyringService, refreshTokenAccount(baseUrl))
+	if err != nil {
+		return nil
+	}
+	var token refreshToken
+	if err := json.Unmarshal([]byte(content), &token); err != nil {
+		return nil
+	}
+	if token.UserName != userName || len(token.Token) < 1 || !now.Before(token.Expires) {
+		return nil
+	}
+	return &token
+}
+
+// saveRefreshToken stores the token the server returned in header after a
+// successful 2FA, if any. Tokens without a valid expiry are not kept.
+func saveRefreshToken(userName string, baseUrl string, header http.Header) error {
+	value := header.Get(proto.RefreshTokenHeader)
+	if len(value) < 1 {
+		return nil
+	}
+	expires, err := time.Parse(time.RFC3339, header.Get(proto.RefreshTokenExpiresHeader))
+	if err != nil {
+		return fmt.Errorf("invalid refresh token expiry: %s", err)
+	}
+	content, err := json.Marshal(refreshToken{UserName: userName, Token: value, Expires: expires})
+	if err != nil {
+		return err
+	}
+	if err := keyring.Set(*keyringService, refreshTokenAccount(baseUrl), string(content)); err != nil {
+		return err
+	}
+	if *debug {
+		log.Printf("stored refresh token for %s valid until %s", baseUrl, expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func deleteRefreshToken(baseUrl string) {
+	keyring.Delete(*keyringService, refreshTokenAccount(baseUrl))
+}
+
+// refreshSession implements --refresh-token, exchanging the stored token
+// for session cookies in the client jar. The token is sent as the password
+// of a login request, so login_method, login_body and login_success apply.
+// A token rejected by the server is dropped so that the next run does the
+// full login.
+func refreshSession(client *http.Client, userName string, baseUrl string) error {
+	token := loadRefreshToken(userName, baseUrl, time.Now())
+	if token == nil {
+		return errNoRefreshToken
+	}
+	req, err := buildLoginRequest(baseUrl+proto.RefreshPath, userName, []byte(token.Token))
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != loginSuccess.expectedStatusCode() {
+		body := readErrorBody(resp)
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			deleteRefreshToken(baseUrl)
+		}
+		return newStatusError("refresh", resp, body)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := loginSuccess.checkLoginSuccess(resp, body); err != nil {
+		return fmt.Errorf("refresh token rejected: %s", err)
+	}
+	log.Printf("reused the session of the refresh token, valid until %s",
+		token.Expires.Format(time.RFC3339))
+	return nil
+}
+
+// lazyPassword is the password of a run, read the first time a login
+// needs it so that a run getting a session with its refresh token never
+// prompts for it.
+type lazyPassword struct {
+	read     func() ([]byte, error)
+	password []byte
+	err      error
+	done     bool
+}
+
+// knownPassword returns the lazyPassword of an already read password.
+func knownPassword(password []byte) *lazyPassword {
+	return &lazyPassword{password: password, done: true}
+}
+
+func (p *lazyPassword) get() ([]byte, error) {
+	if !p.done {
+		p.password, p.err = p.read()
+		p.done = true
+	}
+	return p.password, p.err
+}
+
+// loginOrRefresh logs into baseUrl, first trying the refresh token with
+// --refresh-token and falling back to the password and 2FA.
+func loginOrRefresh(client *http.Client, userName string, password *lazyPassword, baseUrl string, skipu2f bool) error {
+	if *mtlsOnly {
+		// The client cert authenticates every request
+		return nil
+	}
+	if *useRefreshToken {
+		err := refreshSession(client, userName, baseUrl)
+		if err == nil {
+			return nil
+		}
+		if *debug || err != errNoRefreshToken {
+			log.Printf("doing a full login: %s", err)
+		}
+	}
+	passwordValue, err := password.get()
+	if err != nil {
+		return err
+	}
+	return retryStep("login", *loginRetries, func() error {
+		return loginToServer(client, userName, passwordValue, baseUrl, skipu2f)
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"github.com/Symantec/keymaster/lib/webapi/v0/proto"
+	"github.com/zalando/go-keyring"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSaveLoadRefreshToken(t *testing.T) {
+	keyring.MockInit()
+	now := time.Now()
+	header := http.Header{}
+	if err := saveRefreshToken("username", "https://km.example.com", header); err != nil {
+		t.Fatal(err)
+	}
+	if loadRefreshToken("username", "https://km.example.com", now) != nil {
+		t.Fatal("no token should be stored without the header")
+	}
+	header.Set(proto.RefreshTokenHeader, "token")
+	header.Set(proto.RefreshTokenExpiresHeader, now.Add(time.Hour).Format(time.RFC3339))
+	if err := saveRefreshToken("username", "https://km.example.com", header); err != nil {
+		t.Fatal(err)
+	}
+	token := loadRefreshToken("username", "https://km.example.com", now)
+	if token == nil || token.Token != "token" {
+		t.Fatalf("expected the stored token, got %v", token)
+	}
+	if loadRefreshToken("other", "https://km.example.com", now) != nil {
+		t.Fatal("the token should only be used for its user")
+	}
+	if loadRefreshToken("username", "https://km2.example.com", now) != nil {
+		t.Fatal("the token should only be used for its server")
+	}
+	if loadRefreshToken("username", "https://km.example.com", now.Add(2*time.Hour)) != nil {
+		t.Fatal("an expired token should not be used")
+	}
+}
+
+func TestRefreshSession(t *testing.T) {
+	keyring.MockInit()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != proto.RefreshPath || r.FormValue("password") != "token" {
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: fakeAuthCookieName, Value: "session"})
+	}))
+	defer server.Close()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := server.Client()
+	client.Jar = jar
+	if err := refreshSession(client, "username", server.URL); err != errNoRefreshToken {
+		t.Fatalf("expected no token, got %v", err)
+	}
+	for _, value := range []string{"token", "revoked"} {
+		header := http.Header{}
+		header.Set(proto.RefreshTokenHeader, value)
+		header.Set(proto.RefreshTokenExpiresHeader, time.Now().Add(time.Hour).Format(time.RFC3339))
+		if err := saveRefreshToken("username", server.URL, header); err != nil {
+			t.Fatal(err)
+		}
+		err := refreshSession(client, "username", server.URL)
+		if value == "token" && err != nil {
+			t.Fatal(err)
+		}
+		if value == "revoked" && err == nil {
+			t.Fatal("the revoked token should have been rejected")
+		}
+	}
+	if loadRefreshToken("username", server.URL, time.Now()) != nil {
+		t.Fatal("the rejected token should have been dropped")
+	}
+}
+
+func TestLoginOrRefreshReadsPasswordOnlyWithoutSession(t *testing.T) {
+	keyring.MockInit()
+	*useRefreshToken = true
+	defer func() { *useRefreshToken = false }()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != proto.RefreshPath || r.FormValue("password") != "token" {
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: fakeAuthCookieName, Value: "session"})
+	}))
+	defer server.Close()
+	reads := 0
+	password := &lazyPassword{read: func() ([]byte, error) {
+		reads++
+		return []byte("password"), nil
+	}}
+	header := http.Header{}
+	header.Set(proto.RefreshTokenHeader, "token")
+	header.Set(proto.RefreshTokenExpiresHeader, time.Now().Add(time.Hour).Format(time.RFC3339))
+	if err := saveRefreshToken("username", server.URL, header); err != nil {
+		t.Fatal(err)
+	}
+	if err := loginOrRefresh(server.Client(), "username", password, server.URL, false); err != nil {
+		t.Fatal(err)
+	}
+	if reads != 0 {
+		t.Fatal("the password should not be read when the refresh token gets a session")
+	}
+
+	deleteRefreshToken(server.URL)
+	if err := loginOrRefresh(server.Client(), "username", password, server.URL, false); err == nil {
+		t.Fatal("the login with the password should fail")
+	}
+	if reads != 1 {
+		t.Fatalf("the password should be read once without a refresh token, read %d times", reads)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// resumeState implements --resume. It records the certs obtained by a
+// partially successful run so that the next run only requests the missing
+// ones. Certs are keyed by cert type and public key fingerprint, so they
+// are only reused for the same key.
+type resumeState struct {
+	Certs map[string]string `json:"certs"`
+}
+
+// Loaded by main with --resume, nil otherwise.
+var resumeCerts *resumeState
+
+func resumeStatePath(privateKeyPath string) string {
+	return privateKeyPath + ".resume"
+}
+
+// loadResumeState reads the state left by a previous run, a missing or
+// invalid state file meaning nothing to resume.
+func loadResumeState(path string) *resumeState {
+	state := &resumeState{Certs: make(map[string]string)}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return state
+	}
+	if err := json.Unmarshal(content, state); err != nil {
+		log.Printf("ignoring invalid resume state %s: %s", path, err)
+		return &resumeState{Certs: make(map[string]string)}
+	}
+	if state.Certs == nil {
+		state.Certs = make(map[string]string)
+	}
+	return state
+}
+
+func resumeKey(certType string, pub ssh.PublicKey) string {
+	return certType + " " + ssh.FingerprintSHA256(pub)
+}
+
+func certExpiry(certType string, cert []byte) (time.Time, error) {
+	switch certType {
+	case "ssh":
+		sshCert, err := parseSSHCert(cert)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if sshCert.ValidBefore == ssh.CertTimeInfinity {
+			return time.Unix(1<<62, 0), nil
+		}
+		return time.Unix(int64(sshCert.ValidBefore), 0), nil
+	case "x509":
+		return getX509CertExpiry(cert)
+	}
+	return time.Time{}, errors.New("unknown cert type " + certType)
+}
+
+// lookup returns the recorded cert of certType for pub when it is still
+// valid for at least --min-validity, nil otherwise.
+func (state *resumeState) lookup(certType string, pub ssh.PublicKey, now time.Time) []byte {
+	if state == nil {
+		return nil
+	}
+	cert, ok := state.Certs[resumeKey(certType, pub)]
+	if !ok {
+		return nil
+	}
+	expiry, err := certExpiry(certType, []byte(cert))
+	if err != nil || expiry.Before(now.Add(*minValidity)) {
+		return nil
+	}
+	return []byte(cert)
+}
+
+func (state *resumeState) record(certType string, pub ssh.PublicKey, cert []byte) {
+	if cert != nil {
+		state.Certs[resumeKey(certType, pub)] = string(cert)
+	}
+}
+
+func (state *resumeState) save(path string) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, content, 0600)
+}
+
+// updateResumeState records the certs of a partial run, or removes the
+// state once every cert was obtained.
+func updateResumeState(path string, pubs []ssh.PublicKey, materials []certMaterial, partial bool) error {
+	if !partial {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	state := loadResumeState(path)
+	for i, material := range materials {
+		state.record("ssh", pubs[i], material.SSHCert)
+		state.record("x509", pubs[i], material.X509Cert)
+	}
+	return state.save(path)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResumePartialRunFakeServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster-resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	statePath := resumeStatePath(filepath.Join(dir, "keymaster"))
+	fake := newFakeKeymaster(t)
+	defer fake.Close()
+	privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(privateKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	*allowPartial = true
+	defer func() {
+		*allowPartial = false
+		resumeCerts = nil
+	}()
+
+	fake.FailCertType = "x509"
+	resumeCerts = loadResumeState(statePath)
+	sshCert, x509Cert, err := getCertFromTargetUrls(privateKey, "username", []byte("password"),
+		[]string{fake.URL}, fake.RootCAs(), false)
+	if _, ok := err.(*partialCertsError); !ok {
+		t.Fatalf("expected a partial failure, got %v", err)
+	}
+	err = updateResumeState(statePath, []ssh.PublicKey{pub},
+		[]certMaterial{{SSHCert: sshCert, X509Cert: x509Cert}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake.FailCertType = ""
+	fake.Requests = nil
+	resumeCerts = loadResumeState(statePath)
+	resumedSSHCert, x509Cert, err := getCertFromTargetUrls(privateKey, "username", []byte("password"),
+		[]string{fake.URL}, fake.RootCAs(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resumedSSHCert) != string(sshCert) || x509Cert == nil {
+		t.Fatal("expected the previous ssh cert and a new x509 cert")
+	}
+	for _, r := range fake.Requests {
+		if r.Form.Get("type") == "ssh" {
+			t.Fatal("the ssh cert should not have been requested again")
+		}
+	}
+	err = updateResumeState(statePath, []ssh.PublicKey{pub},
+		[]certMaterial{{SSHCert: resumedSSHCert, X509Cert: x509Cert}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Fatal("the resume state should be removed after a full success")
+	}
+}
+
+func TestResumeStateLookupOtherKey(t *testing.T) {
+	state := &resumeState{Certs: make(map[string]string)}
+	var pubs []ssh.PublicKey
+	for i := 0; i < 2; i++ {
+		privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := ssh.NewPublicKey(privateKey.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubs = append(pubs, pub)
+	}
+	state.record("ssh", pubs[0], []byte("not a cert"))
+	if cert := state.lookup("ssh", pubs[1], time.Now()); cert != nil {
+		t.Fatal("cert of another key should not be reused")
+	}
+	if cert := state.lookup("ssh", pubs[0], time.Now()); cert != nil {
+		t.Fatal("unparsable cert should not be reused")
+	}
+	var nilState *resumeState
+	if cert := nilState.lookup("ssh", pubs[0], time.Now()); cert != nil {
+		t.Fatal("nothing should be reused without --resume")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+// backoffFunc returns how long to wait before the given retry attempt,
+// attempts are numbered starting at 1.
+type backoffFunc func(attempt int) time.Duration
+
+// newBackoff returns the backoff for strategy, never waiting more than
+// maxDelay, or maxRetryDelay when maxDelay is 0.
+func newBackoff(strategy string, base time.Duration, maxDelay time.Duration) (backoffFunc, error) {
+	if base < 0 || maxDelay < 0 {
+		return nil, fmt.Errorf("backoff durations must not be negative")
+	}
+	if maxDelay == 0 {
+		maxDelay = maxRetryDelay
+	}
+	capDelay := func(delay time.Duration) time.Duration {
+		if delay > maxDelay {
+			return maxDelay
+		}
+		return delay
+	}
+	switch strategy {
+	case "constant":
+		return func(attempt int) time.Duration {
+			return capDelay(base)
+		}, nil
+	case "linear":
+		return func(attempt int) time.Duration {
+			if base > 0 && time.Duration(attempt) > maxDelay/base {
+				return maxDelay
+			}
+			return capDelay(base * time.Duration(attempt))
+		}, nil
+	case "exponential":
+		return func(attempt int) time.Duration {
+			delay := base
+			for i := 1; i < attempt && delay < maxDelay; i++ {
+				if delay > maxDelay/2 {
+					return maxDelay
+				}
+				delay *= 2
+			}
+			return capDelay(delay)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown backoff strategy '%s'", strategy)
+}
+
+// Longest wait between attempts, backoff or Retry-After, without
+// --backoff-cap, the key lock being held while waiting.
+const maxRetryDelay = 5 * time.Minute
+
+// capRetryAfter limits the wait asked by a server to --backoff-cap, or
+// maxRetryDelay when there is no cap.
+func capRetryAfter(retryAfter time.Duration) time.Duration {
+	maxDelay := maxRetryDelay
+	if *backoffCap > 0 && *backoffCap < maxDelay {
+		maxDelay = *backoffCap
+	}
+	if retryAfter > maxDelay {
+		return maxDelay
+	}
+	return retryAfter
+}
+
+// retryWithBackoff calls operation until it succeeds or it has been retried
+// maxRetries times, sleeping between attempts as dictated by backoff. A
+// server under maintenance is not retried before the time it asked for.
+// Rejections, such as a bad password that could lock the account, and
+// partial results, whose certs are already issued, are not retried.
+func retryWithBackoff(maxRetries int, backoff backoffFunc, operation func() error) error {
+	err := operation()
+	for attempt := 1; err != nil && attempt <= maxRetries && isRetryableRunError(err); attempt++ {
+		delay := backoff(attempt)
+		if e, ok := err.(*maintenanceError); ok && e.retryAfter > delay {
+			delay = capRetryAfter(e.retryAfter)
+		}
+		log.Printf("attempt failed: %s, retrying in %s (%d/%d)", err, delay, attempt, maxRetries)
+		time.Sleep(delay)
+		err = operation()
+	}
+	return err
+}
+
+// statusError is a non 200 answer to one of the requests of the flow.
+type statusError struct {
+	step   string
+	status string
+	code   int
+	// from error_messages, empty when none matched
+	message string
+}
+
+func (e *statusError) Error() string {
+	if len(e.message) > 0 {
+		return fmt.Sprintf("%s failed: %s: %s", e.step, e.status, e.message)
+	}
+	return fmt.Sprintf("%s failed: %s", e.step, e.status)
+}
+
+// isRetryableStepError reports if a failed login or certgen request may
+// succeed when repeated: timeouts, connections that could not be made or
+// were dropped and server side errors, but never a rejection such as a bad
+// password or a server certificate that does not verify.
+func isRetryableStepError(err error) bool {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code >= 500
+	}
+	if isCertificateError(err) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Op == "dial" ||
+			errors.Is(err, syscall.ECONNREFUSED) ||
+			errors.Is(err, syscall.ECONNRESET)
+	}
+	return false
+}
+
+// isCertificateError reports if err comes from the verification of the
+// server certificate, which fails the same way on every attempt.
+func isCertificateError(err error) bool {
+	var verificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	var rootsErr x509.SystemRootsError
+	return errors.As(err, &verificationErr) ||
+		errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &invalidErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &rootsErr)
+}
+
+// isRetryableRunError reports if running the whole flow again (--retries)
+// may succeed: the step errors isRetryableStepError retries and servers
+// under maintenance.
+func isRetryableRunError(err error) bool {
+	switch err.(type) {
+	case *partialCertsError:
+		return false
+	case *maintenanceError:
+		return true
+	}
+	return isRetryableStepError(err)
+}
+
+// retryStep retries a single request of the flow (--login-retries and
+// --certgen-retries) with the --backoff settings, independently from the
+// retries of the whole flow.
+func retryStep(step string, maxRetries int, operation func() error) error {
+	backoff, err := newBackoff(*backoffName, *backoffBase, *backoffCap)
+	if err != nil {
+		return operation()
+	}
+	err = operation()
+	for attempt := 1; err != nil && attempt <= maxRetries && isRetryableStepError(err); attempt++ {
+		delay := backoff(attempt)
+		log.Printf("%s failed: %s, retrying in %s (%d/%d)", step, err, delay, attempt, maxRetries)
+		time.Sleep(delay)
+		err = operation()
+	}
+	return err
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNewBackoffStrategies(t *testing.T) {
+	expected := map[string][]time.Duration{
+		"constant":    {time.Second, time.Second, time.Second, time.Second},
+		"linear":      {time.Second, 2 * time.Second, 3 * time.Second, 4 * time.Second},
+		"exponential": {time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second},
+	}
+	for strategy, delays := range expected {
+		backoff, err := newBackoff(strategy, time.Second, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, delay := range delays {
+			if got := backoff(i + 1); got != delay {
+				t.Fatalf("%s attempt %d: expected %s got %s", strategy, i+1, delay, got)
+			}
+		}
+	}
+}
+
+func TestNewBackoffClampsLongRetries(t *testing.T) {
+	for _, maxDelay := range []time.Duration{0, time.Duration(1<<62 + 1)} {
+		expected := maxDelay
+		if maxDelay == 0 {
+			expected = maxRetryDelay
+		}
+		for _, strategy := range []string{"constant", "linear", "exponential"} {
+			backoff, err := newBackoff(strategy, expected, maxDelay)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, attempt := range []int{1, 2, 64, 1 << 30} {
+				if got := backoff(attempt); got != expected {
+					t.Fatalf("%s cap %s attempt %d: expected %s got %s",
+						strategy, maxDelay, attempt, expected, got)
+				}
+			}
+		}
+		backoff, err := newBackoff("exponential", time.Second, maxDelay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := backoff(1 << 30); got != expected {
+			t.Fatalf("cap %s: expected %s got %s", maxDelay, expected, got)
+		}
+	}
+}
+
+func TestNewBackoffFailUnknownStrategy(t *testing.T) {
+	_, err := newBackoff("random", time.Second, time.Second)
+	if err == nil {
+		t.Fatal("Should have failed on unknown strategy")
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	noDelay := func(attempt int) time.Duration { return 0 }
+	calls := 0
+	transient := &statusError{step: "certgen", status: "502 Bad Gateway", code: 502}
+	err := retryWithBackoff(3, noDelay, func() error {
+		calls++
+		if calls < 3 {
+			return transient
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls)
+	}
+
+	calls = 0
+	err = retryWithBackoff(2, noDelay, func() error {
+		calls++
+		return transient
+	})
+	if err == nil {
+		t.Fatal("Should have failed after exhausting retries")
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls)
+	}
+}
+
+func TestRetryWithBackoffSkipsRejections(t *testing.T) {
+	noDelay := func(attempt int) time.Duration { return 0 }
+	for _, rejection := range []error{
+		fmt.Errorf("Failed to get creds: %w", &statusError{step: "login", status: "401 Unauthorized", code: 401}),
+		&partialCertsError{failures: map[string]error{"x509": errors.New("refused")}},
+		errors.New("login refused"),
+	} {
+		calls := 0
+		retryWithBackoff(3, noDelay, func() error {
+			calls++
+			return rejection
+		})
+		if calls != 1 {
+			t.Fatalf("%v: expected no retry, got %d calls", rejection, calls)
+		}
+	}
+}
+
+func TestIsRetryableStepError(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	_, untrustedErr := http.Get(server.URL)
+	if untrustedErr == nil {
+		t.Fatal("Should have failed to verify the test server certificate")
+	}
+	urlError := func(err error) error {
+		return &url.Error{Op: "Post", URL: "https://keymaster", Err: err}
+	}
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{&statusError{step: "login", status: "401 Unauthorized", code: 401}, false},
+		{&statusError{step: "certgen", status: "404 Not Found", code: 404}, false},
+		{&statusError{step: "certgen", status: "502 Bad Gateway", code: 502}, true},
+		{fmt.Errorf("Failed to get creds: %w", &statusError{step: "certgen", status: "503 Service Unavailable", code: 503}), true},
+		{urlError(&net.OpError{Op: "dial", Err: errors.New("no route to host")}), true},
+		{urlError(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}), true},
+		{urlError(&net.OpError{Op: "read", Err: syscall.ECONNRESET}), true},
+		{urlError(&net.OpError{Op: "read", Err: errors.New("use of closed network connection")}), false},
+		{urlError(&net.DNSError{Err: "i/o timeout", Name: "keymaster", IsTimeout: true}), true},
+		{urlError(&net.DNSError{Err: "no such host", Name: "keymaster", IsNotFound: true}), false},
+		{urlError(x509.UnknownAuthorityError{}), false},
+		{urlError(x509.HostnameError{Host: "keymaster", Certificate: &x509.Certificate{}}), false},
+		{urlError(x509.CertificateInvalidError{Cert: &x509.Certificate{}, Reason: x509.Expired}), false},
+		{urlError(&tls.CertificateVerificationError{Err: errors.New("bad certificate")}), false},
+		{untrustedErr, false},
+		{urlError(errors.New("refusing to follow cross-origin redirect")), false},
+		{errors.New("unexpected content type"), false},
+	}
+	for _, test := range tests {
+		if got := isRetryableStepError(test.err); got != test.retryable {
+			t.Fatalf("%v: expected %v got %v", test.err, test.retryable, got)
+		}
+	}
+}
+
+func TestDoCertRequestCertgenRetries(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/rejected"):
+			http.Error(w, "", http.StatusForbidden)
+		case calls < 2:
+			http.Error(w, "", http.StatusBadGateway)
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("cert"))
+		}
+	}))
+	defer server.Close()
+	*certgenRetries = 2
+	*backoffBase = 0
+	defer func() {
+		*certgenRetries = 0
+		*backoffBase = time.Second
+	}()
+	cert, err := doCertRequest(server.Client(), server.URL+"/certgen/username", "ssh", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cert) != "cert" || calls != 2 {
+		t.Fatalf("expected the cert after 2 calls, got '%s' after %d", cert, calls)
+	}
+
+	calls = 0
+	if _, err := doCertRequest(server.Client(), server.URL+"/rejected", "ssh", "key"); err == nil {
+		t.Fatal("should have failed")
+	}
+	if calls != 1 {
+		t.Fatalf("a rejected request should not be retried, got %d calls", calls)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"os"
+	"time"
+)
+
+// RSA keys from this size take long enough to generate that a progress
+// indicator is shown.
+const spinnerMinKeyBits = 3072
+
+const spinnerInterval = 100 * time.Millisecond
+
+// startSpinner writes message followed by a spinner to out until the
+// returned function is called, which clears the line.
+func startSpinner(out io.Writer, message string) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		frames := `|/-\`
+		ticker := time.NewTicker(spinnerInterval)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			fmt.Fprintf(out, "\r%s %c", message, frames[i%len(frames)])
+			select {
+			case <-done:
+				fmt.Fprintf(out, "\r%*s\r", len(message)+2, "")
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// startKeygenSpinner shows a spinner on the terminal while a large RSA key
+// is generated. Nothing is shown for small keys or when stderr is not a
+// terminal.
+func startKeygenSpinner(bits int) func() {
+	if bits < spinnerMinKeyBits || !terminal.IsTerminal(int(os.Stderr.Fd())) {
+		return func() {}
+	}
+	return startSpinner(os.Stderr, fmt.Sprintf("Generating %d bit RSA key", bits))
+}
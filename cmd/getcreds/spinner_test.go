@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type lockedBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func TestStartSpinner(t *testing.T) {
+	var out lockedBuffer
+	stop := startSpinner(&out, "Generating key")
+	time.Sleep(3 * spinnerInterval)
+	stop()
+	output := out.buf.String()
+	if !strings.HasPrefix(output, "\rGenerating key |") {
+		t.Fatalf("unexpected spinner output %q", output)
+	}
+	if !strings.HasSuffix(output, "\r") {
+		t.Fatalf("spinner line was not cleared: %q", output)
+	}
+	// Small keys never show a spinner
+	startKeygenSpinner(RSAKeySize)()
+}
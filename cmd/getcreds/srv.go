@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type lookupSRVFunc func(name string) ([]*net.SRV, error)
+
+// lookupSRV resolves name with the --resolver when set. The records come
+// back sorted by priority and randomized by weight as RFC 2782 requires.
+func lookupSRV(name string) ([]*net.SRV, error) {
+	resolver := newDialer().Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, records, err := resolver.LookupSRV(ctx, "", "", name)
+	return records, err
+}
+
+// validateSRVTrust refuses an srv_record whose discovered servers would be
+// trusted on the system CAs alone, unless srv_trust accepts it.
+func validateSRVTrust(config baseConfig) error {
+	if len(config.SRVRecord) < 1 || len(config.SRVCAFile) > 0 || config.SRVTrust {
+		return nil
+	}
+	return errors.New("srv_record needs srv_ca_file, or srv_trust to trust the discovered servers on the system CAs")
+}
+
+// srvDomain is the domain of an SRV record name, without its _service and
+// _proto labels.
+func srvDomain(name string) string {
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for len(labels) > 0 && strings.HasPrefix(labels[0], "_") {
+		labels = labels[1:]
+	}
+	return strings.ToLower(strings.Join(labels, "."))
+}
+
+// srvEndpoints turns the SRV records of name into https endpoints. Lower
+// priorities become higher weights so that orderEndpoints tries them
+// first, the record order is kept for equal priorities. Targets outside
+// the domain of name are dropped.
+func srvEndpoints(name string, records []*net.SRV) []endpointConfig {
+	domain := srvDomain(name)
+	var endpoints []endpointConfig
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		// A "." target means the service is explicitly not available
+		if len(target) < 1 {
+			continue
+		}
+		lowerTarget := strings.ToLower(target)
+		if len(domain) < 1 || lowerTarget != domain && !strings.HasSuffix(lowerTarget, "."+domain) {
+			log.Printf("ignoring the SRV target %s, outside of %s", target, domain)
+			continue
+		}
+		host := target
+		if record.Port != 443 {
+			host = net.JoinHostPort(target, strconv.Itoa(int(record.Port)))
+		}
+		endpoints = append(endpoints, endpointConfig{
+			URL:    "https://" + host,
+			Weight: -int(record.Priority),
+		})
+	}
+	return endpoints
+}
+
+// resolveEndpoints returns the configured endpoints followed by the ones
+// discovered from the srv_record, verified with the srv_ca_file when set.
+// A failed lookup is only fatal when there are no configured endpoints to
+// fall back to.
+func resolveEndpoints(config AppConfigFile, lookup lookupSRVFunc) ([]endpointConfig, error) {
+	endpoints := getEndpoints(config)
+	if len(config.Base.SRVRecord) < 1 {
+		return endpoints, nil
+	}
+	records, err := lookup(config.Base.SRVRecord)
+	if err == nil {
+		discovered := srvEndpoints(config.Base.SRVRecord, records)
+		for i := range discovered {
+			discovered[i].CAFile = config.Base.SRVCAFile
+		}
+		if *debug {
+			log.Printf("found %d endpoints in %s", len(discovered), config.Base.SRVRecord)
+		}
+		if len(discovered) < 1 {
+			err = errors.New("no usable records")
+		}
+		endpoints = append(endpoints, discovered...)
+	}
+	if err != nil {
+		err = fmt.Errorf("cannot discover endpoints from %s: %s", config.Base.SRVRecord, err)
+		if len(endpoints) < 1 {
+			return nil, err
+		}
+		log.Println(err)
+	}
+	return endpoints, nil
+}
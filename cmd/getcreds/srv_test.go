@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSRVEndpoints(t *testing.T) {
+	records := []*net.SRV{
+		{Target: "km1.example.com.", Port: 443, Priority: 10},
+		{Target: "km2.Example.com.", Port: 8443, Priority: 20},
+		{Target: ".", Port: 443, Priority: 30},
+		{Target: "attacker.com.", Port: 443, Priority: 1},
+		{Target: "km1.notexample.com.", Port: 443, Priority: 1},
+	}
+	expected := []endpointConfig{
+		{URL: "https://km1.example.com", Weight: -10},
+		{URL: "https://km2.Example.com:8443", Weight: -20},
+	}
+	endpoints := srvEndpoints("_keymaster._tcp.example.com", records)
+	if !reflect.DeepEqual(endpoints, expected) {
+		t.Fatalf("expected %v got %v", expected, endpoints)
+	}
+}
+
+func TestResolveEndpoints(t *testing.T) {
+	var config AppConfigFile
+	config.Base.Gen_Cert_URLS = "https://static.example.com"
+	config.Base.SRVRecord = "_keymaster._tcp.example.com"
+	config.Base.SRVCAFile = "/etc/keymaster/ca.pem"
+	lookup := func(name string) ([]*net.SRV, error) {
+		if name != config.Base.SRVRecord {
+			t.Fatalf("unexpected lookup of %s", name)
+		}
+		return []*net.SRV{
+			{Target: "km2.example.com.", Port: 443, Priority: 20},
+			{Target: "km1.example.com.", Port: 443, Priority: 10},
+		}, nil
+	}
+	endpoints, err := resolveEndpoints(config, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := getEndpointURLs(orderEndpoints(endpoints, false))
+	expected := []string{"https://static.example.com", "https://km1.example.com", "https://km2.example.com"}
+	if !reflect.DeepEqual(urls, expected) {
+		t.Fatalf("expected %v got %v", expected, urls)
+	}
+	if endpoints[0].CAFile != "" || endpoints[1].CAFile != config.Base.SRVCAFile {
+		t.Fatalf("srv_ca_file should only apply to the discovered endpoints: %v", endpoints)
+	}
+
+	failedLookup := func(name string) ([]*net.SRV, error) {
+		return nil, errors.New("no such host")
+	}
+	endpoints, err = resolveEndpoints(config, failedLookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 1 {
+		t.Fatalf("expected to fall back to the static endpoint, got %v", endpoints)
+	}
+	config.Base.Gen_Cert_URLS = ""
+	if _, err := resolveEndpoints(config, failedLookup); err == nil {
+		t.Fatal("should have failed without any endpoint")
+	}
+}
+
+func TestLoadVerifyConfigFileSRVOnly(t *testing.T) {
+	tmpfile, err := createTempFileWithStringContent("test_LoadVerifyConfigSRV",
+		"base:\n    srv_record: \"_keymaster._tcp.example.com\"\n    srv_trust: true\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+	config, err := loadVerifyConfigFile(tmpfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Base.SRVRecord != "_keymaster._tcp.example.com" {
+		t.Fatalf("unexpected srv_record '%s'", config.Base.SRVRecord)
+	}
+	if problems := configProblems(tmpfile.Name()); len(problems) > 0 {
+		t.Fatalf("unexpected problems %v", problems)
+	}
+}
+
+func TestValidateSRVTrust(t *testing.T) {
+	config := baseConfig{SRVRecord: "_keymaster._tcp.example.com"}
+	if err := validateSRVTrust(config); err == nil {
+		t.Fatal("should have required srv_ca_file or srv_trust")
+	}
+	config.SRVCAFile = "/etc/keymaster/ca.pem"
+	if err := validateSRVTrust(config); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+)
+
+// syncDir flushes the entries of dir, so that a file renamed into it is
+// still there after a crash.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,7 @@
+package main
+
+// syncDir does nothing on Windows, where directories cannot be opened for
+// a sync and renames are flushed with the file system metadata.
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/Symantec/keymaster/lib/certgen"
+	"github.com/Symantec/keymaster/lib/webapi/v0/proto"
+	"golang.org/x/crypto/ssh"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const fakeAuthCookieName = "auth_cookie"
+
+// fakeKeymaster is an in process keymaster server implementing the login
+// and certgen endpoints used by the client so that the whole client flow
+// can be exercised without a real server.
+type fakeKeymaster struct {
+	*httptest.Server
+	Username     string
+	Password     string
+	CertBackends []string
+	// FailCertType makes certgen requests for that cert type fail.
+	FailCertType string
+	// CertgenMethod is the only method accepted by certgen.
+	CertgenMethod string
+	// PasswordPrompt is the prompt hint returned by the version call.
+	PasswordPrompt string
+	// DelegationAdmins may get certs for other users.
+	DelegationAdmins []string
+	caSigner         crypto.Signer
+	caCert           *x509.Certificate
+	sshSigner        ssh.Signer
+	mutex            sync.Mutex
+	sessions         map[string]string
+	Requests         []*http.Request
+}
+
+func newFakeKeymaster(t *testing.T) *fakeKeymaster {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caDer, err := certgen.GenSelfSignedCACert("fake-keymaster", "TestOrg", caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshSigner, err := ssh.NewSignerFromSigner(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeKeymaster{
+		Username:      "username",
+		Password:      "password",
+		CertBackends:  []string{proto.AuthTypePassword},
+		CertgenMethod: "POST",
+		caSigner:      caKey,
+		caCert:        caCert,
+		sshSigner:     sshSigner,
+		sessions:      make(map[string]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(proto.LoginPath, fake.loginHandler)
+	mux.HandleFunc(proto.VersionPath, fake.versionHandler)
+	mux.HandleFunc("/certgen/", fake.certgenHandler)
+	mux.HandleFunc(x509CAPath, fake.x509CAHandler)
+	fake.Server = httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fake.mutex.Lock()
+			fake.Requests = append(fake.Requests, r)
+			fake.mutex.Unlock()
+			mux.ServeHTTP(w, r)
+		}))
+	return fake
+}
+
+// RootCAs returns a pool trusting the TLS certificate of the fake server.
+func (fake *fakeKeymaster) RootCAs() *x509.CertPool {
+	certPool := x509.NewCertPool()
+	certPool.AddCert(fake.Certificate())
+	return certPool
+}
+
+func (fake *fakeKeymaster) requestPaths() []string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	var paths []string
+	for _, r := range fake.Requests {
+		paths = append(paths, r.URL.Path)
+	}
+	return paths
+}
+
+func (fake *fakeKeymaster) isDelegationAllowed(authUser string, r *http.Request) bool {
+	if r.URL.Query().Get(proto.DelegatedByParam) != authUser {
+		return false
+	}
+	for _, admin := range fake.DelegationAdmins {
+		if admin == authUser {
+			return true
+		}
+	}
+	return false
+}
+
+func (fake *fakeKeymaster) versionHandler(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(proto.VersionResponse{Version: "0.3.2", PasswordPrompt: fake.PasswordPrompt})
+}
+
+func (fake *fakeKeymaster) x509CAHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: fake.caCert.Raw}))
+}
+
+func (fake *fakeKeymaster) loginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if r.Form.Get("username") != fake.Username || r.Form.Get("password") != fake.Password {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	sessionValue, err := genRandomTestString()
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	fake.mutex.Lock()
+	fake.sessions[sessionValue] = fake.Username
+	fake.mutex.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: fakeAuthCookieName, Value: sessionValue,
+		Path: "/", HttpOnly: true, Secure: true})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proto.LoginResponse{Message: "success",
+		CertAuthBackend: fake.CertBackends})
+}
+
+func (fake *fakeKeymaster) certgenHandler(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(fakeAuthCookieName)
+	if err != nil {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	fake.mutex.Lock()
+	authUser, ok := fake.sessions[cookie.Value]
+	fake.mutex.Unlock()
+	if !ok {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	targetUser := strings.TrimPrefix(r.URL.Path, "/certgen/")
+	if targetUser != authUser && !fake.isDelegationAllowed(authUser, r) {
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+	if r.Method != fake.CertgenMethod {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseMultipartForm(1e7); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+	file, _, err := r.FormFile("pubkeyfile")
+	if err != nil {
+		http.Error(w, "Missing public key file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(file)
+	if r.Form.Get("type") == fake.FailCertType {
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	switch r.Form.Get("type") {
+	case "ssh":
+		cert, err := certgen.GenSSHCertFileString(targetUser, buf.String(), fake.sshSigner, "fake-keymaster")
+		if err != nil {
+			http.Error(w, "Invalid public key", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(cert))
+	case "x509":
+		block, _ := pem.Decode(buf.Bytes())
+		if block == nil || block.Type != "PUBLIC KEY" {
+			http.Error(w, "Invalid File, Unable to decode pem", http.StatusBadRequest)
+			return
+		}
+		userPub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			http.Error(w, "Cannot parse public key", http.StatusBadRequest)
+			return
+		}
+		derCert, err := certgen.GenUserX509Cert(targetUser, userPub, fake.caCert, fake.caSigner, nil)
+		if err != nil {
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		w.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derCert}))
+	case hostCertType:
+		hostKey, _, _, _, err := ssh.ParseAuthorizedKey(buf.Bytes())
+		if err != nil {
+			http.Error(w, "Invalid public key", http.StatusBadRequest)
+			return
+		}
+		cert := &ssh.Certificate{
+			Key:             hostKey,
+			CertType:        ssh.HostCert,
+			KeyId:           "fake-keymaster_" + targetUser,
+			ValidPrincipals: r.Form["hostname"],
+			ValidBefore:     ssh.CertTimeInfinity,
+		}
+		if err := cert.SignCert(rand.Reader, fake.sshSigner); err != nil {
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		w.Write(ssh.MarshalAuthorizedKey(cert))
+	default:
+		http.Error(w, "Unrecognized cert type", http.StatusBadRequest)
+	}
+}
+
+func genRandomTestString() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// describeServerCert summarizes the cert presented by the server so that
+// trust problems can be told apart from expired or misissued certs.
+func describeServerCert(cert *x509.Certificate) string {
+	if cert == nil {
+		return "no server cert available"
+	}
+	return fmt.Sprintf("subject='%s' issuer='%s' valid from %s to %s",
+		cert.Subject, cert.Issuer,
+		cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339))
+}
+
+// describeTLSError adds which verification check failed and the details
+// of the presented server cert to TLS verification errors. Other errors
+// are returned unchanged.
+func describeTLSError(err error) error {
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	switch {
+	case errors.As(err, &unknownAuthorityErr):
+		return fmt.Errorf("server cert is not signed by a trusted CA (%s): %s",
+			describeServerCert(unknownAuthorityErr.Cert), err)
+	case errors.As(err, &invalidErr):
+		check := "server cert is invalid"
+		if invalidErr.Reason == x509.Expired {
+			check = "server cert is expired or not yet valid"
+		}
+		return fmt.Errorf("%s (%s): %s", check, describeServerCert(invalidErr.Cert), err)
+	case errors.As(err, &hostnameErr):
+		return fmt.Errorf("server cert does not match host '%s' (%s): %s",
+			hostnameErr.Host, describeServerCert(hostnameErr.Certificate), err)
+	}
+	return err
+}
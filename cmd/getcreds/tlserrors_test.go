@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDescribeTLSError(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:   pkix.Name{CommonName: "keymaster.example.com"},
+		Issuer:    pkix.Name{CommonName: "Example CA"},
+		NotBefore: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:  time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{x509.UnknownAuthorityError{Cert: cert}, "not signed by a trusted CA"},
+		{x509.CertificateInvalidError{Cert: cert, Reason: x509.Expired}, "expired or not yet valid"},
+		{x509.HostnameError{Certificate: cert, Host: "other.example.com"}, "does not match host 'other.example.com'"},
+	}
+	for _, test := range tests {
+		message := describeTLSError(test.err).Error()
+		if !strings.Contains(message, test.expected) {
+			t.Errorf("expected '%s' in '%s'", test.expected, message)
+		}
+		if !strings.Contains(message, "CN=Example CA") || !strings.Contains(message, "2021-01-01T00:00:00Z") {
+			t.Errorf("missing server cert details in '%s'", message)
+		}
+	}
+	plainErr := errors.New("connection refused")
+	if describeTLSError(plainErr) != plainErr {
+		t.Fatal("non TLS errors should be returned unchanged")
+	}
+}
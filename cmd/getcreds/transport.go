@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/Symantec/keymaster/lib/client"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// normalizeResolverAddress returns the host:port of a DNS server given as
+// an address with an optional port.
+func normalizeResolverAddress(resolver string) (string, error) {
+	if host, port, err := net.SplitHostPort(resolver); err == nil {
+		if net.ParseIP(host) == nil {
+			return "", fmt.Errorf("invalid resolver address '%s'", resolver)
+		}
+		return net.JoinHostPort(host, port), nil
+	}
+	if net.ParseIP(resolver) == nil {
+		return "", fmt.Errorf("invalid resolver address '%s'", resolver)
+	}
+	return net.JoinHostPort(resolver, "53"), nil
+}
+
+// newDialer returns the dialer used for the servers. It races IPv4 and
+// IPv6 connections to dual stack hosts (happy eyeballs) unless
+// --ip-version restricts the family.
+func newDialer() *net.Dialer {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}
+	if len(*dnsResolver) > 0 {
+		resolverAddress, err := normalizeResolverAddress(*dnsResolver)
+		if err != nil {
+			log.Printf("%s, using the system resolver", err)
+			return dialer
+		}
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var resolverDialer net.Dialer
+				return resolverDialer.DialContext(ctx, network, resolverAddress)
+			},
+		}
+	}
+	return dialer
+}
+
+// parseRenegotiation maps the --tls-renegotiation values to the tls
+// package setting.
+func parseRenegotiation(value string) (tls.RenegotiationSupport, error) {
+	switch value {
+	case "never":
+		return tls.RenegotiateNever, nil
+	case "once":
+		return tls.RenegotiateOnceAsClient, nil
+	case "freely":
+		return tls.RenegotiateFreelyAsClient, nil
+	}
+	return tls.RenegotiateNever, fmt.Errorf("unknown tls renegotiation '%s', use never, once or freely", value)
+}
+
+// parseIPVersion maps the --ip-version values to the network dialed for
+// "tcp", empty when both families are used.
+func parseIPVersion(value string) (string, error) {
+	switch value {
+	case "any":
+		return "", nil
+	case "4":
+		return "tcp4", nil
+	case "6":
+		return "tcp6", nil
+	}
+	return "", fmt.Errorf("unknown ip version '%s', use any, 4 or 6", value)
+}
+
+// withIPVersion makes dial only use network, tcp4 or tcp6, to
+// troubleshoot servers only reachable over one family.
+func withIPVersion(dial client.DialContextFunc, network string) client.DialContextFunc {
+	return func(ctx context.Context, _, address string) (net.Conn, error) {
+		return dial(ctx, network, address)
+	}
+}
+
+// newTLSConfig returns the TLS settings used to talk to keymaster,
+// honoring the session ticket, renegotiation and client cert flags.
+func newTLSConfig(rootCAs *x509.CertPool) (*tls.Config, error) {
+	renegotiation, err := parseRenegotiation(*tlsRenegotiation)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		RootCAs:                rootCAs,
+		MinVersion:             tls.VersionTLS12,
+		SessionTicketsDisabled: *disableSessionTickets,
+		Renegotiation:          renegotiation,
+	}
+	clientCert, err := getClientCertificate()
+	if err != nil {
+		return nil, err
+	}
+	if clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*clientCert}
+	}
+	if *rejectSelfSigned {
+		tlsConfig.VerifyConnection = rejectSelfSignedServer
+	}
+	return tlsConfig, nil
+}
+
+// isSelfSigned reports whether cert is its own issuer, as dev CAs and
+// test servers usually are.
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+// rejectSelfSignedServer implements --reject-self-signed, refusing a
+// self-signed server cert even when it is in the trusted CAs, so that a dev
+// CA accidentally shipped to production is noticed.
+func rejectSelfSignedServer(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) > 0 && isSelfSigned(state.PeerCertificates[0]) {
+		return fmt.Errorf("server cert is self-signed (%s)", describeServerCert(state.PeerCertificates[0]))
+	}
+	return nil
+}
+
+// chainVerifyConnection runs both VerifyConnection callbacks, either of
+// which may be nil.
+func chainVerifyConnection(first, second func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	if first == nil {
+		return second
+	}
+	if second == nil {
+		return first
+	}
+	return func(state tls.ConnectionState) error {
+		if err := first(state); err != nil {
+			return err
+		}
+		return second(state)
+	}
+}
+
+func defaultDialContext() client.DialContextFunc {
+	dial := client.DialContextFunc(newDialer().DialContext)
+	if network, err := parseIPVersion(*ipVersion); err == nil && len(network) > 0 {
+		dial = withIPVersion(dial, network)
+	}
+	if *proxyProtocol {
+		dial = client.WithProxyProtocol(dial)
+	}
+	return dial
+}
+
+// newEndpointHTTPClient returns a client applying the TLS overrides of
+// endpoint on top of the default settings.
+func newEndpointHTTPClient(endpoint endpointConfig, rootCAs *x509.CertPool) (*http.Client, error) {
+	if len(endpoint.CAFile) > 0 {
+		var err error
+		rootCAs, err = loadRootCAs(endpoint.CAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tlsConfig, err := newTLSConfig(rootCAs)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ServerName = endpoint.ServerName
+	if len(endpoint.ExpectedSAN) > 0 {
+		tlsConfig.VerifyConnection = chainVerifyConnection(tlsConfig.VerifyConnection,
+			verifyExpectedSAN(endpoint.ExpectedSAN))
+	}
+	return newHTTPClient(tlsConfig)
+}
+
+// verifyExpectedSAN returns a tls.Config VerifyConnection callback
+// requiring the server cert to be valid for expected, as a DNS or IP SAN
+// (wildcards included) or as its CN. It runs after the usual chain and
+// hostname verification.
+func verifyExpectedSAN(expected string) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) < 1 {
+			return errors.New("server presented no cert")
+		}
+		leaf := state.PeerCertificates[0]
+		if leaf.VerifyHostname(expected) == nil ||
+			strings.EqualFold(leaf.Subject.CommonName, expected) {
+			return nil
+		}
+		return fmt.Errorf("server cert is not valid for the expected name '%s' (%s)",
+			expected, describeServerCert(leaf))
+	}
+}
+
+// newHTTPClient returns the client used to talk to keymaster. Its cookie
+// jar only sends the login cookies back to the host and path they were
+// scoped to instead of replaying them on every request.
+func newHTTPClient(tlsConfig *tls.Config) (*http.Client, error) {
+	return newHTTPClientWithDial(tlsConfig, defaultDialContext())
+}
+
+// newHTTPClientWithDial is newHTTPClient using dial for the connections,
+// the client of lib/client with the --dump-responses transport.
+func newHTTPClientWithDial(tlsConfig *tls.Config, dial client.DialContextFunc) (*http.Client, error) {
+	httpClient, err := client.NewHTTPClient(tlsConfig, dial)
+	if err != nil {
+		return nil, err
+	}
+	if len(*dumpResponses) > 0 {
+		httpClient.Transport = &dumpTransport{base: httpClient.Transport, dir: *dumpResponses}
+	}
+	return httpClient, nil
+}
+
+// connTracker records the connections used by the requests going through
+// it, so that we can verify keep-alive works across the login and certgen
+// calls.
+type connTracker struct {
+	base     http.RoundTripper
+	mutex    sync.Mutex
+	conns    []net.Conn
+	requests int
+	// TLS parameters of the latest new connection
+	tlsState *tls.ConnectionState
+}
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// tlsVersionName names the negotiated TLS version, as in "TLS 1.3".
+func tlsVersionName(version uint16) string {
+	if name, ok := tlsVersionNames[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown TLS version 0x%04x", version)
+}
+
+func (t *connTracker) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			t.requests++
+			for _, conn := range t.conns {
+				if conn == info.Conn {
+					return
+				}
+			}
+			t.conns = append(t.conns, info.Conn)
+			if *debug {
+				log.Printf("new connection to %s for %s (reused=%v)",
+					info.Conn.RemoteAddr(), req.URL.Path, info.Reused)
+			}
+			if tlsConn, ok := info.Conn.(*tls.Conn); ok {
+				state := tlsConn.ConnectionState()
+				t.tlsState = &state
+				if *debug {
+					log.Printf("negotiated %s with %s to %s", tlsVersionName(state.Version),
+						tls.CipherSuiteName(state.CipherSuite), info.Conn.RemoteAddr())
+				}
+			}
+		},
+	}
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// negotiatedTLS returns the TLS version and cipher suite of the latest
+// new connection, empty strings when there was none.
+func (t *connTracker) negotiatedTLS() (string, string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.tlsState == nil {
+		return "", ""
+	}
+	return tlsVersionName(t.tlsState.Version), tls.CipherSuiteName(t.tlsState.CipherSuite)
+}
+
+func (t *connTracker) connectionCount() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.conns)
+}
+
+// withConnTracker returns a copy of client whose requests are recorded by
+// the returned tracker.
+func withConnTracker(client *http.Client) (*http.Client, *connTracker) {
+	tracker := &connTracker{base: client.Transport}
+	trackedClient := *client
+	trackedClient.Transport = tracker
+	return &trackedClient, tracker
+}
+
+// checkConnReuse warns when more than one connection was needed to talk to
+// a single server, which means keep-alive is not working and every signing
+// request pays for a new TLS handshake.
+func checkConnReuse(tracker *connTracker, baseUrl string) {
+	count := tracker.connectionCount()
+	if count > 1 {
+		log.Printf("WARNING: %d connections were opened to '%s', connections are not being reused",
+			count, baseUrl)
+	} else if *debug {
+		log.Printf("all %d requests to '%s' reused one connection", tracker.requests, baseUrl)
+	}
+}
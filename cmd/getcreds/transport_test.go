@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCheckRedirectSameOriginKeepsAuth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/start" {
+			http.Redirect(w, r, "/final", http.StatusFound)
+			return
+		}
+		cookie, err := r.Cookie("auth")
+		if err != nil || cookie.Value != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	client, err := newHTTPClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startURL, err := url.Parse(ts.URL + "/start")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Jar.SetCookies(startURL, []*http.Cookie{{Name: "auth", Value: "secret"}})
+	resp, err := client.Get(startURL.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("cookie was not re-applied on redirect, got %s", resp.Status)
+	}
+}
+
+func TestHTTPClientScopesCookiesToHost(t *testing.T) {
+	client, err := newHTTPClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginURL, err := url.Parse("https://keymaster.example.com/api/v0/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Jar.SetCookies(loginURL, []*http.Cookie{{Name: "auth", Value: "secret", Path: "/"}})
+	for target, expected := range map[string]int{
+		"https://keymaster.example.com/certgen/username": 1,
+		"https://sso.example.com/login":                  0,
+		"https://keymaster.example.com.evil.com/":        0,
+	} {
+		targetURL, err := url.Parse(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cookies := client.Jar.Cookies(targetURL); len(cookies) != expected {
+			t.Fatalf("expected %d cookies for %s, got %d", expected, target, len(cookies))
+		}
+	}
+}
+
+func TestNormalizeResolverAddress(t *testing.T) {
+	expected := map[string]string{
+		"10.0.0.53":       "10.0.0.53:53",
+		"10.0.0.53:5353":  "10.0.0.53:5353",
+		"2001:db8::1":     "[2001:db8::1]:53",
+		"[2001:db8::1]:5": "[2001:db8::1]:5",
+	}
+	for resolver, address := range expected {
+		normalized, err := normalizeResolverAddress(resolver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if normalized != address {
+			t.Fatalf("expected %s got %s", address, normalized)
+		}
+	}
+	for _, invalid := range []string{"", "dns.example.com", "dns.example.com:53"} {
+		if _, err := normalizeResolverAddress(invalid); err == nil {
+			t.Fatalf("'%s' should be invalid", invalid)
+		}
+	}
+}
+
+func TestParseRenegotiation(t *testing.T) {
+	tests := map[string]tls.RenegotiationSupport{
+		"never":  tls.RenegotiateNever,
+		"once":   tls.RenegotiateOnceAsClient,
+		"freely": tls.RenegotiateFreelyAsClient,
+	}
+	for value, expected := range tests {
+		renegotiation, err := parseRenegotiation(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if renegotiation != expected {
+			t.Errorf("unexpected renegotiation for '%s'", value)
+		}
+	}
+	if _, err := parseRenegotiation("always"); err == nil {
+		t.Fatal("should have failed on an unknown value")
+	}
+}
+
+func TestWithIPVersion(t *testing.T) {
+	network, err := parseIPVersion("6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dialed string
+	dial := withIPVersion(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = network
+		return nil, errors.New("not dialing")
+	}, network)
+	dial(context.Background(), "tcp", "keymaster.example.com:443")
+	if dialed != "tcp6" {
+		t.Fatalf("expected to dial tcp6, got '%s'", dialed)
+	}
+	if network, err := parseIPVersion("any"); err != nil || network != "" {
+		t.Fatalf("unexpected network '%s' for any: %v", network, err)
+	}
+	if _, err := parseIPVersion("5"); err == nil {
+		t.Fatal("should have failed on an unknown version")
+	}
+}
+
+func TestNewEndpointHTTPClientExpectedSAN(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	rootCAs := ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	for expected, valid := range map[string]bool{
+		"example.com":       true,
+		"127.0.0.1":         true,
+		"keymaster.invalid": false,
+	} {
+		client, err := newEndpointHTTPClient(endpointConfig{URL: ts.URL, ExpectedSAN: expected}, rootCAs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != valid {
+			t.Fatalf("expected SAN '%s': valid=%v, got %v", expected, valid, err)
+		}
+	}
+}
+
+func TestRejectSelfSigned(t *testing.T) {
+	block, _ := pem.Decode([]byte(localhostCertPem))
+	signedCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isSelfSigned(signedCert) {
+		t.Fatal("a CA signed cert is not self-signed")
+	}
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	if !isSelfSigned(ts.Certificate()) {
+		t.Fatal("the test server cert should be self-signed")
+	}
+	rootCAs := ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	*rejectSelfSigned = true
+	defer func() { *rejectSelfSigned = false }()
+	for _, expectedSAN := range []string{"", "example.com"} {
+		client, err := newEndpointHTTPClient(endpointConfig{URL: ts.URL, ExpectedSAN: expectedSAN}, rootCAs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp, err := client.Get(ts.URL); err == nil {
+			resp.Body.Close()
+			t.Fatalf("the self-signed server should have been refused with expected SAN '%s'", expectedSAN)
+		}
+	}
+}
+
+func TestConnTrackerNegotiatedTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	client, tracker := withConnTracker(ts.Client())
+	if version, _ := tracker.negotiatedTLS(); version != "" {
+		t.Fatalf("unexpected version '%s' before connecting", version)
+	}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	version, cipherSuite := tracker.negotiatedTLS()
+	if version != "TLS 1.3" || cipherSuite != tls.CipherSuiteName(resp.TLS.CipherSuite) {
+		t.Fatalf("unexpected negotiated TLS '%s' '%s'", version, cipherSuite)
+	}
+}
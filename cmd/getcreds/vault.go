@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// vaultPersister returns a persistFunc writing the key and certs to the
+// Vault KV secret at path, using VAULT_ADDR and VAULT_TOKEN. VAULT_CACERT
+// can point to the CAs trusted for the Vault server. privateKeyPath is
+// empty when the key is held by the agent and cannot be stored.
+func vaultPersister(path string, kvVersion int, privateKeyPath string) (persistFunc, error) {
+	vaultAddr := strings.TrimRight(os.Getenv("VAULT_ADDR"), "/")
+	if len(vaultAddr) < 1 {
+		return nil, errors.New("VAULT_ADDR is not set")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if len(token) < 1 {
+		return nil, errors.New("VAULT_TOKEN is not set")
+	}
+	if kvVersion != 1 && kvVersion != 2 {
+		return nil, fmt.Errorf("unsupported vault kv version %d", kvVersion)
+	}
+	var rootCAs *x509.CertPool
+	if caPath := os.Getenv("VAULT_CACERT"); len(caPath) > 0 {
+		var err error
+		rootCAs, err = loadRootCAs(caPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	client := newVaultHTTPClient(rootCAs)
+	secretURL := vaultAddr + "/v1/" + strings.Trim(path, "/")
+	return func(material certMaterial) error {
+		secret := make(map[string]string)
+		if len(privateKeyPath) > 0 {
+			privateKey, err := ioutil.ReadFile(privateKeyPath)
+			if err != nil {
+				return err
+			}
+			secret["private_key"] = string(privateKey)
+		}
+		if material.SSHCert != nil {
+			secret["ssh_cert"] = string(material.SSHCert)
+		}
+		if material.X509Cert != nil {
+			secret["x509_cert"] = string(material.X509Cert)
+		}
+		return writeVaultSecret(client, secretURL, token, kvVersion, secret)
+	}, nil
+}
+
+// Timeout of the Vault requests.
+const vaultTimeout = 30 * time.Second
+
+// newVaultHTTPClient returns the client used for Vault, which trusts only
+// rootCAs, or the system CAs when nil. None of the keymaster settings (the
+// TLS client cert, the dialer, --dump-responses, ...) apply to it.
+func newVaultHTTPClient(rootCAs *x509.CertPool) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: rootCAs, MinVersion: tls.VersionTLS12},
+		},
+		Timeout: vaultTimeout,
+	}
+}
+
+func writeVaultSecret(client *http.Client, secretURL string, token string, kvVersion int, secret map[string]string) error {
+	var payload interface{} = secret
+	if kvVersion == 2 {
+		payload = map[string]interface{}{"data": secret}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", secretURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("writing to vault failed: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVaultPersisterWritesKV2Secret(t *testing.T) {
+	var gotPath, gotToken string
+	var gotBody map[string]map[string]string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotToken = r.Header.Get("X-Vault-Token")
+		json.NewDecoder(r.Body).Decode(&gotBody)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+	os.Setenv("VAULT_ADDR", ts.URL+"/")
+	os.Setenv("VAULT_TOKEN", "s.testtoken")
+	defer os.Unsetenv("VAULT_ADDR")
+	defer os.Unsetenv("VAULT_TOKEN")
+	dir, err := ioutil.TempDir("", "keymaster-vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	privateKeyPath := filepath.Join(dir, "keymaster")
+	if err := ioutil.WriteFile(privateKeyPath, []byte("private key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Vault responses are not keymaster responses
+	dumpDir := filepath.Join(dir, "dump")
+	if err := os.Mkdir(dumpDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	*dumpResponses = dumpDir
+	defer func() { *dumpResponses = "" }()
+	persist, err := vaultPersister("secret/data/keymaster/username", 2, privateKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := persist(certMaterial{SSHCert: []byte("ssh cert")}); err != nil {
+		t.Fatal(err)
+	}
+	if gotPath != "/v1/secret/data/keymaster/username" || gotToken != "s.testtoken" {
+		t.Fatalf("unexpected request to %s with token %s", gotPath, gotToken)
+	}
+	data := gotBody["data"]
+	if data["private_key"] != "private key" || data["ssh_cert"] != "ssh cert" {
+		t.Fatalf("unexpected secret %v", gotBody)
+	}
+	if _, ok := data["x509_cert"]; ok {
+		t.Fatal("missing x509 cert should not be written")
+	}
+	if dumped, err := ioutil.ReadDir(dumpDir); err != nil || len(dumped) > 0 {
+		t.Fatal("the Vault response should not have been dumped")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"strings"
+	"time"
+)
+
+// Exit code when --verify-host could not log in with the new ssh cert.
+const exitCodeVerifyHostFailed = 8
+
+// parseVerifyHost splits the user@host[:port] --verify-host target, using
+// the ssh port when none is given.
+func parseVerifyHost(target string) (string, string, error) {
+	at := strings.LastIndex(target, "@")
+	if at < 1 || at == len(target)-1 {
+		return "", "", fmt.Errorf("invalid verify host '%s', use user@host[:port]", target)
+	}
+	userName, address := target[:at], target[at+1:]
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "22")
+	}
+	return userName, address, nil
+}
+
+// sshCertSigner pairs the ssh cert with the signer of its key. Agent held
+// keys are looked up again as the agent connection used for certgen is
+// closed by now.
+func sshCertSigner(signer crypto.Signer, certBytes []byte) (ssh.Signer, func(), error) {
+	cert, err := parseSSHCert(certBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	closeAgent := func() {}
+	var keySigner ssh.Signer
+	if agentKey, ok := signer.(*agentSigner); ok {
+		sshAgent, conn, err := connectToAgent()
+		if err != nil {
+			return nil, nil, err
+		}
+		closeAgent = func() { conn.Close() }
+		selected, err := selectAgentSigner(sshAgent, ssh.FingerprintSHA256(agentKey.sshSigner.PublicKey()))
+		if err != nil {
+			closeAgent()
+			return nil, nil, err
+		}
+		keySigner = selected.sshSigner
+	} else {
+		keySigner, err = ssh.NewSignerFromSigner(signer)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	certSigner, err := ssh.NewCertSigner(cert, keySigner)
+	if err != nil {
+		closeAgent()
+		return nil, nil, err
+	}
+	return certSigner, closeAgent, nil
+}
+
+// verifyHostLogin implements --verify-host, authenticating to target with
+// the new ssh cert without running anything, so that a cert the host does
+// not accept is noticed right away. The host key is checked against
+// knownHostsPath.
+func verifyHostLogin(target string, signer crypto.Signer, certBytes []byte, knownHostsPath string) error {
+	if certBytes == nil {
+		return errors.New("no ssh cert to verify")
+	}
+	userName, address, err := parseVerifyHost(target)
+	if err != nil {
+		return err
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return fmt.Errorf("cannot verify the host key: %s", err)
+	}
+	certSigner, closeAgent, err := sshCertSigner(signer, certBytes)
+	if err != nil {
+		return err
+	}
+	defer closeAgent()
+	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            userName,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(certSigner)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         10 * time.Second,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot log in to %s with the new cert: %s", target, err)
+	}
+	return client.Close()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseVerifyHost(t *testing.T) {
+	tests := map[string][2]string{
+		"alice@host.example.com":      {"alice", "host.example.com:22"},
+		"alice@host.example.com:2222": {"alice", "host.example.com:2222"},
+		"alice@[::1]":                 {"alice", "[::1]:22"},
+		"alice@corp@10.0.0.1:22":      {"alice@corp", "10.0.0.1:22"},
+	}
+	for target, expected := range tests {
+		userName, address, err := parseVerifyHost(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if userName != expected[0] || address != expected[1] {
+			t.Fatalf("expected %v for %s, got %s %s", expected, target, userName, address)
+		}
+	}
+	for _, target := range []string{"host.example.com", "@host", "alice@"} {
+		if _, _, err := parseVerifyHost(target); err == nil {
+			t.Fatalf("%s should have been rejected", target)
+		}
+	}
+}
+
+// startTestSSHServer accepts the user certs signed by caKey, returning
+// its address and a known_hosts line for its host key.
+func startTestSSHServer(t *testing.T, caKey ssh.PublicKey) (net.Listener, string) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromSigner(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), caKey.Marshal())
+		},
+	}
+	config := &ssh.ServerConfig{PublicKeyCallback: checker.Authenticate}
+	config.AddHostKey(hostSigner)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				go ssh.DiscardRequests(requests)
+				go func() {
+					for channel := range channels {
+						channel.Reject(ssh.Prohibited, "")
+					}
+				}()
+				serverConn.Wait()
+			}()
+		}
+	}()
+	line := knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, hostSigner.PublicKey())
+	return listener, line
+}
+
+func TestVerifyHostLogin(t *testing.T) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caSigner, err := ssh.NewSignerFromSigner(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(privateKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:             pub,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"username"},
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatal(err)
+	}
+	listener, knownHostsLine := startTestSSHServer(t, caSigner.PublicKey())
+	defer listener.Close()
+	dir, err := ioutil.TempDir("", "keymaster-verify-host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	if err := ioutil.WriteFile(knownHostsPath, []byte(knownHostsLine+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	certBytes := ssh.MarshalAuthorizedKey(cert)
+	target := "username@" + listener.Addr().String()
+	if err := verifyHostLogin(target, privateKey, certBytes, knownHostsPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyHostLogin("other@"+listener.Addr().String(), privateKey, certBytes, knownHostsPath); err == nil {
+		t.Fatal("a principal not in the cert should be refused")
+	}
+	if err := ioutil.WriteFile(knownHostsPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyHostLogin(target, privateKey, certBytes, knownHostsPath); err == nil {
+		t.Fatal("an unknown host key should be refused")
+	}
+}
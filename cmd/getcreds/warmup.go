@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+)
+
+// keyWarmup generates the key pair in the background so that the RSA
+// generation latency overlaps with other work, such as the password
+// prompt, instead of adding to it.
+type keyWarmup struct {
+	done   chan struct{}
+	signer crypto.Signer
+	pemKey []byte
+	err    error
+}
+
+// startKeyWarmup starts generating the key pair. A --keygen-command is
+// only run when the key is taken as it may use the terminal.
+func startKeyWarmup() *keyWarmup {
+	warmup := &keyWarmup{}
+	if len(*keygenCommand) > 0 {
+		return warmup
+	}
+	warnLowEntropy()
+	warmup.done = make(chan struct{})
+	go func() {
+		defer close(warmup.done)
+		warmup.signer, warmup.pemKey, warmup.err = newRSAKeyPair(rand.Reader)
+	}()
+	return warmup
+}
+
+// take returns the key pair, showing the keygen spinner while it is still
+// being generated.
+func (warmup *keyWarmup) take() (crypto.Signer, []byte, error) {
+	if warmup.done == nil {
+		return newKeyPair(rand.Reader)
+	}
+	select {
+	case <-warmup.done:
+	default:
+		stopSpinner := startKeygenSpinner(*rsaKeyBits)
+		<-warmup.done
+		stopSpinner()
+	}
+	return warmup.signer, warmup.pemKey, warmup.err
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/rsa"
+	"testing"
+)
+
+func TestKeyWarmup(t *testing.T) {
+	warmup := startKeyWarmup()
+	signer, pemKey, err := warmup.take()
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, ok := signer.(*rsa.PrivateKey)
+	if !ok {
+		t.Fatalf("expected an RSA key, got %T", signer)
+	}
+	if privateKey.N.BitLen() != *rsaKeyBits {
+		t.Fatalf("expected a %d bit key, got %d", *rsaKeyBits, privateKey.N.BitLen())
+	}
+	parsed, err := parsePrivateKeyPEM(pemKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !privateKey.PublicKey.Equal(parsed.Public()) {
+		t.Fatal("PEM key does not match the generated key")
+	}
+}
+
+func TestKeyWarmupKeygenCommandRunsOnTake(t *testing.T) {
+	*keygenCommand = "false"
+	defer func() { *keygenCommand = "" }()
+	warmup := startKeyWarmup()
+	if warmup.done != nil {
+		t.Fatal("the keygen command should not run in the background")
+	}
+	if _, _, err := warmup.take(); err == nil {
+		t.Fatal("should have failed running the keygen command")
+	}
+}
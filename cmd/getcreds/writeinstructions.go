@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/Symantec/keymaster/lib/webapi/v0/proto"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// writeInstructions is how the server asks the cert to be stored, the
+// zero value keeping the client defaults.
+type writeInstructions struct {
+	// Filename replaces the default cert file name. It is scoped to the
+	// key, see certPath.
+	Filename   string
+	Mode       os.FileMode
+	AddToAgent bool
+}
+
+// certFileSuffix is the suffix every file name of certType must end with,
+// the one of the default cert file names.
+func certFileSuffix(certType string) string {
+	if certType == "x509" {
+		return "-x509Cert" + x509FormatExtensions[*x509Format]
+	}
+	return "-cert.pub"
+}
+
+// parseWriteInstructions reads the instructions of a certgen response for
+// certType. File names must end like the default cert file names and
+// modes are restricted to files not writable by others, so that a server
+// cannot overwrite the keys or the ssh config.
+func parseWriteInstructions(header http.Header, certType string) (writeInstructions, error) {
+	var instructions writeInstructions
+	if filename := header.Get(proto.CertFilenameHeader); len(filename) > 0 {
+		suffix := certFileSuffix(certType)
+		if filename != filepath.Base(filename) || strings.ContainsAny(filename, `/\`) ||
+			!strings.HasSuffix(filename, suffix) || len(filename) <= len(suffix) {
+			return instructions, fmt.Errorf("invalid cert file name '%s' from the server", filename)
+		}
+		instructions.Filename = filename
+	}
+	if mode := header.Get(proto.CertFileModeHeader); len(mode) > 0 {
+		value, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || value > 0777 || value&0022 != 0 || value&0400 == 0 {
+			return instructions, fmt.Errorf("invalid cert file mode '%s' from the server", mode)
+		}
+		instructions.Mode = os.FileMode(value)
+	}
+	if addToAgent := header.Get(proto.CertAddToAgentHeader); len(addToAgent) > 0 {
+		value, err := strconv.ParseBool(addToAgent)
+		if err != nil {
+			return instructions, fmt.Errorf("invalid add to agent value '%s' from the server", addToAgent)
+		}
+		instructions.AddToAgent = value
+	}
+	return instructions, nil
+}
+
+// certPath returns where the cert of the key at privateKeyPath, whose
+// default location is defaultPath, is written. The instructed file name
+// is prefixed with the key file name, so that the certs of several keys
+// never share a file and no other file of the directory can be named.
+func (instructions writeInstructions) certPath(privateKeyPath string, defaultPath string) string {
+	if *ignoreInstructions || len(instructions.Filename) < 1 {
+		return defaultPath
+	}
+	return privateKeyPath + "-" + instructions.Filename
+}
+
+// writeCert writes a cert of the key at privateKeyPath whose default
+// location is defaultPath, honoring the server instructions unless
+// --ignore-write-instructions is set. An instructed file is only replaced
+// when isCert accepts its content.
+func (instructions writeInstructions) writeCert(privateKeyPath string, defaultPath string, cert []byte, isCert func([]byte) bool) error {
+	path := instructions.certPath(privateKeyPath, defaultPath)
+	if path != defaultPath {
+		content, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil && !isCert(content) {
+			return fmt.Errorf("refusing to replace %s, which is not a cert", path)
+		}
+	}
+	mode := instructions.Mode
+	if mode == 0 || *ignoreInstructions {
+		mode = 0644
+	}
+	return writeFileAtomic(path, cert, mode, ".keymaster-cert-")
+}
+
+func isSSHCertFile(content []byte) bool {
+	_, err := parseSSHCert(content)
+	return err == nil
+}
+
+// isX509CertFile accepts the x509 certs of every --x509-format.
+func isX509CertFile(content []byte) bool {
+	if block, _ := pem.Decode(content); block != nil {
+		return block.Type == "CERTIFICATE"
+	}
+	der := content
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content))); err == nil {
+		der = decoded
+	}
+	_, err := x509.ParseCertificate(der)
+	return err == nil
+}
+
+// instructedCertPaths returns the cert files the server asked for in place
+// of the default ones, keyPaths holding the private key path of each
+// material, so that they get the --on-existing policy and the rollback
+// of the default files.
+func instructedCertPaths(keyPaths []string, materials []certMaterial) []string {
+	var paths []string
+	for i, material := range materials {
+		if i >= len(keyPaths) {
+			break
+		}
+		sshDefault := keyPaths[i] + "-cert.pub"
+		if path := material.SSHInstructions.certPath(keyPaths[i], sshDefault); path != sshDefault {
+			paths = append(paths, path)
+		}
+		x509Default := x509CertPath(keyPaths[i])
+		if path := material.X509Instructions.certPath(keyPaths[i], x509Default); path != x509Default {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// addInstructedCertToAgent adds the key and its ssh cert to ssh-agent when
+// the server asked for it. Failures are only logged as the cert is already
+// written.
+func addInstructedCertToAgent(privateKey crypto.Signer, material certMaterial) {
+	if *ignoreInstructions || !material.SSHInstructions.AddToAgent || material.SSHCert == nil {
+		return
+	}
+	if *useAgentKey || *memoryOnly {
+		return
+	}
+	cert, err := parseSSHCert(material.SSHCert)
+	if err != nil {
+		log.Printf("cannot add the ssh cert to ssh-agent: %s", err)
+		return
+	}
+	sshAgent, conn, err := connectToAgent()
+	if err != nil {
+		log.Printf("cannot add the ssh cert to ssh-agent: %s", err)
+		return
+	}
+	defer conn.Close()
+	if err := addCertToAgent(sshAgent, privateKey, cert, time.Now()); err != nil {
+		log.Printf("cannot add the ssh cert to ssh-agent: %s", err)
+		return
+	}
+	log.Printf("added the ssh cert %s to ssh-agent as asked by the server", cert.KeyId)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/Symantec/keymaster/lib/webapi/v0/proto"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseWriteInstructions(t *testing.T) {
+	header := http.Header{}
+	header.Set(proto.CertFilenameHeader, "fleet-cert.pub")
+	header.Set(proto.CertFileModeHeader, "0600")
+	header.Set(proto.CertAddToAgentHeader, "true")
+	instructions, err := parseWriteInstructions(header, "ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := writeInstructions{Filename: "fleet-cert.pub", Mode: 0600, AddToAgent: true}
+	if instructions != expected {
+		t.Fatalf("expected %+v got %+v", expected, instructions)
+	}
+	for _, filename := range []string{"../id_rsa-cert.pub", "/etc/passwd", "..", `dir\cert-cert.pub`,
+		"authorized_keys", "-cert.pub", "fleet-x509Cert.pem"} {
+		header := http.Header{}
+		header.Set(proto.CertFilenameHeader, filename)
+		if _, err := parseWriteInstructions(header, "ssh"); err == nil {
+			t.Errorf("should have refused the file name '%s'", filename)
+		}
+	}
+	header = http.Header{}
+	header.Set(proto.CertFilenameHeader, "fleet-x509Cert.pem")
+	if _, err := parseWriteInstructions(header, "x509"); err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []string{"0666", "0200", "rw", "01644"} {
+		header := http.Header{}
+		header.Set(proto.CertFileModeHeader, mode)
+		if _, err := parseWriteInstructions(header, "ssh"); err == nil {
+			t.Errorf("should have refused the mode '%s'", mode)
+		}
+	}
+}
+
+func TestFilePersisterHonorsWriteInstructions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster-instructions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	privateKeyPath := filepath.Join(dir, "keymaster")
+	material := certMaterial{
+		SSHCert:         []byte("ssh cert"),
+		SSHInstructions: writeInstructions{Filename: "fleet-cert.pub", Mode: 0600},
+	}
+	if err := filePersister(privateKeyPath)(material); err != nil {
+		t.Fatal(err)
+	}
+	instructedPath := filepath.Join(dir, "keymaster-fleet-cert.pub")
+	info, err := os.Stat(instructedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected mode 0600 got %o", info.Mode().Perm())
+	}
+	paths := instructedCertPaths([]string{privateKeyPath}, []certMaterial{material})
+	if len(paths) != 1 || paths[0] != instructedPath {
+		t.Fatalf("unexpected instructed paths %v", paths)
+	}
+	// what was written is not a real cert, so it must not be replaced
+	if err := filePersister(privateKeyPath)(material); err == nil {
+		t.Fatal("should have refused to replace a file that is not a cert")
+	}
+
+	*ignoreInstructions = true
+	defer func() { *ignoreInstructions = false }()
+	if err := filePersister(privateKeyPath)(material); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(privateKeyPath + "-cert.pub"); err != nil {
+		t.Fatal("the instructions should have been ignored")
+	}
+}
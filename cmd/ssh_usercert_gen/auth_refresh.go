@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Symantec/keymaster/lib/webapi/v0/proto"
+	"log"
+	"net/http"
+	"time"
+)
+
+// issueRefreshToken adds a refresh token for username to the response of a
+// successful 2FA, when refresh_token_lifetime_seconds enables them.
+func (state *RuntimeState) issueRefreshToken(w http.ResponseWriter, username string) error {
+	lifetime := state.Config.Base.RefreshTokenLifetimeSeconds
+	if lifetime < 1 {
+		return nil
+	}
+	token, err := genRandomString()
+	if err != nil {
+		return err
+	}
+	expiration := time.Now().Add(time.Duration(lifetime) * time.Second)
+	state.Mutex.Lock()
+	state.refreshTokens[token] = authInfo{Username: username, ExpiresAt: expiration, AuthType: AuthTypeU2F}
+	state.Mutex.Unlock()
+	w.Header().Set(proto.RefreshTokenHeader, token)
+	w.Header().Set(proto.RefreshTokenExpiresHeader, expiration.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// refreshHandler exchanges a refresh token, sent as the password of a login
+// request, for a new session with the auth type of the 2FA that issued it.
+func (state *RuntimeState) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if r.Method != "GET" && r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		log.Println(err)
+		state.writeFailureResponse(w, r, http.StatusBadRequest, "Error parsing form")
+		return
+	}
+	username, token, ok := r.BasicAuth()
+	if !ok {
+		username = r.Form.Get("username")
+		token = r.Form.Get("password")
+	}
+	if len(username) < 1 || len(token) < 1 {
+		state.writeFailureResponse(w, r, http.StatusUnauthorized, "")
+		return
+	}
+	state.Mutex.Lock()
+	info, ok := state.refreshTokens[token]
+	state.Mutex.Unlock()
+	if !ok || info.Username != username || info.ExpiresAt.Before(time.Now()) {
+		state.writeFailureResponse(w, r, http.StatusUnauthorized, "")
+		log.Printf("Invalid refresh token for %s", username)
+		return
+	}
+	cookieVal, err := genRandomString()
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "error internal")
+		log.Println(err)
+		return
+	}
+	expiration := time.Now().Add(time.Duration(maxAgeSecondsAuthCookie) * time.Second)
+	state.Mutex.Lock()
+	state.authCookie[cookieVal] = authInfo{Username: username, ExpiresAt: expiration, AuthType: info.AuthType}
+	state.Mutex.Unlock()
+	authCookie := http.Cookie{Name: authCookieName, Value: cookieVal, Expires: expiration, Path: "/", HttpOnly: true, Secure: true}
+	http.SetCookie(w, &authCookie)
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(proto.LoginResponse{Message: "success"})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/Symantec/keymaster/lib/webapi/v0/proto"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRefreshToken(t *testing.T) {
+	var state RuntimeState
+	signer, err := getSignerFromPEMBytes([]byte(testSignerPrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Signer = signer
+	state.authCookie = make(map[string]authInfo)
+	state.refreshTokens = make(map[string]authInfo)
+
+	rr := httptest.NewRecorder()
+	if err := state.issueRefreshToken(rr, "username"); err != nil {
+		t.Fatal(err)
+	}
+	if len(rr.Header().Get(proto.RefreshTokenHeader)) > 0 {
+		t.Fatal("no refresh token should be issued when they are not enabled")
+	}
+	state.Config.Base.RefreshTokenLifetimeSeconds = 3600
+	rr = httptest.NewRecorder()
+	if err := state.issueRefreshToken(rr, "username"); err != nil {
+		t.Fatal(err)
+	}
+	token := rr.Header().Get(proto.RefreshTokenHeader)
+	if len(token) < 1 {
+		t.Fatal("no refresh token issued")
+	}
+	if _, err := time.Parse(time.RFC3339, rr.Header().Get(proto.RefreshTokenExpiresHeader)); err != nil {
+		t.Fatal(err)
+	}
+
+	refreshRequest := func(username, token string) *http.Request {
+		form := url.Values{}
+		form.Add("username", username)
+		form.Add("password", token)
+		req, err := http.NewRequest("POST", proto.RefreshPath, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+	for _, req := range []*http.Request{
+		refreshRequest("username", "invalid"),
+		refreshRequest("other", token),
+		refreshRequest("username", ""),
+	} {
+		if _, err := checkRequestHandlerCode(req, state.refreshHandler, http.StatusUnauthorized); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rr, err = checkRequestHandlerCode(refreshRequest("username", token), state.refreshHandler, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkValidLoginResponse(rr.Result(), &state, "username") {
+		t.Fatal("no valid session from the refresh token")
+	}
+	for _, info := range state.authCookie {
+		if info.AuthType != AuthTypeU2F {
+			t.Fatalf("session auth type %d instead of u2f", info.AuthType)
+		}
+	}
+
+	info := state.refreshTokens[token]
+	info.ExpiresAt = time.Now().Add(-time.Second)
+	state.refreshTokens[token] = info
+	if _, err := checkRequestHandlerCode(refreshRequest("username", token), state.refreshHandler, http.StatusUnauthorized); err != nil {
+		t.Fatal(err)
+	}
+}
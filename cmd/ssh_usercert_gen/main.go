@@ -45,6 +45,7 @@ const (
 	AuthTypePassword = 1 << iota
 	AuthTypeFederated
 	AuthTypeU2F
+	AuthTypeClientCert
 )
 
 type authInfo struct {
@@ -79,10 +80,12 @@ type RuntimeState struct {
 	SSHCARawFileContent []byte
 	Signer              crypto.Signer
 	ClientCAPool        *x509.CertPool
+	ClientCertAuthCAs   *x509.CertPool
 	HostIdentity        string
 	KerberosRealm       *string
 	caCertDer           []byte
 	authCookie          map[string]authInfo
+	refreshTokens       map[string]authInfo
 	SignerIsReady       chan bool
 	Mutex               sync.Mutex
 	//userProfile         map[string]userProfile
@@ -152,6 +155,11 @@ func (state *RuntimeState) performStateCleanup(secsBetweenCleanup int) {
 			}
 		}
 		finalAuthSize := len(state.authCookie)
+		for key, authInfo := range state.refreshTokens {
+			if authInfo.ExpiresAt.Before(time.Now()) {
+				delete(state.refreshTokens, key)
+			}
+		}
 
 		//
 		initPendingSize := len(state.pendingOauth2)
@@ -375,11 +383,20 @@ func (state *RuntimeState) certGenHandler(w http.ResponseWriter, r *http.Request
 	/*
 	 */
 	// TODO(camilo_viecco1): reorder checks so that simple checks are done before checking user creds
-	authUser, authLevel, err := state.checkAuth(w, r)
-	if err != nil {
-		log.Printf("%v", err)
+	// Service accounts authenticate with their client cert alone, for
+	// certgen only
+	var authUser string
+	var authLevel int
+	var err error
+	if clientCertUser, ok := state.clientCertAuthUser(r); ok {
+		authUser, authLevel = clientCertUser, AuthTypeClientCert
+	} else {
+		authUser, authLevel, err = state.checkAuth(w, r)
+		if err != nil {
+			log.Printf("%v", err)
 
-		return
+			return
+		}
 	}
 
 	sufficientAuthLevel := false
@@ -393,6 +410,10 @@ func (state *RuntimeState) certGenHandler(w http.ResponseWriter, r *http.Request
 	if (authLevel & AuthTypeU2F) == AuthTypeU2F {
 		sufficientAuthLevel = true
 	}
+	// so can the service accounts allowed to use their client cert
+	if (authLevel & AuthTypeClientCert) == AuthTypeClientCert {
+		sufficientAuthLevel = true
+	}
 
 	if !sufficientAuthLevel {
 		state.writeFailureResponse(w, r, http.StatusBadRequest, "Not enough auth level for getting certs")
@@ -401,9 +422,12 @@ func (state *RuntimeState) certGenHandler(w http.ResponseWriter, r *http.Request
 
 	targetUser := r.URL.Path[len(certgenPath):]
 	if authUser != targetUser {
-		state.writeFailureResponse(w, r, http.StatusForbidden, "")
-		log.Printf("User %s asking for creds for %s", authUser, targetUser)
-		return
+		if !state.isDelegationAllowed(authUser, r) {
+			state.writeFailureResponse(w, r, http.StatusForbidden, "")
+			log.Printf("User %s asking for creds for %s", authUser, targetUser)
+			return
+		}
+		log.Printf("User %s requesting creds on behalf of %s", authUser, targetUser)
 	}
 	if *debug {
 		log.Printf("auth succedded for %s", authUser)
@@ -459,6 +483,88 @@ func (state *RuntimeState) certGenHandler(w http.ResponseWriter, r *http.Request
 
 }
 
+// isDelegationAllowed reports whether authUser may get certs for another
+// user: it must be a delegation admin and name itself in the request, so
+// that a delegation is never the accident of a stale cookie.
+func (state *RuntimeState) isDelegationAllowed(authUser string, r *http.Request) bool {
+	if r.URL.Query().Get(proto.DelegatedByParam) != authUser {
+		return false
+	}
+	for _, admin := range state.Config.Base.DelegationAdmins {
+		if admin == authUser {
+			return true
+		}
+	}
+	return false
+}
+
+// clientCertAuthUser returns the user authenticated by the TLS client cert
+// of r, when its common name is one of the service accounts allowed to get
+// certs without a password. The cert must chain to client_cert_auth_ca and
+// must not be issued by this server, so that the x509 certs it issues
+// cannot renew themselves.
+func (state *RuntimeState) clientCertAuthUser(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) < 1 {
+		return "", false
+	}
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+	if state.ClientCertAuthCAs == nil {
+		return "", false
+	}
+	clientCert := r.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := clientCert.Verify(x509.VerifyOptions{
+		Roots:         state.ClientCertAuthCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return "", false
+	}
+	if len(state.caCertDer) > 0 {
+		caCert, err := x509.ParseCertificate(state.caCertDer)
+		if err != nil {
+			return "", false
+		}
+		err = caCert.CheckSignature(clientCert.SignatureAlgorithm,
+			clientCert.RawTBSCertificate, clientCert.Signature)
+		if err == nil {
+			log.Printf("Refusing client cert auth with a cert issued by keymaster for %s",
+				clientCert.Subject.CommonName)
+			return "", false
+		}
+	}
+	clientName := clientCert.Subject.CommonName
+	for _, allowed := range state.Config.Base.ClientCertAuthUsers {
+		if allowed == clientName {
+			return clientName, true
+		}
+	}
+	return "", false
+}
+
+// setWriteInstructions adds the configured instructions on how to store
+// the certs of certType to a certgen response.
+func (state *RuntimeState) setWriteInstructions(w http.ResponseWriter, certType string) {
+	instructions, ok := state.Config.Base.CertWriteInstructions[certType]
+	if !ok {
+		return
+	}
+	if len(instructions.Filename) > 0 {
+		w.Header().Set(proto.CertFilenameHeader, instructions.Filename)
+	}
+	if len(instructions.Mode) > 0 {
+		w.Header().Set(proto.CertFileModeHeader, instructions.Mode)
+	}
+	if instructions.AddToAgent {
+		w.Header().Set(proto.CertAddToAgentHeader, "true")
+	}
+}
+
 func (state *RuntimeState) postAuthSSHCertHandler(w http.ResponseWriter, r *http.Request, targetUser string, keySigner crypto.Signer) {
 	signer, err := ssh.NewSignerFromSigner(keySigner)
 	if err != nil {
@@ -513,6 +619,7 @@ func (state *RuntimeState) postAuthSSHCertHandler(w http.ResponseWriter, r *http
 
 	}
 	w.Header().Set("Content-Disposition", `attachment; filename="id_rsa-cert.pub"`)
+	state.setWriteInstructions(w, "ssh")
 	w.WriteHeader(200)
 	fmt.Fprintf(w, "%s", cert)
 	log.Printf("Generated SSH Certifcate for %s", targetUser)
@@ -571,6 +678,7 @@ func (state *RuntimeState) postAuthX509CertHandler(w http.ResponseWriter, r *htt
 
 	}
 	w.Header().Set("Content-Disposition", `attachment; filename="userCert.pem"`)
+	state.setWriteInstructions(w, "x509")
 	w.WriteHeader(200)
 	fmt.Fprintf(w, "%s", cert)
 	log.Printf("Generated x509 Certifcate for %s", targetUser)
@@ -1176,6 +1284,10 @@ func (state *RuntimeState) u2fSignResponse(w http.ResponseWriter, r *http.Reques
 				return
 			}
 
+			if err := state.issueRefreshToken(w, authUser); err != nil {
+				log.Printf("cannot issue refresh token: %v", err)
+			}
+
 			// TODO: update local cookie state
 			w.Write([]byte("success"))
 			return
@@ -1341,6 +1453,14 @@ func (state *RuntimeState) u2fTokenManagerHandler(w http.ResponseWriter, r *http
 	return
 }
 
+func (state *RuntimeState) versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proto.VersionResponse{
+		Version:        Version,
+		PasswordPrompt: state.Config.Base.PasswordPrompt,
+	})
+}
+
 func (state *RuntimeState) defaultPathHandler(w http.ResponseWriter, r *http.Request) {
 	//redirect to profile
 	if r.URL.Path[:] == "/" {
@@ -1393,6 +1513,8 @@ func main() {
 	serviceMux.HandleFunc(certgenPath, runtimeState.certGenHandler)
 	serviceMux.HandleFunc(publicPath, runtimeState.publicPathHandler)
 	serviceMux.HandleFunc(proto.LoginPath, runtimeState.loginHandler)
+	serviceMux.HandleFunc(proto.RefreshPath, runtimeState.refreshHandler)
+	serviceMux.HandleFunc(proto.VersionPath, runtimeState.versionHandler)
 	serviceMux.HandleFunc(logoutPath, runtimeState.logoutHandler)
 	serviceMux.HandleFunc(profilePath, runtimeState.profileHandler)
 
@@ -1438,10 +1560,16 @@ func main() {
 		panic("got bad singer ready data")
 	}
 
+	// The service port only verifies the client certs of service accounts
+	serviceCfg := cfg
+	if runtimeState.ClientCertAuthCAs != nil {
+		serviceCfg = cfg.Clone()
+		serviceCfg.ClientCAs = runtimeState.ClientCertAuthCAs
+	}
 	serviceSrv := &http.Server{
 		Addr:         runtimeState.Config.Base.HttpAddress,
 		Handler:      serviceMux,
-		TLSConfig:    cfg,
+		TLSConfig:    serviceCfg,
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0),
 	}
 
@@ -2,12 +2,16 @@ package main
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	//"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/Symantec/keymaster/lib/certgen"
 	"github.com/Symantec/keymaster/lib/webapi/v0/proto"
 	"io"
 	"io/ioutil"
@@ -785,3 +789,72 @@ func TestU2fTokenManagerHandlerDeleteSuccess(t *testing.T) {
 		t.Fatal("update not successul")
 	}
 }
+
+func TestClientCertAuthUser(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name())
+	state.Config.Base.ClientCertAuthUsers = []string{"service"}
+
+	authKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authCADer, err := certgen.GenSelfSignedCACert("client auth CA", "TestOrg", authKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authCA, err := x509.ParseCertificate(authCADer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keymasterCA, err := x509.ParseCertificate(state.caCertDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert := func(userName string, caCert *x509.Certificate, caPriv crypto.Signer) *x509.Certificate {
+		der, err := certgen.GenUserX509Cert(userName, authKey.Public(), caCert, caPriv, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	certGenRequest := func(cert *x509.Certificate) *http.Request {
+		req := httptest.NewRequest("POST", "/certgen/service", nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		return req
+	}
+	serviceCert := clientCert("service", authCA, authKey)
+	if _, ok := state.clientCertAuthUser(certGenRequest(serviceCert)); ok {
+		t.Fatal("client cert auth should need a client_cert_auth_ca")
+	}
+
+	// the keymaster CA is trusted by mistake, its certs are still refused
+	state.ClientCertAuthCAs = x509.NewCertPool()
+	state.ClientCertAuthCAs.AddCert(authCA)
+	state.ClientCertAuthCAs.AddCert(keymasterCA)
+	userName, ok := state.clientCertAuthUser(certGenRequest(serviceCert))
+	if !ok || userName != "service" {
+		t.Fatalf("service cert not accepted, got '%s'", userName)
+	}
+	for _, cert := range []*x509.Certificate{
+		clientCert("other", authCA, authKey),
+		clientCert("service", keymasterCA, state.Signer),
+	} {
+		if _, ok := state.clientCertAuthUser(certGenRequest(cert)); ok {
+			t.Fatalf("cert of '%s' from '%s' should be refused",
+				cert.Subject.CommonName, cert.Issuer.CommonName)
+		}
+	}
+
+	// the client cert authenticates certgen requests only
+	if _, _, err := state.checkAuth(httptest.NewRecorder(), certGenRequest(serviceCert)); err == nil {
+		t.Fatal("the client cert should not authenticate other handlers")
+	}
+}
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"golang.org/x/crypto/ssh"
+	"io"
+)
+
+// NewRSAKeyPair generates an RSA key of bits from random, returning it with
+// its PKCS1 PEM encoding. A nil random means crypto/rand. Note that the
+// standard library deliberately makes RSA generation non deterministic, so
+// even a seeded random gives a new key every time.
+func NewRSAKeyPair(random io.Reader, bits int) (crypto.Signer, []byte, error) {
+	if random == nil {
+		random = rand.Reader
+	}
+	privateKey, err := rsa.GenerateKey(random, bits)
+	if err != nil {
+		return nil, nil, err
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	return privateKey, pemKey, nil
+}
+
+// NewEd25519KeyPair generates an Ed25519 key from random, returning it with
+// its PEM encoding in the OpenSSH format, the only one ssh reads Ed25519
+// keys in. A nil random means crypto/rand. The key is fully determined by
+// random: tests may pass a seeded source for fixed keys, which must never
+// be done for real keys.
+func NewEd25519KeyPair(random io.Reader) (crypto.Signer, []byte, error) {
+	if random == nil {
+		random = rand.Reader
+	}
+	_, privateKey, err := ed25519.GenerateKey(random)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(privateKey, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	return privateKey, pem.EncodeToMemory(block), nil
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"io"
+	mathrand "math/rand"
+	"testing"
+)
+
+// seededRandom is a deterministic random source giving fixed test keys.
+// It only exists in tests so that it cannot end up generating real keys.
+func seededRandom(seed int64) io.Reader {
+	return mathrand.New(mathrand.NewSource(seed))
+}
+
+func TestNewEd25519KeyPairSeeded(t *testing.T) {
+	first, _, err := NewEd25519KeyPair(seededRandom(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := NewEd25519KeyPair(seededRandom(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := NewEd25519KeyPair(seededRandom(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Public().(ed25519.PublicKey).Equal(second.Public()) {
+		t.Fatal("the same seed should give the same key")
+	}
+	if first.Public().(ed25519.PublicKey).Equal(other.Public()) {
+		t.Fatal("different seeds should give different keys")
+	}
+}
+
+func TestNewEd25519KeyPairRoundTrip(t *testing.T) {
+	signer, pemKey, err := NewEd25519KeyPair(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ssh.ParseRawPrivateKey(pemKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !signer.Public().(ed25519.PublicKey).Equal(parsed.(*ed25519.PrivateKey).Public()) {
+		t.Fatal("parsed key does not match the generated key")
+	}
+}
@@ -0,0 +1,123 @@
+// Package client holds the parts of the keymaster client that programs
+// embedding it can reuse, with the hooks they need to adapt it.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"time"
+)
+
+const maxRedirects = 10
+
+// DialContextFunc dials the connections to the keymaster servers, letting
+// embedders replace how connections are established.
+type DialContextFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// CheckRedirect only follows redirects within the origin of the original
+// request, re-applying the auth headers that net/http would otherwise drop.
+// Cookies are re-applied by the cookie jar. Redirects to another origin (an
+// SSO provider or a different host) are refused so that credentials are
+// never leaked.
+func CheckRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.New("stopped after too many redirects")
+	}
+	original := via[0]
+	if req.URL.Scheme != original.URL.Scheme || req.URL.Host != original.URL.Host {
+		return fmt.Errorf("refusing to follow cross-origin redirect from '%s://%s' to '%s'",
+			original.URL.Scheme, original.URL.Host, req.URL)
+	}
+	if value := original.Header.Get("Authorization"); len(value) > 0 {
+		req.Header.Set("Authorization", value)
+	}
+	return nil
+}
+
+func proxyProtocolHeader(conn net.Conn) (string, error) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return "", errors.New("PROXY protocol requires a TCP connection")
+	}
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return "", errors.New("PROXY protocol requires a TCP connection")
+	}
+	family := "TCP6"
+	if local.IP.To4() != nil && remote.IP.To4() != nil {
+		family = "TCP4"
+	}
+	return fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family,
+		local.IP, remote.IP, local.Port, remote.Port), nil
+}
+
+// WithProxyProtocol wraps dial so that every new connection starts with a
+// PROXY protocol v1 header, as expected by some L4 load balancers.
+func WithProxyProtocol(dial DialContextFunc) DialContextFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		header, err := proxyProtocolHeader(conn)
+		if err == nil {
+			_, err = conn.Write([]byte(header))
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+func getParseURLEnvVariable(name string) (*url.URL, error) {
+	envVariable := os.Getenv(name)
+	if len(envVariable) < 1 {
+		return nil, nil
+	}
+	return url.Parse(envVariable)
+}
+
+// NewHTTPClient returns a client to talk to keymaster, using dial for the
+// connections, or a plain net.Dialer when nil. Its cookie jar only sends
+// the login cookies back to the host and path they were scoped to, and it
+// follows redirects with CheckRedirect.
+func NewHTTPClient(tlsConfig *tls.Config, dial DialContextFunc) (*http.Client, error) {
+	if dial == nil {
+		dialer := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}
+		dial = dialer.DialContext
+	}
+	clientTransport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+		DialContext:     dial,
+	}
+
+	// proxy env variables in ascending order of preference, lower case 'http_proxy' dominates
+	// just like curl
+	proxyEnvVariables := []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy"}
+	for _, proxyVar := range proxyEnvVariables {
+		httpProxy, err := getParseURLEnvVariable(proxyVar)
+		if err == nil && httpProxy != nil {
+			clientTransport.Proxy = http.ProxyURL(httpProxy)
+		}
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport:     clientTransport,
+		Timeout:       5 * time.Second,
+		CheckRedirect: CheckRedirect,
+		Jar:           jar,
+	}, nil
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithProxyProtocolSendsHeader(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	headers := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			headers <- err.Error()
+			return
+		}
+		defer conn.Close()
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			headers <- err.Error()
+			return
+		}
+		headers <- line
+	}()
+	var dialer net.Dialer
+	dial := WithProxyProtocol(dialer.DialContext)
+	conn, err := dial(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.TCPAddr)
+	expected := fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %d %d\r\n",
+		local.Port, listener.Addr().(*net.TCPAddr).Port)
+	if header := <-headers; header != expected {
+		t.Fatalf("expected header '%q' got '%q'", expected, header)
+	}
+}
+
+func TestNewHTTPClientUsesDial(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	dials := 0
+	var dialer net.Dialer
+	client, err := NewHTTPClient(nil,
+		func(ctx context.Context, network, address string) (net.Conn, error) {
+			dials++
+			return dialer.DialContext(ctx, network, address)
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if dials != 1 {
+		t.Fatalf("expected the custom dial to be used once, got %d", dials)
+	}
+}
@@ -2,6 +2,35 @@ package proto
 
 const LoginPath = "/api/v0/login"
 
+const VersionPath = "/api/v0/version"
+
+// RefreshPath exchanges a refresh token, sent as the password of a login
+// request, for a new session. Servers issue refresh tokens after a
+// successful 2FA in the RefreshTokenHeader of the response, with their
+// RFC 3339 expiry in RefreshTokenExpiresHeader.
+const RefreshPath = "/api/v0/refresh"
+
+const (
+	RefreshTokenHeader        = "X-Keymaster-Refresh-Token"
+	RefreshTokenExpiresHeader = "X-Keymaster-Refresh-Token-Expires"
+)
+
+// DelegatedByParam names the authenticated user in certgen requests for
+// another user. Servers only honor them for their delegation admins.
+const DelegatedByParam = "delegated_by"
+
+// Headers of certgen responses telling clients how to store the cert, set
+// by servers managing a fleet. CertFilenameHeader is a file name ending
+// like the default cert file names (-cert.pub for ssh certs), which clients
+// prefix with the key file name, CertFileModeHeader an octal mode such as
+// 0600 and CertAddToAgentHeader "true" to also add the ssh cert to
+// ssh-agent. Clients may override them locally.
+const (
+	CertFilenameHeader   = "X-Keymaster-Cert-Filename"
+	CertFileModeHeader   = "X-Keymaster-Cert-Mode"
+	CertAddToAgentHeader = "X-Keymaster-Cert-Add-To-Agent"
+)
+
 const (
 	AuthTypePassword = "password"
 	AuthTypeU2F      = "U2F"
@@ -11,3 +40,10 @@ type LoginResponse struct {
 	Message         string   `json:"message"`
 	CertAuthBackend []string `json:"auth_backend"`
 }
+
+type VersionResponse struct {
+	Version string `json:"version"`
+	// Text clients should display when asking for the password, such as
+	// "Enter your PIN+OTP:", empty for the default prompt.
+	PasswordPrompt string `json:"password_prompt,omitempty"`
+}